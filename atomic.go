@@ -0,0 +1,177 @@
+package squashfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrLocked - another extractor holds the lock on the destination.
+var ErrLocked = errors.New("destination is locked by another extraction")
+
+// lockPath - the lock file of an atomic extraction into dir, next to it as dir
+// itself is replaced.
+func lockPath(dir string) string {
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".lock")
+}
+
+// lockDir - take the extraction lock for dir, return the function that releases it.
+// The lock is a flock of dir itself.  An atomic extraction replaces dir, so it
+// also locks the file lockPath(dir), which is left in place: removing it would
+// race with the next locker.
+func lockDir(dir string, atomic bool) (func(), error) {
+	unlocks := []func(){}
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	if atomic {
+		u, err := flockPath(dir, lockPath(dir), os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			return nil, err
+		}
+		unlocks = append(unlocks, u)
+	}
+	u, err := flockPath(dir, dir, os.O_RDONLY)
+	if err != nil && !(atomic && os.IsNotExist(err)) {
+		unlock()
+		return nil, err
+	} else if err == nil {
+		unlocks = append(unlocks, u)
+	}
+	return unlock, nil
+}
+
+// flockPath - take an exclusive flock on the file at path, opened with flag, for
+// the extraction into dir.  Return the function that releases it.
+func flockPath(dir, path string, flag int) (func(), error) {
+	fp, err := os.OpenFile(path, flag, DefaultFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(fp.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		fp.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s: %w", dir, ErrLocked)
+		}
+		return nil, err
+	}
+	return func() {
+		unix.Flock(int(fp.Fd()), unix.LOCK_UN)
+		fp.Close()
+	}, nil
+}
+
+// runAtomic - run the extraction into a staging directory next to e.Dir, and
+// put it in place of e.Dir only if it all worked.  An existing e.Dir is
+// swapped out with renameat2(RENAME_EXCHANGE) and then removed.
+func (e *Extractor) runAtomic(ctx context.Context, walker func(WalkFunc) error) error {
+	if e.Sync || e.Delete {
+		return fmt.Errorf("atomic extraction starts from an empty tree, it cannot be used with Sync or Delete")
+	}
+
+	// run holds the lock of dest.
+	dest := filepath.Clean(e.Dir)
+	stage, err := ioutil.TempDir(filepath.Dir(dest), "."+filepath.Base(dest)+".stage-")
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(DefaultDirPerm)
+	if fi, err := os.Stat(dest); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(stage, mode); err != nil {
+		removeTree(stage)
+		return err
+	}
+
+	e.Logger.Debug("extracting to staging directory %s", stage)
+	e.Dir = stage
+	err = e.runIn(ctx, walker)
+	e.Dir = dest
+	if err != nil {
+		if rmErr := removeTree(stage); rmErr != nil {
+			e.Logger.Info("failed removing staging directory %s: %s", stage, rmErr)
+		}
+		return err
+	}
+
+	return e.replaceDir(stage, dest)
+}
+
+// replaceDir - put the directory stage in place of dest.
+func (e *Extractor) replaceDir(stage, dest string) error {
+	if _, err := os.Lstat(dest); os.IsNotExist(err) {
+		return os.Rename(stage, dest)
+	}
+
+	err := unix.Renameat2(unix.AT_FDCWD, stage, unix.AT_FDCWD, dest, unix.RENAME_EXCHANGE)
+	if err == unix.ENOSYS || err == unix.EINVAL {
+		// no RENAME_EXCHANGE here: move dest out of the way, then stage in.
+		e.Logger.Debug("renameat2(RENAME_EXCHANGE) not supported: %s", err)
+		old := stage + ".old"
+		if err := os.Rename(dest, old); err != nil {
+			removeTree(stage)
+			return err
+		}
+		if err := os.Rename(stage, dest); err != nil {
+			if rbErr := os.Rename(old, dest); rbErr != nil {
+				e.Logger.Info("failed to put %s back to %s: %s", old, dest, rbErr)
+			}
+			removeTree(stage)
+			return err
+		}
+		stage = old
+	} else if err != nil {
+		removeTree(stage)
+		return fmt.Errorf("failed to exchange %s and %s: %s", stage, dest, err)
+	}
+
+	// stage now holds the old tree.
+	if err := removeTree(stage); err != nil {
+		e.Logger.Info("failed removing old tree %s: %s", stage, err)
+	}
+	return nil
+}
+
+// removeTree - os.RemoveAll, making directories writable first.
+func removeTree(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() && fi.Mode().Perm()&0700 != 0700 {
+		if err := os.Chmod(path, fi.Mode().Perm()|0700); err != nil {
+			return err
+		}
+	}
+	if fi.IsDir() {
+		names, err := dirNames(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := removeTree(filepath.Join(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(path)
+}
+
+func dirNames(dir string) ([]string, error) {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return fp.Readdirnames(-1)
+}
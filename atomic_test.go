@@ -0,0 +1,52 @@
+package squashfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractTakesLock(t *testing.T) {
+	d := tempDir(t)
+	sqfs := writeTestImage(t, filepath.Join(d, "image.squashfs"), []testEntry{tdir("/"), tfile("/a", "a")})
+	defer sqfs.Free()
+
+	dir := filepath.Join(d, "out")
+	if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockDir(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, atomic := range []bool{false, true} {
+		e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/", Atomic: atomic, Logger: PrintfLogger{}}
+		if err := e.Extract(); !errors.Is(err, ErrLocked) {
+			t.Errorf("extract (atomic %v) into a locked directory: got %v, want ErrLocked", atomic, err)
+		}
+	}
+
+	unlock()
+	// left by the atomic extraction above.
+	if err := os.Remove(lockPath(dir)); err != nil {
+		t.Fatal(err)
+	}
+	e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/", Logger: PrintfLogger{}}
+	if err := e.Extract(); err != nil {
+		t.Errorf("extract once unlocked: %s", err)
+	}
+	if _, err := os.Lstat(lockPath(dir)); !os.IsNotExist(err) {
+		t.Errorf("extract left a lock file next to Dir: %v", err)
+	}
+
+	// the lock file of atomic extractions stays.
+	e.Atomic = true
+	if err := e.Extract(); err != nil {
+		t.Errorf("atomic extract once unlocked: %s", err)
+	}
+	if _, err := os.Lstat(lockPath(dir)); err != nil {
+		t.Errorf("no lock file after an atomic extract: %s", err)
+	}
+}
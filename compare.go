@@ -0,0 +1,240 @@
+package squashfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Change kinds reported by Compare.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Change - a path that differs between two Trees.
+type Change struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	// Fields - for modified entries, what changed: type, mode, owner, mtime,
+	// xattr, target, device and/or content.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// String - one line summary: "+ path", "- path" or "M path fields".
+func (c Change) String() string {
+	switch c.Kind {
+	case ChangeAdded:
+		return "+ " + c.Path
+	case ChangeRemoved:
+		return "- " + c.Path
+	}
+	return fmt.Sprintf("M %s %s", c.Path, strings.Join(c.Fields, ","))
+}
+
+// CompareOptions - options for Compare.
+type CompareOptions struct {
+	IgnoreMtime bool
+}
+
+// Compare - return the changes from a to b, sorted by path.
+func Compare(a, b Tree, opts CompareOptions) ([]Change, error) {
+	return compareTrees(a, b, map[string]bool{"mtime": opts.IgnoreMtime})
+}
+
+// CheckOptions - what CompareDir checks.  Owners, Perms, Devs and Sockets should be
+// those the Extractor was run with.  The Extractor does not restore mtimes or
+// xattrs, so they are only checked if asked for.
+type CheckOptions struct {
+	// Path - the Extractor Path, only it and what is below it are compared.
+	Path    string
+	Owners  bool
+	Perms   bool
+	Devs    bool
+	Sockets bool
+	Mtimes  bool
+	Xattrs  bool
+	// WhiteOuts - the Extractor WhiteOuts, whiteouts and opaque directories are
+	// expected on disk as it writes them.
+	WhiteOuts WhiteOutMode
+}
+
+// CompareDir - return how the directory dir differs from what extracting sqfs into it
+// would give.  Entries only in dir are ChangeAdded, those missing from dir are
+// ChangeRemoved.
+func CompareDir(sqfs *SquashFs, dir string, opts CheckOptions) ([]Change, error) {
+	root := path.Clean("/" + opts.Path)
+	under := func(ent TreeEntry) bool {
+		return root == "/" || ent.Path == root || strings.HasPrefix(ent.Path, root+"/")
+	}
+
+	image := filteredTree{&extractedTree{ImageTree: ImageTree{sqfs}, whiteOuts: opts.WhiteOuts},
+		func(ent TreeEntry) bool {
+			switch {
+			case !under(ent):
+				return false
+			case !opts.Devs && (ent.Type() == "char" || ent.Type() == "block"):
+				return false
+			case !opts.Sockets && ent.Type() == "socket":
+				return false
+			}
+			return true
+		}}
+	disk := filteredTree{DirTree(dir), under}
+
+	return compareTrees(image, disk, map[string]bool{
+		"owner": !opts.Owners,
+		"mode":  !opts.Perms,
+		"mtime": !opts.Mtimes,
+		"xattr": !opts.Xattrs,
+	})
+}
+
+// compareTrees - return the changes from a to b, leaving out the fields set in ignore.
+func compareTrees(a, b Tree, ignore map[string]bool) ([]Change, error) {
+	changes := []Change{}
+	aEnts, err := a.Entries()
+	if err != nil {
+		return changes, err
+	}
+	bEnts, err := b.Entries()
+	if err != nil {
+		return changes, err
+	}
+
+	all := map[string]TreeEntry{}
+	for p, ent := range aEnts {
+		all[p] = ent
+	}
+	for p, ent := range bEnts {
+		all[p] = ent
+	}
+
+	for _, p := range sortedPaths(all) {
+		aEnt, inA := aEnts[p]
+		bEnt, inB := bEnts[p]
+		if !inA {
+			changes = append(changes, Change{Path: p, Kind: ChangeAdded})
+			continue
+		} else if !inB {
+			changes = append(changes, Change{Path: p, Kind: ChangeRemoved})
+			continue
+		}
+
+		fields, err := compareEntries(a, aEnt, b, bEnt, ignore["mtime"])
+		if err != nil {
+			return changes, fmt.Errorf("failed comparing %s: %s", p, err)
+		}
+		kept := []string{}
+		for _, f := range fields {
+			// symlink permissions are meaningless on linux.
+			if ignore[f] || (f == "mode" && aEnt.Type() == "symlink") {
+				continue
+			}
+			kept = append(kept, f)
+		}
+		if len(kept) != 0 {
+			changes = append(changes, Change{Path: p, Kind: ChangeModified, Fields: kept})
+		}
+	}
+
+	return changes, nil
+}
+
+// filteredTree - a Tree with only the entries keep returns true for.
+type filteredTree struct {
+	Tree
+	keep func(TreeEntry) bool
+}
+
+func (f filteredTree) Entries() (map[string]TreeEntry, error) {
+	entries, err := f.Tree.Entries()
+	if err != nil {
+		return entries, err
+	}
+	for p, ent := range entries {
+		if !f.keep(ent) {
+			delete(entries, p)
+		}
+	}
+	return entries, nil
+}
+
+// extractedTree - the entries of an image as an Extractor with WhiteOuts writes
+// them: whiteouts and opaque markers are dropped, kept or converted.  The empty
+// files it makes up are read as such.
+type extractedTree struct {
+	ImageTree
+	whiteOuts WhiteOutMode
+	made      map[string]bool
+}
+
+func (t *extractedTree) Entries() (map[string]TreeEntry, error) {
+	entries, err := t.ImageTree.Entries()
+	if err != nil {
+		return entries, err
+	}
+	t.made = map[string]bool{}
+	out := map[string]TreeEntry{}
+	for p, ent := range entries {
+		whiteOut := ""
+		name := path.Base(p)
+		if ent.Type() == "char" && ent.Rdev == 0 {
+			whiteOut = p
+		} else if ent.Type() == "file" && strings.HasPrefix(name, WhiteOutPrefix) &&
+			!strings.HasPrefix(name, aufsMetaPrefix) && t.whiteOuts != WhiteOutSkip {
+			whiteOut = path.Join(path.Dir(p), strings.TrimPrefix(name, WhiteOutPrefix))
+		}
+
+		switch {
+		case whiteOut != "" && t.whiteOuts == WhiteOutLiteral:
+			ent.Path, ent.Mode, ent.Size, ent.Rdev = whiteOut, os.ModeCharDevice|ent.Mode.Perm(), 0, 0
+			out[whiteOut] = ent
+		case whiteOut != "" && t.whiteOuts == WhiteOutAUFS:
+			aufs := path.Join(path.Dir(whiteOut), WhiteOutPrefix+path.Base(whiteOut))
+			ent.Path, ent.Mode, ent.Size, ent.Rdev = aufs, ent.Mode.Perm(), 0, 0
+			out[aufs] = ent
+			t.made[aufs] = p != aufs
+		case whiteOut != "":
+			// applied (overlay) or not extracted (skip).
+		case name == OpaqueMarker && (t.whiteOuts == WhiteOutOverlay || t.whiteOuts == WhiteOutLiteral):
+		default:
+			out[p] = ent
+		}
+	}
+
+	for p, ent := range entries {
+		_, marker := entries[path.Join(p, OpaqueMarker)]
+		if !ent.Mode.IsDir() || (ent.Xattrs[OpaqueXattr] != "y" && !marker) {
+			continue
+		}
+		switch t.whiteOuts {
+		case WhiteOutLiteral:
+			xattrs := map[string]string{OpaqueXattr: "y"}
+			for k, v := range ent.Xattrs {
+				xattrs[k] = v
+			}
+			ent.Xattrs = xattrs
+			out[p] = ent
+		case WhiteOutAUFS:
+			if !marker {
+				m := path.Join(p, OpaqueMarker)
+				out[m] = TreeEntry{Path: m, Mode: ent.Mode.Perm(), Uid: ent.Uid, Gid: ent.Gid,
+					ModTime: ent.ModTime, Xattrs: map[string]string{}}
+				t.made[m] = true
+			}
+		}
+	}
+	return out, nil
+}
+
+func (t *extractedTree) Open(p string) (io.ReadCloser, error) {
+	if t.made[p] {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	return t.ImageTree.Open(p)
+}
@@ -0,0 +1,43 @@
+package squashfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareDirAfterExtract(t *testing.T) {
+	d := tempDir(t)
+	layers := testLayers(t, d)
+	for i := range layers {
+		defer layers[i].Free()
+	}
+	// whiteout char devices, .wh. files, an opaque marker and an opaque xattr.
+	mid := layers[1]
+
+	for _, mode := range []WhiteOutMode{WhiteOutSkip, WhiteOutOverlay, WhiteOutLiteral, WhiteOutAUFS} {
+		t.Run(mode.String(), func(t *testing.T) {
+			root := os.Getuid() == 0
+			if mode == WhiteOutLiteral && !root {
+				t.Skip("the opaque xattr and whiteout devices need root")
+			}
+			dir := filepath.Join(d, mode.String())
+			if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+				t.Fatal(err)
+			}
+			e := Extractor{Dir: dir, SquashFs: mid, Path: "/", WhiteOuts: mode, Devs: root,
+				Logger: PrintfLogger{}}
+			if err := e.Extract(); err != nil {
+				t.Fatal(err)
+			}
+
+			changes, err := CompareDir(&mid, dir, CheckOptions{Devs: root, WhiteOuts: mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != 0 {
+				t.Errorf("changes after extracting: %v", changes)
+			}
+		})
+	}
+}
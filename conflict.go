@@ -0,0 +1,169 @@
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConflictPolicy - what the Extractor does when something is already where it
+// extracts an entry.  A directory extracted over an existing directory is not a
+// conflict, the two are merged.
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite - remove what is there (a whole tree if it is a directory).
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictKeep - leave what is there and do not extract the entry, or what is below it.
+	ConflictKeep
+	// ConflictFail - stop with a *ConflictError.
+	ConflictFail
+	// ConflictNewer - overwrite only if the entry is newer (mtime) than what is there.
+	ConflictNewer
+	// ConflictBackup - rename what is there by adding Extractor.BackupSuffix, replacing
+	// any previous backup.
+	ConflictBackup
+)
+
+// DefaultBackupSuffix - suffix for ConflictBackup if Extractor.BackupSuffix is empty.
+const DefaultBackupSuffix = "~"
+
+var conflictPolicyNames = map[ConflictPolicy]string{
+	ConflictOverwrite: "overwrite",
+	ConflictKeep:      "keep",
+	ConflictFail:      "error",
+	ConflictNewer:     "newer",
+	ConflictBackup:    "backup",
+}
+
+func (p ConflictPolicy) String() string {
+	if name, ok := conflictPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConflictPolicy(%d)", int(p))
+}
+
+// ParseConflictPolicy - return the ConflictPolicy for name (overwrite, keep, error, newer or backup).
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for p, n := range conflictPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return ConflictOverwrite, fmt.Errorf("unknown conflict policy '%s'", name)
+}
+
+// ConflictPolicies - the ConflictPolicy for each type of entry extracted.
+type ConflictPolicies struct {
+	// Default - policy for the types not in Types.
+	Default ConflictPolicy
+	// Types - policy by type of the entry extracted: dir, file, symlink, char,
+	// block, fifo or socket.  "whiteout" is the policy for what whiteouts and
+	// opaque directories remove.
+	Types map[string]ConflictPolicy
+}
+
+// Policy - the policy for extracting an entry with mode.
+func (c ConflictPolicies) Policy(mode os.FileMode) ConflictPolicy {
+	if p, ok := c.Types[fileType(mode)]; ok {
+		return p
+	}
+	return c.Default
+}
+
+// ParseConflictPolicies - parse "policy" or "type=policy" settings, like
+// "keep" or "file=newer".  Later settings win.
+func ParseConflictPolicies(settings []string) (ConflictPolicies, error) {
+	c := ConflictPolicies{Types: map[string]ConflictPolicy{}}
+	for _, s := range settings {
+		typ, name := "", s
+		if i := strings.Index(s, "="); i >= 0 {
+			typ, name = s[:i], s[i+1:]
+		}
+		p, err := ParseConflictPolicy(name)
+		if err != nil {
+			return c, err
+		}
+		switch typ {
+		case "":
+			c.Default = p
+		case "dir", "file", "symlink", "char", "block", "fifo", "socket", "whiteout":
+			c.Types[typ] = p
+		default:
+			return c, fmt.Errorf("unknown type '%s' in conflict policy '%s'", typ, s)
+		}
+	}
+	return c, nil
+}
+
+// ConflictError - Path was in the way of an entry, with the ConflictFail policy.
+type ConflictError struct {
+	Path     string
+	Existing string
+	Wanted   string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s exists where %s is to be extracted", e.Path, e.Existing, e.Wanted)
+}
+
+// errKeepExisting - prepWrite decided to leave what is at path, the entry is not extracted.
+var errKeepExisting = errors.New("keeping existing entry")
+
+// resolveConflict - apply the policy for extracting finfo to path, where existing is.
+// Returns true if path is out of the way, errKeepExisting if it is to stay.
+func (e *Extractor) resolveConflict(path string, existing os.FileInfo, finfo FileInfo) (bool, error) {
+	return e.applyPolicy(e.Conflicts.Policy(finfo.FMode), path, existing, fileType(finfo.FMode), finfo)
+}
+
+// resolveRemoval - apply the whiteout policy to removing existing at path, for the
+// whiteout or opaque directory info.  Returns as resolveConflict does.
+func (e *Extractor) resolveRemoval(path string, existing os.FileInfo, info FileInfo) (bool, error) {
+	policy, ok := e.Conflicts.Types["whiteout"]
+	if !ok {
+		policy = e.Conflicts.Default
+	}
+	return e.applyPolicy(policy, path, existing, "whiteout", info)
+}
+
+// applyPolicy - apply policy for putting want (from finfo) at path, where existing is.
+func (e *Extractor) applyPolicy(policy ConflictPolicy, path string, existing os.FileInfo, want string, finfo FileInfo) (bool, error) {
+	have := fileType(existing.Mode())
+	if policy == ConflictNewer {
+		if finfo.FModTime.After(existing.ModTime()) {
+			policy = ConflictOverwrite
+		} else {
+			e.Logger.Verbose("conflict %s: keeping %s, not older than %s in image", path, have, want)
+			return false, errKeepExisting
+		}
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		e.Logger.Verbose("conflict %s: overwriting %s with %s", path, have, want)
+		return false, nil
+	case ConflictKeep:
+		e.Logger.Verbose("conflict %s: keeping %s, not extracting %s", path, have, want)
+		return false, errKeepExisting
+	case ConflictFail:
+		e.Logger.Verbose("conflict %s: %s in the way of %s", path, have, want)
+		return false, &ConflictError{Path: path, Existing: have, Wanted: want}
+	case ConflictBackup:
+		backup := path + e.backupSuffix()
+		e.Logger.Verbose("conflict %s: moving %s to %s", path, have, backup)
+		if err := e.Ops.RemoveAll(backup); err != nil {
+			return false, err
+		}
+		return true, e.Ops.Rename(path, backup)
+	}
+	return false, fmt.Errorf("unknown conflict policy %s", policy)
+}
+
+// backupSuffix - the suffix ConflictBackup adds.
+func (e *Extractor) backupSuffix() string {
+	if e.BackupSuffix == "" {
+		return DefaultBackupSuffix
+	}
+	return e.BackupSuffix
+}
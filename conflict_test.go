@@ -0,0 +1,241 @@
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWhiteOutConflictPolicy(t *testing.T) {
+	d := tempDir(t)
+	base := writeTestImage(t, filepath.Join(d, "base.squashfs"), []testEntry{
+		tdir("/"),
+		tfile("/a", "a"),
+		tdir("/d"),
+		tfile("/d/x", "x"),
+	})
+	defer base.Free()
+	top := writeTestImage(t, filepath.Join(d, "top.squashfs"), []testEntry{
+		tdir("/"),
+		tchar("/a", 0, 0),
+		tdir("/d", OpaqueXattr, "y"),
+	})
+	defer top.Free()
+
+	for _, tc := range []struct {
+		policy ConflictPolicy
+		want   string
+	}{
+		{ConflictOverwrite, "/ /d"},
+		{ConflictKeep, "/ /a /d /d/x"},
+		{ConflictBackup, "/ /a~ /d /d/x~"},
+		{ConflictFail, ""},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			dir := filepath.Join(d, tc.policy.String())
+			if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+				t.Fatal(err)
+			}
+			e := Extractor{Dir: dir, SquashFs: base, Path: "/", Logger: PrintfLogger{}}
+			if err := e.Extract(); err != nil {
+				t.Fatal(err)
+			}
+
+			e = Extractor{Dir: dir, SquashFs: top, Path: "/", WhiteOuts: WhiteOutOverlay, Logger: PrintfLogger{},
+				Conflicts: ConflictPolicies{Types: map[string]ConflictPolicy{"whiteout": tc.policy}}}
+			err := e.Extract()
+			if tc.policy == ConflictFail {
+				var conflictErr *ConflictError
+				if !errors.As(err, &conflictErr) {
+					t.Errorf("expected a ConflictError, got %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(treePaths(t, dir), " "); got != tc.want {
+				t.Errorf("tree is %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConflictPoliciesPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		settings []string
+		want     map[os.FileMode]ConflictPolicy
+		err      bool
+	}{
+		{nil, map[os.FileMode]ConflictPolicy{0644: ConflictOverwrite, os.ModeDir: ConflictOverwrite}, false},
+		{[]string{"keep"}, map[os.FileMode]ConflictPolicy{0644: ConflictKeep, os.ModeSymlink: ConflictKeep}, false},
+		// a type setting overrides the default, before or after it.
+		{[]string{"keep", "file=newer"}, map[os.FileMode]ConflictPolicy{
+			0644: ConflictNewer, os.ModeDir: ConflictKeep, os.ModeSymlink: ConflictKeep}, false},
+		{[]string{"file=backup", "error"}, map[os.FileMode]ConflictPolicy{
+			0644: ConflictBackup, os.ModeDir: ConflictFail, os.ModeCharDevice: ConflictFail}, false},
+		{[]string{"dir=keep", "socket=error", "dir=overwrite"}, map[os.FileMode]ConflictPolicy{
+			os.ModeDir: ConflictOverwrite, os.ModeSocket: ConflictFail, os.ModeNamedPipe: ConflictOverwrite}, false},
+		{[]string{"bogus"}, nil, true},
+		{[]string{"pipe=keep"}, nil, true},
+	} {
+		c, err := ParseConflictPolicies(tc.settings)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tc.settings)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: %s", tc.settings, err)
+			continue
+		}
+		for mode, want := range tc.want {
+			if got := c.Policy(mode); got != want {
+				t.Errorf("%v: policy for %s is %s, want %s", tc.settings, fileType(mode), got, want)
+			}
+		}
+	}
+}
+
+func TestPrepWriteConflicts(t *testing.T) {
+	d := tempDir(t)
+	older, newer := testModTime.Add(-time.Hour), testModTime.Add(time.Hour)
+
+	for _, tc := range []struct {
+		existing string // file or tree, a directory with a file in it.
+		want     os.FileMode
+		policy   ConflictPolicy
+		mtime    time.Time
+		result   string // gone, kept, backup or error.
+	}{
+		{"file", 0644, ConflictOverwrite, older, "gone"},
+		{"file", 0644, ConflictKeep, newer, "kept"},
+		{"file", 0644, ConflictFail, newer, "error"},
+		{"file", 0644, ConflictNewer, newer, "gone"},
+		{"file", 0644, ConflictNewer, older, "kept"},
+		{"file", 0644, ConflictNewer, testModTime, "kept"},
+		{"file", 0644, ConflictBackup, older, "backup"},
+		{"tree", 0644, ConflictOverwrite, older, "gone"},
+		{"tree", 0644, ConflictKeep, newer, "kept"},
+		{"tree", 0644, ConflictFail, newer, "error"},
+		{"tree", 0644, ConflictNewer, newer, "gone"},
+		{"tree", 0644, ConflictNewer, older, "kept"},
+		{"tree", 0644, ConflictBackup, older, "backup"},
+		{"file", os.ModeDir | 0755, ConflictOverwrite, older, "gone"},
+		{"file", os.ModeDir | 0755, ConflictKeep, newer, "kept"},
+		{"file", os.ModeDir | 0755, ConflictFail, newer, "error"},
+		{"file", os.ModeDir | 0755, ConflictNewer, newer, "gone"},
+		{"file", os.ModeDir | 0755, ConflictNewer, older, "kept"},
+		{"file", os.ModeDir | 0755, ConflictBackup, older, "backup"},
+		// a directory over a directory is merged, whatever the policy.
+		{"tree", os.ModeDir | 0755, ConflictFail, newer, "merged"},
+		{"tree", os.ModeDir | 0755, ConflictBackup, newer, "merged"},
+	} {
+		name := fmt.Sprintf("%s-%s-%s-%s", fileType(tc.want), tc.existing, tc.policy, tc.mtime.Sub(testModTime))
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(d, name)
+			if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+				t.Fatal(err)
+			}
+			fpath := filepath.Join(dir, "x")
+			stamp := fpath
+			if tc.existing == "tree" {
+				if err := os.Mkdir(fpath, DefaultDirPerm); err != nil {
+					t.Fatal(err)
+				}
+				stamp = filepath.Join(fpath, "in")
+			}
+			if err := ioutil.WriteFile(stamp, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(fpath, testModTime, testModTime); err != nil {
+				t.Fatal(err)
+			}
+
+			e := Extractor{Dir: dir, Logger: PrintfLogger{},
+				Conflicts: ConflictPolicies{Default: ConflictFail, Types: map[string]ConflictPolicy{
+					fileType(tc.want): tc.policy}}}
+			e.setOps()
+			cleanup, err := e.prepWrite(fpath, FileInfo{Filename: "/x", FMode: tc.want, FModTime: tc.mtime})
+			if cerr := cleanup(); cerr != nil {
+				t.Fatal(cerr)
+			}
+
+			var conflictErr *ConflictError
+			switch {
+			case tc.result == "error":
+				if !errors.As(err, &conflictErr) {
+					t.Errorf("expected a ConflictError, got %v", err)
+				}
+			case tc.result == "kept":
+				if err != errKeepExisting {
+					t.Errorf("expected errKeepExisting, got %v", err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			_, statErr := os.Lstat(stamp)
+			_, backupErr := os.Lstat(fpath + DefaultBackupSuffix)
+			switch tc.result {
+			case "gone":
+				if !os.IsNotExist(statErr) {
+					t.Errorf("%s was not removed: %v", stamp, statErr)
+				}
+			case "backup":
+				if !os.IsNotExist(statErr) || backupErr != nil {
+					t.Errorf("%s was not moved to the backup: %v %v", fpath, statErr, backupErr)
+				}
+				if tc.existing == "tree" {
+					if _, err := os.Lstat(filepath.Join(fpath+DefaultBackupSuffix, "in")); err != nil {
+						t.Errorf("the backup lost the tree: %s", err)
+					}
+				}
+			default:
+				if statErr != nil {
+					t.Errorf("%s was removed: %s", stamp, statErr)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractConflictTypeOverride(t *testing.T) {
+	d := tempDir(t)
+	sqfs := writeTestImage(t, filepath.Join(d, "image.squashfs"), []testEntry{
+		tdir("/"),
+		tfile("/a", "new"),
+		tsymlink("/l", "a"),
+	})
+	defer sqfs.Free()
+
+	dir := filepath.Join(d, "out")
+	if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "l"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conflicts, err := ParseConflictPolicies([]string{"error", "file=keep", "symlink=overwrite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/", Conflicts: conflicts, Logger: PrintfLogger{}}
+	if err := e.Extract(); err != nil {
+		t.Fatalf("the type policies should override the default error: %s", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "a")); err != nil || string(data) != "old" {
+		t.Errorf("/a should be kept: %q %v", data, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "l")); err != nil || target != "a" {
+		t.Errorf("/l should be overwritten by the symlink: %q %v", target, err)
+	}
+}
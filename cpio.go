@@ -0,0 +1,328 @@
+package squashfs
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cpioNewcMagic = "070701"
+	cpioTrailer   = "TRAILER!!!"
+)
+
+// CpioWriter - writes a cpio archive in the "newc" format, as used for initramfs.
+type CpioWriter struct {
+	w       io.Writer
+	written int64
+	nextIno uint32
+	// inodes - the inode number given to each path, so hard links can share it.
+	inodes map[string]uint32
+	closed bool
+}
+
+// NewCpioWriter - return a CpioWriter writing to w.
+func NewCpioWriter(w io.Writer) *CpioWriter {
+	return &CpioWriter{w: w, nextIno: 1, inodes: map[string]uint32{}}
+}
+
+// cpioMode - the st_mode of mode, type and permission bits.
+func cpioMode(mode os.FileMode) (uint32, error) {
+	perms := unixPerms(mode)
+	switch fileType(mode) {
+	case "dir":
+		return syscall.S_IFDIR | perms, nil
+	case "file":
+		return syscall.S_IFREG | perms, nil
+	case "symlink":
+		return syscall.S_IFLNK | perms, nil
+	case "char":
+		return syscall.S_IFCHR | perms, nil
+	case "block":
+		return syscall.S_IFBLK | perms, nil
+	case "fifo":
+		return syscall.S_IFIFO | perms, nil
+	case "socket":
+		return syscall.S_IFSOCK | perms, nil
+	}
+	return 0, fmt.Errorf("cannot store mode %s in cpio", mode)
+}
+
+// cpioName - the archive name of path: relative, "." for the root.
+func cpioName(path string) string {
+	name := strings.TrimPrefix(path, "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// WriteEntry - add ent to the archive, with the content of regular files read from r.
+// An entry with HardLink set shares the inode of the earlier entry at that path,
+// its data is not written again.
+func (c *CpioWriter) WriteEntry(ent SinkEntry, r io.Reader) error {
+	if c.closed {
+		return fmt.Errorf("cpio archive already closed")
+	}
+	mode, err := cpioMode(ent.Mode)
+	if err != nil {
+		return fmt.Errorf("%s: %s", ent.Path, err)
+	}
+
+	ino := c.nextIno
+	size := ent.Size
+	nlink := ent.Nlink
+	var data io.Reader
+	switch {
+	case ent.HardLink != "":
+		linked, ok := c.inodes[ent.HardLink]
+		if !ok {
+			return fmt.Errorf("%s: hard link to %s, which is not in the archive", ent.Path, ent.HardLink)
+		}
+		ino, size = linked, 0
+	case ent.Mode.IsRegular():
+		data = r
+	case ent.Mode&os.ModeSymlink != 0:
+		data, size = strings.NewReader(ent.LinkTarget), int64(len(ent.LinkTarget))
+	default:
+		size = 0
+	}
+	if size > 0xffffffff {
+		return fmt.Errorf("%s: %d bytes is too big for cpio", ent.Path, size)
+	}
+	if ino == c.nextIno {
+		c.nextIno++
+	}
+	c.inodes[ent.Path] = ino
+	if nlink == 0 {
+		nlink = 1
+		if ent.Mode.IsDir() {
+			nlink = 2
+		}
+	}
+
+	if err := c.header(cpioName(ent.Path), ino, mode, ent.Uid, ent.Gid, uint32(nlink),
+		ent.ModTime.Unix(), size, ent.Rdev); err != nil {
+		return err
+	}
+	if data != nil {
+		n, err := io.Copy(countingWriter{c}, io.LimitReader(data, size))
+		if err != nil {
+			return err
+		} else if n != size {
+			return fmt.Errorf("%s: wrote %d bytes to cpio, expected %d", ent.Path, n, size)
+		}
+	}
+	return c.pad()
+}
+
+// Close - write the trailer.  The underlying writer is not closed.
+func (c *CpioWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.header(cpioTrailer, 0, 0, 0, 0, 1, 0, 0, 0)
+}
+
+// header - write a newc header and name, padded.
+func (c *CpioWriter) header(name string, ino, mode, uid, gid, nlink uint32, mtime, size int64, rdev uint64) error {
+	hdr := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cpioNewcMagic, ino, mode, uid, gid, nlink, uint32(mtime), uint32(size),
+		0, 0, unix.Major(rdev), unix.Minor(rdev), len(name)+1, 0)
+	if err := c.write([]byte(hdr + name + "\x00")); err != nil {
+		return err
+	}
+	return c.pad()
+}
+
+func (c *CpioWriter) write(b []byte) error {
+	n, err := c.w.Write(b)
+	c.written += int64(n)
+	return err
+}
+
+// pad - pad the archive to a multiple of 4 bytes.
+func (c *CpioWriter) pad() error {
+	if n := c.written % 4; n != 0 {
+		return c.write(make([]byte, 4-n))
+	}
+	return nil
+}
+
+// countingWriter - writes to the CpioWriter, keeping count for padding.
+type countingWriter struct {
+	c *CpioWriter
+}
+
+func (cw countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.c.w.Write(b)
+	cw.c.written += int64(n)
+	return n, err
+}
+
+// CpioCompression - how WriteCpio compresses the archive.
+type CpioCompression int
+
+const (
+	// CpioNone - write the archive as is.
+	CpioNone CpioCompression = iota
+	// CpioGzip - gzip the archive.
+	CpioGzip
+	// CpioZstd - compress the archive with the zstd program, which must be in PATH.
+	CpioZstd
+)
+
+var cpioCompressionNames = map[CpioCompression]string{
+	CpioNone: "none",
+	CpioGzip: "gzip",
+	CpioZstd: "zstd",
+}
+
+func (c CpioCompression) String() string {
+	if name, ok := cpioCompressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CpioCompression(%d)", int(c))
+}
+
+// ParseCpioCompression - return the CpioCompression for name (none, gzip or zstd).
+func ParseCpioCompression(name string) (CpioCompression, error) {
+	for c, n := range cpioCompressionNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return CpioNone, fmt.Errorf("unknown compression '%s'. Needs one of: none, gzip, zstd", name)
+}
+
+// CpioOptions - options for WriteCpio.
+type CpioOptions struct {
+	Compression CpioCompression
+	// WhiteOuts - how whiteouts in the image are written, WhiteOutOverlay is the
+	// same as WhiteOutSkip as there is nothing below them.
+	WhiteOuts WhiteOutMode
+	// Filter - if set, only what it selects is written, renamed as it says.
+	Filter *Filter
+	Logger Logger
+}
+
+// WriteCpio - write what is below path in s to w as a newc cpio archive, as the
+// kernel takes for an initramfs.  path is the root of the archive.  Owners,
+// permissions, devices, sockets, symlinks and hard links are kept as they are in
+// the image: nothing is written to disk, so no privileges are needed.
+func WriteCpio(s SquashFs, path string, w io.Writer, opts CpioOptions) error {
+	if opts.Logger == nil {
+		opts.Logger = PrintfLogger{}
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	out, err := compressWriter(w, opts.Compression)
+	if err != nil {
+		return err
+	}
+	cw := NewCpioWriter(out)
+	e := Extractor{
+		SquashFs:  s,
+		Path:      path,
+		WhiteOuts: opts.WhiteOuts,
+		Owners:    true,
+		Perms:     true,
+		Devs:      true,
+		Sockets:   true,
+		Logger:    opts.Logger,
+		Filter:    opts.Filter,
+		Sink:      rebaseSink{&CpioSink{cw}, path},
+	}
+	err = e.Extract()
+	if err == nil {
+		err = cw.Close()
+	}
+	// the compressor is closed even on error, to stop zstd.
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rebaseSink - a Sink adding entries below root as if root were "/".
+type rebaseSink struct {
+	Sink
+	root string
+}
+
+func (r rebaseSink) Add(ent SinkEntry, rd io.Reader) error {
+	ent.Path = rebase(r.root, ent.Path)
+	if ent.HardLink != "" {
+		ent.HardLink = rebase(r.root, ent.HardLink)
+	}
+	return r.Sink.Add(ent, rd)
+}
+
+// rebase - p, below root, as a path below "/".  Paths not below root are left alone.
+func rebase(root, p string) string {
+	root, p = path.Clean("/"+root), path.Clean("/"+p)
+	if root == "/" {
+		return p
+	} else if p == root {
+		return "/"
+	} else if strings.HasPrefix(p, root+"/") {
+		return p[len(root):]
+	}
+	return p
+}
+
+// compressWriter - return a writer compressing to w as c says.  Close finishes
+// the compressed stream, it does not close w.
+func compressWriter(w io.Writer, c CpioCompression) (io.WriteCloser, error) {
+	switch c {
+	case CpioNone:
+		return nopWriteCloser{w}, nil
+	case CpioGzip:
+		return gzip.NewWriter(w), nil
+	case CpioZstd:
+		cmd := exec.Command("zstd", "-q", "-c", "-")
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("cannot run zstd: %s", err)
+		}
+		return &cmdWriter{WriteCloser: stdin, cmd: cmd}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %s", c)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// cmdWriter - writes to the stdin of cmd, Close waits for it to finish.
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdWriter) Close() error {
+	err := c.WriteCloser.Close()
+	if werr := c.cmd.Wait(); werr != nil {
+		return fmt.Errorf("%s failed: %s", c.cmd.Path, werr)
+	}
+	return err
+}
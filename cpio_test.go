@@ -0,0 +1,248 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpioEntry - an entry read back from a newc archive.
+type cpioEntry struct {
+	name                                    string
+	ino, mode, uid, gid, nlink, mtime, size uint32
+	rdevMajor, rdevMinor                    uint32
+	data                                    string
+}
+
+// readCpio - parse the newc archive b up to the trailer, checking the padding.
+func readCpio(t *testing.T, b []byte) []cpioEntry {
+	t.Helper()
+	var ents []cpioEntry
+	off := 0
+	pad := func() {
+		for ; off%4 != 0; off++ {
+			if off >= len(b) || b[off] != 0 {
+				t.Fatalf("bad padding at %d", off)
+			}
+		}
+	}
+	for {
+		if off+110 > len(b) {
+			t.Fatalf("archive ends at %d without a trailer", off)
+		}
+		if string(b[off:off+6]) != cpioNewcMagic {
+			t.Fatalf("bad magic %q at %d", b[off:off+6], off)
+		}
+		// ino mode uid gid nlink mtime filesize devmajor devminor rdevmajor rdevminor namesize check
+		fields := make([]uint32, 13)
+		for i := range fields {
+			start := off + 6 + 8*i
+			v, err := strconv.ParseUint(string(b[start:start+8]), 16, 32)
+			if err != nil {
+				t.Fatalf("bad header field %d at %d: %s", i, off, err)
+			}
+			fields[i] = uint32(v)
+		}
+		off += 110
+		namesize := int(fields[11])
+		if namesize == 0 || off+namesize > len(b) || b[off+namesize-1] != 0 {
+			t.Fatalf("bad name at %d", off)
+		}
+		ent := cpioEntry{name: string(b[off : off+namesize-1]),
+			ino: fields[0], mode: fields[1], uid: fields[2], gid: fields[3], nlink: fields[4],
+			mtime: fields[5], size: fields[6], rdevMajor: fields[9], rdevMinor: fields[10]}
+		if fields[7] != 0 || fields[8] != 0 || fields[12] != 0 {
+			t.Errorf("%s: dev and check should be 0: %v", ent.name, fields)
+		}
+		off += namesize
+		pad()
+		if ent.name == cpioTrailer {
+			if off != len(b) {
+				t.Errorf("%d bytes after the trailer", len(b)-off)
+			}
+			return ents
+		}
+		if off+int(ent.size) > len(b) {
+			t.Fatalf("%s: data goes past the end of the archive", ent.name)
+		}
+		ent.data = string(b[off : off+int(ent.size)])
+		off += int(ent.size)
+		pad()
+		ents = append(ents, ent)
+	}
+}
+
+func TestCpioWriter(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewCpioWriter(&buf)
+	if err := c.WriteEntry(SinkEntry{TreeEntry: TreeEntry{Path: "/a", Mode: 0644, Uid: 1, Gid: 2, Size: 5,
+		ModTime: testModTime}}, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "070701" + "00000001" + "000081a4" + "00000001" + "00000002" + "00000001" + "5f5e1000" +
+		"00000005" + "00000000" + "00000000" + "00000000" + "00000000" + "00000002" + "00000000" +
+		"a\x00" + "hello\x00\x00\x00" +
+		"070701" + "00000000" + "00000000" + "00000000" + "00000000" + "00000001" + "00000000" +
+		"00000000" + "00000000" + "00000000" + "00000000" + "00000000" + "0000000b" + "00000000" +
+		"TRAILER!!!\x00" + "\x00\x00\x00"
+	if got := buf.String(); got != want {
+		t.Errorf("archive is\n%q\nwant\n%q", got, want)
+	}
+
+	if err := c.WriteEntry(SinkEntry{TreeEntry: TreeEntry{Path: "/b", Mode: 0644}}, nil); err == nil {
+		t.Errorf("expected an error writing to a closed archive")
+	}
+}
+
+func TestCpioWriterHardLink(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewCpioWriter(&buf)
+	for _, ent := range []SinkEntry{
+		{TreeEntry: TreeEntry{Path: "/", Mode: os.ModeDir | 0755}},
+		{TreeEntry: TreeEntry{Path: "/f", Mode: 0644, Size: 3}, Nlink: 2},
+		{TreeEntry: TreeEntry{Path: "/g", Mode: 0644}, Nlink: 2, HardLink: "/f"},
+	} {
+		if err := c.WriteEntry(ent, strings.NewReader("abc")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.WriteEntry(SinkEntry{TreeEntry: TreeEntry{Path: "/h", Mode: 0644}, HardLink: "/missing"},
+		nil); err == nil {
+		t.Errorf("expected an error for a hard link to a missing entry")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ents := readCpio(t, buf.Bytes())
+	if len(ents) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", ents)
+	}
+	root, f, g := ents[0], ents[1], ents[2]
+	if root.name != "." || root.nlink != 2 || root.mode != syscall.S_IFDIR|0755 {
+		t.Errorf("unexpected root %+v", root)
+	}
+	if f.ino != g.ino || f.ino == root.ino {
+		t.Errorf("hard links should share an inode: %d %d", f.ino, g.ino)
+	}
+	if f.data != "abc" || g.size != 0 || f.nlink != 2 || g.nlink != 2 {
+		t.Errorf("the data should be written once, with the first link: %+v %+v", f, g)
+	}
+}
+
+func TestWriteCpio(t *testing.T) {
+	d := tempDir(t)
+	fname := filepath.Join(d, "image.squashfs")
+	w, err := NewWriter(fname, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ent := range []testEntry{
+		tdir("/"),
+		tdir("/dev"),
+		tchar("/dev/null", 1, 3),
+		{TreeEntry: TreeEntry{Path: "/dev/sda", Mode: os.ModeDevice | 0660, Gid: 6, Rdev: unix.Mkdev(8, 1)}},
+		tdir("/dir"),
+		tfile("/dir/f", "data1"),
+		tsymlink("/l", "dir/f"),
+	} {
+		ent.ModTime = testModTime
+		if err := w.Add(ent.TreeEntry, strings.NewReader(ent.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Link("/dir/g", "/dir/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sqfs, err := OpenSquashfs(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqfs.Free()
+
+	for _, compression := range []CpioCompression{CpioNone, CpioGzip} {
+		t.Run(compression.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteCpio(sqfs, "/", &buf, CpioOptions{Compression: compression}); err != nil {
+				t.Fatal(err)
+			}
+			b := buf.Bytes()
+			if compression == CpioGzip {
+				gz, err := gzip.NewReader(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b, err = ioutil.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := map[string]cpioEntry{}
+			names := []string{}
+			for _, ent := range readCpio(t, b) {
+				got[ent.name] = ent
+				names = append(names, ent.name)
+			}
+			want := ". dev dev/null dev/sda dir dir/f dir/g l"
+			if strings.Join(names, " ") != want {
+				t.Errorf("entries are %v, want %s", names, want)
+			}
+			if null := got["dev/null"]; null.mode != syscall.S_IFCHR|0644 || null.rdevMajor != 1 ||
+				null.rdevMinor != 3 || null.size != 0 {
+				t.Errorf("unexpected dev/null %+v", null)
+			}
+			if sda := got["dev/sda"]; sda.mode != syscall.S_IFBLK|0660 || sda.gid != 6 ||
+				sda.rdevMajor != 8 || sda.rdevMinor != 1 {
+				t.Errorf("unexpected dev/sda %+v", sda)
+			}
+			if l := got["l"]; l.mode != syscall.S_IFLNK|0777 || l.data != "dir/f" {
+				t.Errorf("unexpected symlink %+v", l)
+			}
+			f, g := got["dir/f"], got["dir/g"]
+			if f.ino != g.ino || f.nlink != 2 || g.nlink != 2 {
+				t.Errorf("dir/f and dir/g should be hard links: %+v %+v", f, g)
+			}
+			if f.data+g.data != "data1" || (f.size == 0) == (g.size == 0) {
+				t.Errorf("the linked data should be written once: %+v %+v", f, g)
+			}
+			if f.mtime != uint32(testModTime.Unix()) {
+				t.Errorf("dir/f mtime is %d", f.mtime)
+			}
+			inos := map[uint32]bool{}
+			for _, ent := range got {
+				inos[ent.ino] = true
+			}
+			if len(inos) != len(got)-1 {
+				t.Errorf("only the hard links should share an inode: %d inodes for %d entries", len(inos), len(got))
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCpio(sqfs, "/dir", &buf, CpioOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, ent := range readCpio(t, buf.Bytes()) {
+		names = append(names, ent.name)
+	}
+	if got := fmt.Sprint(names); got != "[. f g]" {
+		t.Errorf("archive of /dir has %s", got)
+	}
+}
@@ -0,0 +1,136 @@
+package squashfs
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// DigestScope - what part of the image file OpenVerified hashes.
+type DigestScope int
+
+const (
+	// DigestBytesUsed - hash the filesystem only, up to the superblock's bytes_used.
+	// Padding and trailers (such as a verity tree) are not covered.
+	DigestBytesUsed DigestScope = iota
+	// DigestFullFile - hash the whole file, as an OCI blob digest does.
+	DigestFullFile
+)
+
+// squashfs superblock fields read before the image is opened.
+const (
+	superMagic           = 0x73717368
+	superSize            = 96
+	superBytesUsedOffset = 40
+)
+
+// InvalidDigestError - a digest string is malformed or uses an unsupported algorithm.
+type InvalidDigestError struct {
+	Digest string
+	Reason string
+}
+
+func (e *InvalidDigestError) Error() string {
+	return fmt.Sprintf("invalid digest '%s': %s", e.Digest, e.Reason)
+}
+
+// DigestMismatchError - the image content does not match the expected digest.
+type DigestMismatchError struct {
+	Filename string
+	Expected string
+	Actual   string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("%s has digest %s, expected %s", e.Filename, e.Actual, e.Expected)
+}
+
+// parseDigest - return the algorithm, hex value and a new hash for digest ("algorithm:hex").
+func parseDigest(digest string) (string, string, hash.Hash, error) {
+	toks := strings.SplitN(digest, ":", 2)
+	if len(toks) != 2 {
+		return "", "", nil, &InvalidDigestError{digest, "expected algorithm:hex"}
+	}
+
+	var h hash.Hash
+	switch toks[0] {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", "", nil, &InvalidDigestError{digest, fmt.Sprintf("unsupported algorithm '%s'", toks[0])}
+	}
+
+	if b, err := hex.DecodeString(toks[1]); err != nil || len(b) != h.Size() || strings.ToLower(toks[1]) != toks[1] {
+		return "", "", nil, &InvalidDigestError{digest, fmt.Sprintf("expected %d lower case hex digits", h.Size()*2)}
+	}
+
+	return toks[0], toks[1], h, nil
+}
+
+// OpenVerified - OpenSquashfs, after checking the image against digest ("sha256:hex" or
+// "sha512:hex").  A DigestMismatchError is returned if it does not match, an
+// InvalidDigestError if digest cannot be used.  The image is read through the
+// descriptor that was hashed, kept open until Free, so replacing the file in
+// between is not possible.  Reopen and the functions that read the image file
+// again (Verify, VerityFormat, ...) use that descriptor too.
+func OpenVerified(fname, digest string, scope DigestScope) (SquashFs, error) {
+	alg, expected, h, err := parseDigest(digest)
+	if err != nil {
+		return SquashFs{}, err
+	}
+
+	fp, err := os.Open(fname)
+	if err != nil {
+		return SquashFs{}, err
+	}
+
+	var r io.Reader = fp
+	if scope == DigestBytesUsed {
+		size, err := imageBytesUsed(fp)
+		if err != nil {
+			fp.Close()
+			return SquashFs{}, fmt.Errorf("failed to open %s: %s", fname, err)
+		}
+		r = io.NewSectionReader(fp, 0, int64(size))
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		fp.Close()
+		return SquashFs{}, fmt.Errorf("failed reading %s: %s", fname, err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		fp.Close()
+		return SquashFs{}, &DigestMismatchError{fname, digest, alg + ":" + actual}
+	}
+
+	return openVerified(fname, fp)
+}
+
+// imageBytesUsed - read bytes_used from the superblock of the image in fp and check
+// the file is not shorter than that.
+func imageBytesUsed(fp *os.File) (uint64, error) {
+	super := make([]byte, superSize)
+	if _, err := fp.ReadAt(super, 0); err != nil {
+		return 0, fmt.Errorf("cannot read superblock: %s", err)
+	}
+	if binary.LittleEndian.Uint32(super) != superMagic {
+		return 0, fmt.Errorf("not a squashfs image")
+	}
+	bytesUsed := binary.LittleEndian.Uint64(super[superBytesUsedOffset:])
+
+	st, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if uint64(st.Size()) < bytesUsed {
+		return 0, fmt.Errorf("image is truncated: %d bytes, superblock says %d", st.Size(), bytesUsed)
+	}
+	return bytesUsed, nil
+}
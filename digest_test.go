@@ -0,0 +1,47 @@
+package squashfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenVerifiedReopensVerifiedFile(t *testing.T) {
+	d := tempDir(t)
+	fname := filepath.Join(d, "image.squashfs")
+	good := writeTestImage(t, fname, []testEntry{tdir("/"), tfile("/good", "good")})
+	good.Free()
+	evil := writeTestImage(t, filepath.Join(d, "evil.squashfs"), []testEntry{tdir("/"), tfile("/evil", "evil")})
+	evil.Free()
+
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	sqfs, err := OpenVerified(fname, "sha256:"+hex.EncodeToString(sum[:]), DigestFullFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqfs.Free()
+
+	// replace the image once it was verified.
+	if err := os.Rename(filepath.Join(d, "evil.squashfs"), fname); err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := sqfs.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Free()
+	if _, err := image.Lstat("/good"); err != nil {
+		t.Errorf("Reopen did not read the verified image: %s", err)
+	}
+	if _, err := image.Lstat("/evil"); err == nil {
+		t.Errorf("Reopen read the replaced image")
+	}
+}
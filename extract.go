@@ -1,13 +1,16 @@
 package squashfs
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -25,20 +28,80 @@ type Extractor struct {
 	Dir       string
 	SquashFs  SquashFs
 	Path      string
-	WhiteOuts bool
+	WhiteOuts WhiteOutMode
 	Owners    bool
 	Perms     bool
 	Devs      bool
 	Sockets   bool
 	Logger    Logger
 	Ops       FsOps
-	cleanups  []func() error
+	// Sync - leave entries that are already in Dir and unchanged, set mtimes on
+	// regular files so they can be compared next time.
+	Sync bool
+	// SyncHash - with Sync, compare the content of regular files too.
+	SyncHash bool
+	// Delete - remove what is in Dir below Path but not in the image.
+	Delete bool
+	// Workers - number of regular files written in parallel, serial if 0 or 1.
+	Workers int
+	// Limits - caps on what is extracted, a LimitError is returned when one is hit.
+	Limits Limits
+	// Filter - if set, only what it selects is extracted, renamed as it says.
+	Filter *Filter
+	// Progress - if set, called as entries and file content are done.
+	// Calls are serialized, but may come from the workers.
+	Progress func(Progress)
+	// Atomic - extract to a staging directory next to Dir and only replace Dir
+	// with it once everything is extracted.  Dir ends up holding just what was
+	// extracted.  The lock file .<name of Dir>.lock is left next to Dir.
+	Atomic bool
+	// Conflicts - what to do when something is already where an entry goes.
+	Conflicts ConflictPolicies
+	// BackupSuffix - added to names moved out of the way by ConflictBackup,
+	// DefaultBackupSuffix if empty.
+	BackupSuffix string
+	// ContinueOnError - when an entry fails, add it to Report.Errors and go on.
+	// Extract then returns Report.Errors, an ExtractErrors.
+	ContinueOnError bool
+	// Report - filled in by Extract.
+	Report ExtractReport
+	// Sink - if set, entries are written to it instead of Dir, serially.  Dir,
+	// Ops, Sync, Delete, Atomic, Conflicts and Workers do not apply.
+	Sink        Sink
+	links       map[linkKey]string
+	reportMutex sync.Mutex
+	cleanups    []func() error
+	seen        map[string]bool
+	kept        map[string]bool
+	prepare     func() error
+	pool        *extractPool
+	ctx         context.Context
+	progress    *progressState
 }
 
+// FsOps - the changes an Extractor makes to the filesystem.  None of them follow
+// a symlink at the path given.
 type FsOps interface {
 	Chmod(string, os.FileMode) error
 	Chown(string, int, int) error
 	Mknod(string, FileInfo) error
+	Mkdir(string, os.FileMode) error
+	// Create - create a regular file, and return it for writing the content.
+	Create(string, os.FileMode) (io.WriteCloser, error)
+	// Symlink - create a symlink at path pointing to target.
+	Symlink(target, path string) error
+	// Link - create a hard link at path to the existing oldpath.
+	Link(oldpath, path string) error
+	Rename(oldpath, newpath string) error
+	// Remove - remove a file or an empty directory.
+	Remove(string) error
+	// RemoveAll - remove path and what is below it, if anything is there.
+	RemoveAll(string) error
+	Mkfifo(string, os.FileMode) error
+	// Socket - create a unix socket at path, with no one listening on it.
+	Socket(string) error
+	Utimes(path string, atime, mtime time.Time) error
+	Setxattr(path, name string, value []byte) error
 }
 
 type GoFsOps struct{}
@@ -51,16 +114,79 @@ func (g GoFsOps) Chown(name string, uid, gid int) error {
 	return os.Lchown(name, uid, gid)
 }
 
+func (g GoFsOps) Mkdir(name string, mode os.FileMode) error {
+	return os.Mkdir(name, mode)
+}
+
+func (g GoFsOps) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+}
+
+func (g GoFsOps) Symlink(target, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (g GoFsOps) Link(oldpath, path string) error {
+	return os.Link(oldpath, path)
+}
+
+func (g GoFsOps) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (g GoFsOps) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (g GoFsOps) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (g GoFsOps) Mkfifo(name string, mode os.FileMode) error {
+	return syscall.Mkfifo(name, uint32(mode.Perm()))
+}
+
+func (g GoFsOps) Socket(name string) error {
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	// bind creates the socket file, which stays when fd is closed.
+	return unix.Bind(fd, &unix.SockaddrUnix{Name: name})
+}
+
+func (g GoFsOps) Utimes(name string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func (g GoFsOps) Setxattr(name, attr string, value []byte) error {
+	return unix.Lsetxattr(name, attr, value, 0)
+}
+
 func (g GoFsOps) Mknod(path string, info FileInfo) error {
 	stat := info.Sys().(syscall.Stat_t)
-	return syscall.Mknod(path, DefaultFilePerm, int(stat.Rdev))
+	mode := uint32(DefaultFilePerm)
+	if info.FMode&os.ModeCharDevice != 0 {
+		mode |= syscall.S_IFCHR
+	} else if info.FMode&os.ModeDevice != 0 {
+		mode |= syscall.S_IFBLK
+	} else if info.FMode&os.ModeNamedPipe != 0 {
+		mode |= syscall.S_IFIFO
+	}
+	return syscall.Mknod(path, mode, int(stat.Rdev))
 }
 
 // Golang's os.Chown, os.Chmod, syscall.Mknod, make syscalls
 // which are missed by fakeroot's LD_PRELOAD of those filesystem operations.
 // In order to work with fakeroot, we execute the programs
 // 'chown', 'chmod', 'mknod' which are expected to work with fakeroot.
-type FakerootOps struct{}
+// The same goes for mkfifo and setfattr.  What fakeroot does not fake is
+// left to GoFsOps.
+type FakerootOps struct {
+	GoFsOps
+}
 
 func (f FakerootOps) Chmod(name string, mode os.FileMode) error {
 	return exec.Command("chmod", fmt.Sprintf("%04o", mode.Perm()), name).Run()
@@ -99,19 +225,136 @@ func (f FakerootOps) Mknod(path string, info FileInfo) error {
 	return nil
 }
 
+func (f FakerootOps) Mkfifo(name string, mode os.FileMode) error {
+	cmd := exec.Command("mkfifo", fmt.Sprintf("--mode=%o", mode.Perm()), name)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfifo %s failed: %s: %s", name, err, output)
+	}
+	return nil
+}
+
+func (f FakerootOps) Setxattr(name, attr string, value []byte) error {
+	cmd := exec.Command("setfattr", "--no-dereference", "-n", attr, "-v", "0x"+hex.EncodeToString(value), name)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("setfattr %s on %s failed: %s: %s", attr, name, err, output)
+	}
+	return nil
+}
+
 // Extract - extract the
 func (e *Extractor) Extract() error {
-	var walkErr, cleanErr error
-	if e.Ops == nil {
-		if isFakeroot() {
-			e.Ops = FakerootOps{}
-		} else {
-			e.Ops = GoFsOps{}
+	return e.ExtractContext(context.Background())
+}
+
+// ExtractContext - Extract, stopping with ctx.Err() when ctx is cancelled.  The
+// cleanups that restore directory permissions are run either way.
+func (e *Extractor) ExtractContext(ctx context.Context) error {
+	return e.run(ctx, func(walkFn WalkFunc) error {
+		return e.SquashFs.Walk(e.Path, walkFn)
+	})
+}
+
+// run - extract what walker goes through, atomically if e.Atomic is set.
+// Extractions into a directory hold its lock (see lockDir) so they do not
+// write over one another.
+func (e *Extractor) run(ctx context.Context, walker func(WalkFunc) error) error {
+	if _, planning := e.Ops.(*PlanOps); e.Sink == nil && !planning {
+		dir := filepath.Clean(e.Dir)
+		if !e.Atomic {
+			// the lock is on Dir itself, so it is made first.
+			e.setOps()
+			if err := e.Ops.Mkdir(dir, DefaultDirPerm); err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+		unlock, err := lockDir(dir, e.Atomic)
+		if err != nil {
+			return err
 		}
+		defer unlock()
 	}
+	if e.prepare != nil {
+		if err := e.prepare(); err != nil {
+			return err
+		}
+	}
+	if e.Atomic {
+		return e.runAtomic(ctx, walker)
+	}
+	return e.runIn(ctx, walker)
+}
+
+// runIn - call walker with e.extract as the WalkFunc, then run the cleanups.
+func (e *Extractor) runIn(ctx context.Context, walker func(WalkFunc) error) error {
+	var walkErr, cleanErr error
+	e.ctx = ctx
+	e.setOps()
 	e.Logger.Debug("extractor: %#v", e)
 
-	walkErr = e.SquashFs.Walk(e.Path, e.extract)
+	if e.Sink != nil {
+		if e.Sync || e.Delete || e.Atomic {
+			return fmt.Errorf("cannot extract to a sink with sync, delete or atomic")
+		}
+		e.links = map[linkKey]string{}
+	}
+	if e.Delete {
+		e.seen = map[string]bool{}
+	}
+	if e.Filter != nil {
+		if err := e.Filter.compile(); err != nil {
+			return err
+		}
+		var skipped func(string, bool)
+		if e.Delete {
+			e.kept = map[string]bool{}
+			skipped = func(p string, below bool) { e.kept[p] = below }
+		}
+		walker = e.Filter.walker(walker, skipped)
+	}
+	if err := e.preWalk(walker); err != nil {
+		return err
+	}
+	e.Report = ExtractReport{Types: map[string]int64{}}
+	if e.Workers > 1 && e.Sink == nil {
+		e.pool = newExtractPool(e)
+	}
+
+	limits := limitState{limits: e.Limits}
+	walkErr = walker(func(path string, info FileInfo, perr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if perr == nil {
+			if err := limits.check(path, info); err != nil {
+				return err
+			}
+		}
+		if err := e.extract(path, info, perr); err != nil && !e.recordError(err) {
+			return err
+		} else if err != nil && info.IsDir() {
+			// nothing below a directory that could not be made can be extracted.
+			if fi, statErr := e.view().Lstat(filepath.Join(e.Dir, path)); statErr != nil || !fi.IsDir() {
+				return SkipDir
+			}
+		}
+		if e.pool == nil || !info.FMode.IsRegular() {
+			// the worker reports regular files when done.
+			e.progress.done(path)
+		}
+		return nil
+	})
+	if e.pool != nil {
+		if err := e.pool.wait(); walkErr == nil {
+			walkErr = err
+		}
+		e.pool = nil
+	}
+	if walkErr == nil && e.Delete {
+		walkErr = e.deleteExtras()
+	}
+	if walkErr == nil && len(e.Report.Errors) != 0 {
+		walkErr = e.Report.Errors
+	}
 
 	for _, c := range e.cleanups {
 		if err := c(); err != nil {
@@ -132,63 +375,160 @@ func (e *Extractor) Extract() error {
 func (e *Extractor) extract(path string, info FileInfo, perr error) error {
 	if perr != nil {
 		e.Logger.Info("extract called with %s info=%s and %s", path, info.Filename, perr)
-		return perr
+		return e.entryError(path, "read", perr)
 	}
 
-	if whiteOut := getWhiteOut(info); whiteOut != "" {
-		if !e.WhiteOuts {
-			e.Logger.Debug("not extracting white-out file %s", path)
+	// without whiteout handling, aufs .wh. files are just regular files.
+	whiteOut := getWhiteOut(info)
+	if e.WhiteOuts == WhiteOutSkip && info.FMode.IsRegular() {
+		whiteOut = ""
+	}
+	if whiteOut != "" && e.Filter != nil {
+		// whiteOut is an image path, it is renamed as what it hides would be.
+		var ok bool
+		if whiteOut, ok = e.Filter.whiteOutTarget(whiteOut); !ok {
+			e.Logger.Debug("not applying white-out %s, the filter leaves its target out", path)
+			e.recordSkip(path, "whiteout target not extracted")
 			return nil
 		}
-		return e.applyWhiteOut(path, whiteOut)
+	}
+	if whiteOut != "" {
+		if err := e.extractWhiteOut(path, whiteOut, info); err == errKeepExisting {
+			e.recordSkip(path, "kept existing entry")
+		} else if err != nil {
+			return e.entryError(path, "whiteout", err)
+		}
+		return nil
+	}
+
+	if info.Name() == OpaqueMarker && e.WhiteOuts != WhiteOutAUFS && e.WhiteOuts != WhiteOutSkip {
+		// the marker only flags its directory, which extractDir has dealt with.
+		e.Logger.Debug("not extracting opaque marker %s", path)
+		e.recordSkip(path, "opaque marker")
+		return nil
 	}
 
 	mode := info.FMode
+	fpath := filepath.Join(e.Dir, path)
+
+	if mode&os.ModeSocket != 0 && !e.Sockets {
+		e.Logger.Debug("skipping socket %s", path)
+		e.recordSkip(path, "sockets not extracted")
+		return nil
+	} else if mode&os.ModeDevice != 0 && !e.Devs {
+		e.Logger.Debug("skipping block device node %s", path)
+		e.recordSkip(path, "devices not extracted")
+		return nil
+	} else if mode&os.ModeCharDevice != 0 && !e.Devs {
+		e.Logger.Debug("skipping char device node %s", path)
+		e.recordSkip(path, "devices not extracted")
+		return nil
+	}
+
+	if e.seen != nil {
+		e.seen[path] = true
+	}
+
+	if e.Sink != nil {
+		if err := e.addToSink(path, info); err != nil {
+			return e.entryError(path, "write", err)
+		}
+		e.recordDone(info)
+		return nil
+	}
 
 	var err error
-	if mode&os.ModeDir != 0 {
+	unchanged := false
+	if e.Sync && !mode.IsDir() {
+		if unchanged, err = e.unchanged(path, info); err != nil {
+			return e.entryError(path, "compare", err)
+		}
+	}
+	if (e.Sync || e.Delete) && !unchanged {
+		if st, statErr := e.view().Lstat(fpath); statErr != nil {
+			e.Logger.Verbose("create %s", path)
+			e.recordSync(&e.Report.Created)
+		} else if mode.IsDir() && st.IsDir() {
+			// an existing directory is kept, only its metadata is set again.
+			e.recordSync(&e.Report.Unchanged)
+		} else {
+			e.Logger.Verbose("update %s", path)
+			e.recordSync(&e.Report.Updated)
+		}
+	}
+
+	if unchanged {
+		e.Logger.Debug("unchanged %s", path)
+		e.recordSync(&e.Report.Unchanged)
+		e.recordSkip(path, "unchanged")
+		if mode.IsRegular() {
+			e.progress.add(path, info.FSize)
+		}
+	} else if mode&os.ModeDir != 0 {
 		err = e.extractDir(path, info)
 	} else if mode&os.ModeSymlink != 0 {
 		err = e.extractSymlink(path, info)
 	} else if mode&os.ModeSocket != 0 {
-		if !e.Sockets {
-			e.Logger.Debug("skipping socket %s", path)
-			return nil
-		}
 		err = e.extractSocket(path, info)
 	} else if mode&os.ModeNamedPipe != 0 {
 		err = e.extractNamedPipe(path, info)
 	} else if mode&os.ModeDevice != 0 {
-		if !e.Devs {
-			e.Logger.Debug("skipping block device node %s", path)
-			return nil
-		}
 		err = e.extractBlockDevice(path, info)
 	} else if mode&os.ModeCharDevice != 0 {
-		if !e.Devs {
-			e.Logger.Debug("skipping char device node %s", path)
-			return nil
-		}
 		err = e.extractCharDevice(path, info)
 	} else if mode&os.ModeIrregular != 0 {
 		err = e.extractIrregular(path, info)
 	} else if mode.IsRegular() {
+		if e.pool != nil {
+			// written by a worker, which calls finish.
+			return e.pool.submit(path, info)
+		}
 		err = e.extractRegular(path, info)
 	} else {
-		return fmt.Errorf("could not determine file type of '%s'", path)
+		return e.entryError(path, "extract", fmt.Errorf("could not determine file type of '%s'", path))
 	}
 
-	if err != nil {
+	if err == errKeepExisting {
+		e.recordSkip(path, "kept existing entry")
+		if mode.IsDir() {
+			// what is kept is not a directory, nothing can go below it.
+			return SkipDir
+		}
+		return nil
+	} else if err != nil {
+		return e.entryError(path, extractOp(mode), err)
+	}
+
+	if e.pool != nil && mode.IsDir() && !e.Perms {
+		if err := e.keepWritable(path); err != nil {
+			return e.entryError(path, "chmod", err)
+		}
+	}
+
+	if err := e.finish(path, info, unchanged); err != nil {
 		return err
 	}
+	if !unchanged {
+		e.recordDone(info)
+	}
+	return nil
+}
 
+// finish - set times, owner and permissions of path once it is extracted.
+func (e *Extractor) finish(path string, info FileInfo, unchanged bool) error {
 	fpath := filepath.Join(e.Dir, path)
+	if e.Sync && !unchanged && info.FMode.IsRegular() {
+		if err := e.Ops.Utimes(fpath, info.FModTime, info.FModTime); err != nil {
+			return e.entryError(path, "chtimes", err)
+		}
+	}
+
 	if e.Owners {
 		stat := info.Sys().(syscall.Stat_t)
 		e.Logger.Debug("chown(%s, %d, %d)", path, stat.Uid, stat.Gid)
 		if err := e.Ops.Chown(fpath, int(stat.Uid), int(stat.Gid)); err != nil {
 			e.Logger.Info("chown(%s, %d, %d) failed: %s", path, stat.Uid, stat.Gid, err)
-			return err
+			return e.entryError(path, "chown", err)
 		}
 	}
 
@@ -197,11 +537,16 @@ func (e *Extractor) extract(path string, info FileInfo, perr error) error {
 		// you can't chmod a symlink.
 		if mode&os.ModeSymlink == 0 {
 			modrw := ""
-			// if a dir does not have owner RW perms, then extract it with RW and add a cleanup to set it back
-			if mode&os.ModeDir != 0 && mode.Perm()&0600 == 0 {
+			// if a dir does not have owner RW perms, then extract it with RW and add a cleanup to set it back.
+			// workers write files after the walk has moved on, so then it has to stay writable.
+			addPerms, needed := os.FileMode(0600), mode.Perm()&0600 == 0
+			if e.pool != nil {
+				addPerms, needed = 0700, mode.Perm()&0700 != 0700
+			}
+			if mode&os.ModeDir != 0 && needed {
 				oldMode := mode
-				mode |= 0600
-				modrw = "(+rw)"
+				mode |= addPerms
+				modrw = fmt.Sprintf("(+%o)", addPerms)
 				e.cleanups = append(e.cleanups, func() error {
 					e.Logger.Debug("fixing %s back to %04o", path, oldMode.Perm())
 					return e.Ops.Chmod(fpath, oldMode)
@@ -210,7 +555,7 @@ func (e *Extractor) extract(path string, info FileInfo, perr error) error {
 			e.Logger.Debug("chmod(%s, %04o)%s", path, mode.Perm(), modrw)
 			if err := e.Ops.Chmod(fpath, mode); err != nil {
 				e.Logger.Info("chmod(%s, %04o) failed: %s", path, mode.Perm(), err)
-				return err
+				return e.entryError(path, "chmod", err)
 			}
 		}
 	}
@@ -223,7 +568,7 @@ func (e *Extractor) extractSymlink(path string, info FileInfo) error {
 	targetPath := filepath.Join(e.Dir, path)
 	return e.doCreate(targetPath, info,
 		func() error {
-			return os.Symlink(info.SymlinkTarget, targetPath)
+			return e.Ops.Symlink(info.SymlinkTarget, targetPath)
 		})
 }
 
@@ -232,7 +577,7 @@ func (e *Extractor) extractNamedPipe(path string, info FileInfo) error {
 	targetPath := filepath.Join(e.Dir, path)
 	return e.doCreate(targetPath, info,
 		func() error {
-			return syscall.Mkfifo(targetPath, DefaultFilePerm)
+			return e.Ops.Mkfifo(targetPath, DefaultFilePerm)
 		},
 	)
 }
@@ -242,8 +587,7 @@ func (e *Extractor) extractSocket(path string, info FileInfo) error {
 	targetPath := filepath.Join(e.Dir, path)
 	return e.doCreate(targetPath, info,
 		func() error {
-			_, err := net.Listen("unix", targetPath)
-			return err
+			return e.Ops.Socket(targetPath)
 		})
 }
 
@@ -267,13 +611,18 @@ func (e *Extractor) extractRegular(path string, info FileInfo) error {
 	cleanup, err := e.prepWrite(targetPath, info)
 
 	if err == nil {
-		if writeFp, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY, DefaultFilePerm); err == nil {
-			defer writeFp.Close()
-			if written, err := io.Copy(writeFp, info.File); err == nil {
+		if writeFp, err := e.Ops.Create(targetPath, DefaultFilePerm); err == nil {
+			if written, err := io.Copy(progressWriter{writeFp, e, path}, info.File); err == nil {
 				if written != info.FSize {
 					finalError = fmt.Errorf("wrote %d bytes to %s. expected %d from %s",
 						written, targetPath, info.FSize, path)
 				}
+			} else {
+				finalError = err
+			}
+			// the writer may be remote, where Close is what fails.
+			if err := writeFp.Close(); finalError == nil {
+				finalError = err
 			}
 		} else {
 			finalError = err
@@ -283,7 +632,11 @@ func (e *Extractor) extractRegular(path string, info FileInfo) error {
 	}
 
 	cleanupError = cleanup()
-	if finalError != nil {
+	if finalError == errKeepExisting && cleanupError != nil {
+		return cleanupError
+	} else if finalError == errKeepExisting {
+		return finalError
+	} else if finalError != nil {
 		// there was an error before cleanup, so log the cleanup error, return the real error.
 		e.Logger.Info("prepWrite cleanup for %s failed: %s", targetPath, cleanupError)
 	} else {
@@ -301,29 +654,69 @@ func (e *Extractor) extractDir(path string, info FileInfo) error {
 
 	// we do not use doCreate here because we do not want to remove if exist.
 	fpath := filepath.Join(e.Dir, path)
-	if err := os.Mkdir(fpath, DefaultDirPerm); os.IsExist(err) {
-		return nil
-	} else if err != nil {
+	if finfo, err := e.view().Lstat(fpath); err == nil && !finfo.IsDir() {
+		// something else is in the way.
+		cleanup, err := e.prepWrite(fpath, info)
+		if cerr := cleanup(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := e.Ops.Mkdir(fpath, DefaultDirPerm); err != nil && !os.IsExist(err) {
 		return err
 	}
-	return nil
-}
-
-func (e *Extractor) applyWhiteOut(path string, whiteOut string) error {
-	fp := filepath.Join(e.Dir, path)
-	if PathExists(fp) {
-		e.Logger.Debug("applying white-out '%s' by removing '%s'", whiteOut, path)
-		return os.RemoveAll(fp)
+	if e.WhiteOuts != WhiteOutSkip && IsOpaque(info) {
+		return e.extractOpaque(path, info)
 	}
 	return nil
 }
 
 // prepWrite - prepare to write to path
 //   if dirname(path) is not a directory - return error
+//   if something is at path, apply the conflict policy for finfo
 func (e *Extractor) prepWrite(path string, finfo FileInfo) (func() error, error) {
+	cleanup, err := e.prepParent(path)
+	if err != nil {
+		return cleanup, err
+	}
+
+	pathFinfo, err := e.view().Lstat(path)
+	if os.IsNotExist(err) {
+		// nothing to do
+		return cleanup, nil
+	} else if err != nil {
+		return cleanup, err
+	}
+
+	if pathFinfo.IsDir() && finfo.IsDir() {
+		// path is already a dir, leave it.
+		// caller has to deal with mkdir failing with os.IsExist()
+		return cleanup, nil
+	}
+
+	moved, err := e.resolveConflict(path, pathFinfo, finfo)
+	if err != nil || moved {
+		return cleanup, err
+	}
+
+	// path exists, so get rid of it.
+	if pathFinfo.IsDir() {
+		// path is a dir, but we want something else there so purge.
+		return cleanup, e.Ops.RemoveAll(path)
+	}
+
+	// path exists, but is not a dir.
+	return cleanup, e.Ops.Remove(path)
+}
+
+// prepParent - make the directory path goes in writable, return the function that sets it back.
+//   if dirname(path) is not a directory - return error
+func (e *Extractor) prepParent(path string) (func() error, error) {
 	cleanup := func() error { return nil }
 	dir := filepath.Dir(path)
-	dirFinfo, err := os.Stat(dir)
+	dirFinfo, err := e.view().Stat(dir)
 	if err != nil {
 		// could not stat parent directory.
 		return cleanup, err
@@ -333,7 +726,7 @@ func (e *Extractor) prepWrite(path string, finfo FileInfo) (func() error, error)
 		return cleanup, fmt.Errorf("dirname(%s) = %s : not a directory", path, dir)
 	}
 
-	if unix.Access(dir, unix.W_OK) != nil {
+	if e.view().Access(dir, unix.W_OK) != nil {
 		oldPerms := dirFinfo.Mode()
 		setBack := func() error {
 			return e.Ops.Chmod(dir, oldPerms)
@@ -341,7 +734,7 @@ func (e *Extractor) prepWrite(path string, finfo FileInfo) (func() error, error)
 		if err := e.Ops.Chmod(dir, OpenDirPerm); err != nil {
 			return cleanup, err
 		}
-		if unix.Access(dir, unix.W_OK) != nil {
+		if e.view().Access(dir, unix.W_OK) != nil {
 			if err := setBack(); err != nil {
 				return cleanup, fmt.Errorf("cannot make %s writable, failed setting back", dir)
 			}
@@ -349,31 +742,7 @@ func (e *Extractor) prepWrite(path string, finfo FileInfo) (func() error, error)
 		}
 		cleanup = setBack
 	}
-
-	pathFinfo, err := os.Lstat(path)
-	if os.IsNotExist(err) {
-		// nothing to do
-		return cleanup, nil
-	} else if err != nil {
-		return cleanup, err
-	}
-
-	// path exists, so get rid of it.
-	if pathFinfo.IsDir() {
-		if finfo.IsDir() {
-			// path is already a dir, leave it.
-			// caller has to deal with mkdir failing with os.IsExist()
-			return cleanup, nil
-		}
-		// path is a dir, but we want something else there so purge.
-		if err := os.RemoveAll(path); err != nil {
-			return cleanup, err
-		}
-		return cleanup, nil
-	}
-
-	// path exists, but is not a dir.
-	return cleanup, os.Remove(path)
+	return cleanup, nil
 }
 
 // doCreate - prep writing of fInfo to path, and then call creator.
@@ -382,6 +751,8 @@ func (e *Extractor) doCreate(path string, fInfo FileInfo, creator func() error)
 	cleanup, err := e.prepWrite(path, fInfo)
 	if err == nil {
 		createError = creator()
+	} else {
+		createError = err
 	}
 	cleanupError = cleanup()
 
@@ -394,19 +765,19 @@ func (e *Extractor) doCreate(path string, fInfo FileInfo, creator func() error)
 	return createError
 }
 
-func isFakeroot() bool {
-	return os.Getenv("FAKEROOTKEY") != ""
-}
-
-func getWhiteOut(info FileInfo) string {
-	// squashfs / overlayfs is a character device major/minor 0/0 with same name.
-	if info.FMode&os.ModeCharDevice != 0 {
-		stat := info.Sys().(syscall.Stat_t)
-		if stat.Rdev == 0 {
-			return info.Filename
+// setOps - use FakerootOps under fakeroot and GoFsOps otherwise, if e.Ops is not set.
+func (e *Extractor) setOps() {
+	if e.Ops == nil {
+		if isFakeroot() {
+			e.Ops = FakerootOps{}
+		} else {
+			e.Ops = GoFsOps{}
 		}
 	}
-	return ""
+}
+
+func isFakeroot() bool {
+	return os.Getenv("FAKEROOTKEY") != ""
 }
 
 func PathExists(d string) bool {
@@ -0,0 +1,377 @@
+package squashfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter - selects and renames the entries an Extractor writes.
+//
+// An entry is extracted if it is not excluded and it, or a directory above it,
+// is included (everything is included if there are no include patterns).
+// Directories above included entries are extracted too.  Glob patterns
+// (path.Match) with a "/" are matched against the absolute path in the image,
+// those without against the base name.  Regular expressions are matched
+// against the absolute path.
+//
+// Extracted paths are renamed by Prefixes, then Transforms, then StripComponents,
+// as tar does.  Entries that end up with no name are not extracted, but
+// what is below them still is.
+type Filter struct {
+	Include      []string
+	Exclude      []string
+	IncludeRegex []string
+	ExcludeRegex []string
+	// Prefixes - replace the leading From components of paths with To.
+	Prefixes []PrefixRewrite
+	// Transforms - sed style "s/regex/replacement/flags" rules, flags g and i.
+	Transforms []string
+	// StripComponents - drop this many leading components from paths.
+	StripComponents int
+
+	includeRe  []*regexp.Regexp
+	excludeRe  []*regexp.Regexp
+	transforms []transform
+}
+
+// PrefixRewrite - a Filter rule renaming the directory From to To.
+type PrefixRewrite struct {
+	From string
+	To   string
+}
+
+type transform struct {
+	re     *regexp.Regexp
+	repl   string
+	global bool
+}
+
+// IncludeFile - add the paths listed in r, one per line, as includes.  Blank lines
+// and lines starting with '#' are ignored.  Paths are literal, not patterns.
+func (f *Filter) IncludeFile(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f.Include = append(f.Include, globQuote(path.Clean("/"+line)))
+	}
+	return scanner.Err()
+}
+
+// globQuote - escape the path.Match meta characters in s.
+func globQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(s)
+}
+
+func (f *Filter) compile() error {
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern '%s': %s", pattern, err)
+		}
+	}
+
+	f.includeRe, f.excludeRe = []*regexp.Regexp{}, []*regexp.Regexp{}
+	for _, expr := range f.IncludeRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("bad include regex '%s': %s", expr, err)
+		}
+		f.includeRe = append(f.includeRe, re)
+	}
+	for _, expr := range f.ExcludeRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("bad exclude regex '%s': %s", expr, err)
+		}
+		f.excludeRe = append(f.excludeRe, re)
+	}
+
+	f.transforms = []transform{}
+	for _, rw := range f.Prefixes {
+		from := path.Clean("/" + rw.From)
+		re := regexp.MustCompile("^" + regexp.QuoteMeta(from) + "(/|$)")
+		f.transforms = append(f.transforms,
+			transform{re, strings.ReplaceAll(path.Clean("/"+rw.To), "$", "$$") + "${1}", false})
+	}
+	for _, expr := range f.Transforms {
+		t, err := parseTransform(expr)
+		if err != nil {
+			return err
+		}
+		f.transforms = append(f.transforms, t)
+	}
+
+	if f.StripComponents < 0 {
+		return fmt.Errorf("bad strip components %d", f.StripComponents)
+	}
+	return nil
+}
+
+// parseTransform - parse a sed "s/regex/replacement/flags" rule, any delimiter can be used.
+func parseTransform(expr string) (transform, error) {
+	t := transform{}
+	if len(expr) < 2 || expr[0] != 's' {
+		return t, fmt.Errorf("bad transform '%s': expected s/regex/replacement/flags", expr)
+	}
+	delim := expr[1]
+	parts := []string{}
+	cur := strings.Builder{}
+	for i := 2; i < len(expr); i++ {
+		if expr[i] == '\\' && i+1 < len(expr) && expr[i+1] == delim {
+			cur.WriteByte(delim)
+			i++
+		} else if expr[i] == delim {
+			parts = append(parts, cur.String())
+			cur.Reset()
+		} else {
+			cur.WriteByte(expr[i])
+		}
+	}
+	parts = append(parts, cur.String())
+	if len(parts) != 3 {
+		return t, fmt.Errorf("bad transform '%s': expected s/regex/replacement/flags", expr)
+	}
+
+	flags := ""
+	for _, c := range parts[2] {
+		switch c {
+		case 'g':
+			t.global = true
+		case 'i':
+			flags = "(?i)"
+		default:
+			return t, fmt.Errorf("bad transform '%s': unknown flag '%c'", expr, c)
+		}
+	}
+
+	var err error
+	if t.re, err = regexp.Compile(flags + parts[0]); err != nil {
+		return t, fmt.Errorf("bad transform '%s': %s", expr, err)
+	}
+	t.repl = sedReplacement(parts[1])
+	return t, nil
+}
+
+// sedReplacement - turn a sed replacement (\1, &) into a regexp.Expand template.
+func sedReplacement(repl string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(repl); i++ {
+		switch c := repl[i]; {
+		case c == '\\' && i+1 < len(repl):
+			i++
+			if repl[i] >= '0' && repl[i] <= '9' {
+				b.WriteString("${" + strconv.Itoa(int(repl[i]-'0')) + "}")
+			} else if repl[i] == '$' {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte(repl[i])
+			}
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '$':
+			b.WriteString("$$")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (t transform) apply(p string) string {
+	if t.global {
+		return t.re.ReplaceAllString(p, t.repl)
+	}
+	loc := t.re.FindStringSubmatchIndex(p)
+	if loc == nil {
+		return p
+	}
+	out := t.re.ExpandString(nil, t.repl, p, loc)
+	return p[:loc[0]] + string(out) + p[loc[1]:]
+}
+
+// rename - return the extraction path for p, false if it has none.
+func (f *Filter) rename(p string) (string, bool) {
+	if p == "/" {
+		return p, true
+	}
+	for _, t := range f.transforms {
+		p = t.apply(p)
+	}
+	parts := strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/")
+	if len(parts) <= f.StripComponents || parts[0] == "" {
+		return "", false
+	}
+	return "/" + strings.Join(parts[f.StripComponents:], "/"), true
+}
+
+func globMatch(pattern, p string) bool {
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(p))
+		return matched
+	}
+	matched, _ := path.Match(path.Clean("/"+pattern), p)
+	return matched
+}
+
+func (f *Filter) excluded(p string) bool {
+	for _, pattern := range f.Exclude {
+		if globMatch(pattern, p) {
+			return true
+		}
+	}
+	for _, re := range f.excludeRe {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) included(p string) bool {
+	if len(f.Include) == 0 && len(f.includeRe) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if globMatch(pattern, p) {
+			return true
+		}
+	}
+	for _, re := range f.includeRe {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayIncludeBelow - could anything below the directory dir be included.
+func (f *Filter) mayIncludeBelow(dir string) bool {
+	if len(f.includeRe) != 0 {
+		return true
+	}
+	dirParts := strings.Split(strings.Trim(dir, "/"), "/")
+	if dir == "/" {
+		dirParts = []string{}
+	}
+	for _, pattern := range f.Include {
+		if !strings.Contains(pattern, "/") {
+			return true
+		}
+		patParts := strings.Split(strings.Trim(path.Clean("/"+pattern), "/"), "/")
+		if len(patParts) <= len(dirParts) {
+			continue
+		}
+		matched := true
+		for i, part := range dirParts {
+			if ok, _ := path.Match(patParts[i], part); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// whiteOutTarget - the extraction path of target, an image path hidden by a whiteout
+// that is extracted.  False if f leaves target out or it has no name.
+func (f *Filter) whiteOutTarget(target string) (string, bool) {
+	if f.excluded(target) {
+		return "", false
+	}
+	included := f.included(target)
+	for d := path.Dir(target); !included && d != "/"; d = path.Dir(d) {
+		included = f.included(d)
+	}
+	if !included {
+		return "", false
+	}
+	return f.rename(target)
+}
+
+// isBelow - is p dir or below it.
+func isBelow(p, dir string) bool {
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+type pendingDir struct {
+	path string
+	info FileInfo
+}
+
+// walker - wrap walker so only the entries f selects reach the WalkFunc, renamed.
+// Directories that cannot hold anything included are skipped with SkipDir.
+// If skipped is not nil it is called with the renamed path of the entries that are
+// left out, below is set when what is below the entry is left out too.
+func (f *Filter) walker(walker func(WalkFunc) error, skipped func(p string, below bool)) func(WalkFunc) error {
+	return func(walkFn WalkFunc) error {
+		// directories not extracted (yet), in case something below is included.
+		pending := []pendingDir{}
+		includedDir := ""
+
+		emit := func(p string, info FileInfo) error {
+			if name, ok := f.rename(p); ok {
+				return walkFn(name, info, nil)
+			}
+			return nil
+		}
+		skip := func(p string, below bool) {
+			if name, ok := f.rename(p); ok && skipped != nil {
+				skipped(name, below)
+			}
+		}
+
+		return walker(func(p string, info FileInfo, err error) error {
+			if err != nil {
+				return walkFn(p, info, err)
+			}
+			for len(pending) != 0 && !isBelow(p, pending[len(pending)-1].path) {
+				pending = pending[:len(pending)-1]
+			}
+			if includedDir != "" && !isBelow(p, includedDir) {
+				includedDir = ""
+			}
+
+			if f.excluded(p) {
+				skip(p, info.IsDir())
+				if info.IsDir() {
+					return SkipDir
+				}
+				return nil
+			}
+
+			if includedDir == "" && !f.included(p) {
+				if !info.IsDir() {
+					skip(p, false)
+					return nil
+				} else if f.mayIncludeBelow(p) {
+					skip(p, false)
+					pending = append(pending, pendingDir{p, info})
+					return nil
+				}
+				skip(p, true)
+				return SkipDir
+			}
+
+			if info.IsDir() && includedDir == "" {
+				includedDir = p
+			}
+			for _, d := range pending {
+				if err := emit(d.path, d.info); err != nil {
+					return err
+				}
+			}
+			pending = pending[:0]
+			return emit(p, info)
+		})
+	}
+}
@@ -1,8 +1,15 @@
 module github.com/anuvu/squashfs
 
-go 1.14
+go 1.17
 
 require (
 	github.com/urfave/cli/v2 v2.2.0
+	golang.org/x/crypto v0.8.0
 	golang.org/x/sys v0.7.0
 )
+
+require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+)
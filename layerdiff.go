@@ -0,0 +1,158 @@
+package squashfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// DiffOptions - options for Diff.
+type DiffOptions struct {
+	// Compression - see WriterOptions.Compression.
+	Compression string
+	Logger      Logger
+}
+
+// Diff - write a squashfs layer to out that turns lower into upper when stacked on it.
+// The layer is in the overlayfs format: it holds the added and modified
+// entries of upper, 0/0 char device whiteouts for removed entries, and the
+// OpaqueXattr on directories whose lower content is all gone.  It is built with a Writer, so no privileges or
+// external tools are needed, and hard links in upper stay hard links.
+func Diff(lower, upper Tree, out string, opts DiffOptions) error {
+	if opts.Logger == nil {
+		opts.Logger = PrintfLogger{}
+	}
+
+	lowerEnts, err := lower.Entries()
+	if err != nil {
+		return fmt.Errorf("failed reading lower: %s", err)
+	}
+	upperEnts, err := upper.Entries()
+	if err != nil {
+		return fmt.Errorf("failed reading upper: %s", err)
+	}
+
+	include := map[string]bool{"/": true}
+	whiteOuts := []string{}
+	removedIn := map[string]int{}
+	lowerChildren := map[string]int{}
+
+	for _, p := range sortedPaths(lowerEnts) {
+		if p == "/" {
+			continue
+		}
+		parent := path.Dir(p)
+		lowerChildren[parent]++
+		if _, ok := upperEnts[p]; ok {
+			continue
+		}
+		if pent, ok := upperEnts[parent]; !ok || !pent.Mode.IsDir() {
+			// gone with its parent, or the parent was replaced.
+			continue
+		}
+		whiteOuts = append(whiteOuts, p)
+		removedIn[parent]++
+	}
+
+	for _, p := range sortedPaths(upperEnts) {
+		if l, ok := lowerEnts[p]; ok {
+			changes, err := compareEntries(lower, l, upper, upperEnts[p], false)
+			if err != nil {
+				return err
+			}
+			if len(changes) == 0 {
+				continue
+			}
+			opts.Logger.Debug("modified %s: %s", p, strings.Join(changes, ","))
+		} else {
+			opts.Logger.Debug("added %s", p)
+		}
+		include[p] = true
+	}
+
+	// make the directory opaque rather than write whiteouts when nothing of the lower dir is left.
+	opaque := map[string]bool{}
+	for dir, n := range removedIn {
+		if n == lowerChildren[dir] && lowerEnts[dir].Mode.IsDir() {
+			opaque[dir] = true
+		}
+	}
+	for _, p := range whiteOuts {
+		include[path.Dir(p)] = true
+	}
+	for p := range include {
+		for d := path.Dir(p); d != "/"; d = path.Dir(d) {
+			include[d] = true
+		}
+	}
+
+	layer := map[string]TreeEntry{}
+	for p := range include {
+		layer[p] = upperEnts[p]
+	}
+	for _, p := range whiteOuts {
+		if opaque[path.Dir(p)] {
+			continue
+		}
+		opts.Logger.Debug("whiteout %s", p)
+		layer[p] = TreeEntry{Path: p, Mode: os.ModeCharDevice, ModTime: upperEnts[path.Dir(p)].ModTime}
+	}
+	for dir := range opaque {
+		opts.Logger.Debug("opaque %s", dir)
+		ent := layer[dir]
+		xattrs := map[string]string{OpaqueXattr: "y"}
+		for k, v := range ent.Xattrs {
+			xattrs[k] = v
+		}
+		ent.Xattrs = xattrs
+		layer[dir] = ent
+	}
+
+	w, err := NewWriter(out, WriterOptions{Compression: opts.Compression})
+	if err != nil {
+		return err
+	}
+	if err := writeLayer(w, upper, layer); err != nil {
+		w.Discard()
+		return err
+	}
+	return w.Close()
+}
+
+// writeLayer - add the entries of layer to w, parents first.  The content of
+// regular files is read from t, entries of t with the same Ino are written as
+// hard links.
+func writeLayer(w *Writer, t Tree, layer map[string]TreeEntry) error {
+	links := map[uint64]string{}
+	for _, p := range sortedPaths(layer) {
+		ent := layer[p]
+		if ent.Ino != 0 && !ent.Mode.IsDir() {
+			if first, ok := links[ent.Ino]; ok {
+				if err := w.Link(p, first); err != nil {
+					return err
+				}
+				continue
+			}
+			links[ent.Ino] = p
+		}
+
+		if ent.Type() != "file" || ent.Size == 0 {
+			if err := w.Add(ent, bytes.NewReader(nil)); err != nil {
+				return err
+			}
+			continue
+		}
+		r, err := t.Open(p)
+		if err != nil {
+			return err
+		}
+		err = w.Add(ent, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package squashfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffRoundTrip(t *testing.T) {
+	d := tempDir(t)
+	lower := writeTestImage(t, filepath.Join(d, "lower.squashfs"), []testEntry{
+		tdir("/"),
+		tfile("/a", "a"),
+		tdir("/dir"),
+		tfile("/dir/x", "x"),
+		tfile("/dir/y", "y"),
+		tfile("/f2d", "file"),
+		tfile("/gone", "gone"),
+		tfile("/keep", "keep"),
+	})
+	defer lower.Free()
+	upper := writeTestImage(t, filepath.Join(d, "upper.squashfs"), []testEntry{
+		tdir("/"),
+		tfile("/a", "changed"),
+		tdir("/dir"),
+		tfile("/dir/z", "z"),
+		tdir("/f2d"),
+		tfile("/f2d/in", "in"),
+		tfile("/keep", "keep"),
+		tfile("/new", "new"),
+	})
+	defer upper.Free()
+
+	out := filepath.Join(d, "diff.squashfs")
+	if err := Diff(ImageTree{&lower}, ImageTree{&upper}, out, DiffOptions{Logger: PrintfLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := OpenSquashfs(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer diff.Free()
+
+	ents, err := ImageTree{&diff}.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ents["/keep"]; ok {
+		t.Errorf("unchanged /keep is in the layer")
+	}
+	if ents["/gone"].Mode&os.ModeCharDevice == 0 || ents["/gone"].Rdev != 0 {
+		t.Errorf("/gone should be a 0/0 char device whiteout: %+v", ents["/gone"])
+	}
+	if ents["/dir"].Xattrs[OpaqueXattr] != "y" {
+		t.Errorf("/dir should have the opaque xattr: %v", ents["/dir"].Xattrs)
+	}
+	if _, ok := ents["/dir/"+OpaqueMarker]; ok {
+		t.Errorf("the layer has an AUFS opaque marker")
+	}
+
+	stacked := filepath.Join(d, "stacked")
+	want := filepath.Join(d, "upper")
+	for _, dir := range []string{stacked, want} {
+		if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := MultiExtractor{Dir: stacked, Layers: []SquashFs{lower, diff}, Logger: PrintfLogger{}}
+	if err := m.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	e := Extractor{Dir: want, SquashFs: upper, Path: "/", Logger: PrintfLogger{}}
+	if err := e.Extract(); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := Compare(DirTree(want), DirTree(stacked), CompareOptions{IgnoreMtime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("lower with the diff stacked differs from upper: %v", changes)
+	}
+}
@@ -0,0 +1,141 @@
+package squashfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Limits - caps on what an Extractor writes, for images that are not trusted.
+// Zero values mean no limit.
+type Limits struct {
+	// TotalBytes - total size of the regular files extracted.
+	TotalBytes int64
+	// FileSize - size of any one regular file.
+	FileSize int64
+	// Entries - number of entries extracted.
+	Entries int64
+	// Depth - number of components in an extracted path.
+	Depth int
+	// PathLength - length of an extracted path, relative to Dir.
+	PathLength int
+	// CheckFreeSpace - before starting, check the filesystem of Dir has room for
+	// all the regular files, plus Reserve bytes.
+	CheckFreeSpace bool
+	Reserve        int64
+}
+
+// LimitError - extraction stopped because Limit was hit: Value is over Max.
+type LimitError struct {
+	Limit string
+	Path  string
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s limit exceeded: %d > %d", e.Limit, e.Value, e.Max)
+	}
+	return fmt.Sprintf("%s: %s limit exceeded: %d > %d", e.Path, e.Limit, e.Value, e.Max)
+}
+
+// limitState - what has been extracted so far, to check against Limits.
+type limitState struct {
+	limits  Limits
+	entries int64
+	bytes   int64
+}
+
+func (ls *limitState) check(path string, info FileInfo) error {
+	l := ls.limits
+	ls.entries++
+	if l.Entries > 0 && ls.entries > l.Entries {
+		return &LimitError{"entries", path, ls.entries, l.Entries}
+	}
+	if l.PathLength > 0 && len(path) > l.PathLength {
+		return &LimitError{"path length", path, int64(len(path)), int64(l.PathLength)}
+	}
+	if depth := strings.Count(strings.TrimSuffix(path, "/"), "/"); l.Depth > 0 && depth > l.Depth {
+		return &LimitError{"depth", path, int64(depth), int64(l.Depth)}
+	}
+	if !info.FMode.IsRegular() {
+		return nil
+	}
+	if l.FileSize > 0 && info.FSize > l.FileSize {
+		return &LimitError{"file size", path, info.FSize, l.FileSize}
+	}
+	ls.bytes += info.FSize
+	if l.TotalBytes > 0 && ls.bytes > l.TotalBytes {
+		return &LimitError{"total bytes", path, ls.bytes, l.TotalBytes}
+	}
+	return nil
+}
+
+// preWalk - go through walker once before extracting, for what needs to know about
+// everything first: the free space check and Progress.  With CheckFreeSpace the
+// other limits are checked on the way, so nothing is written if the image is over
+// them.
+func (e *Extractor) preWalk(walker func(WalkFunc) error) error {
+	checkSpace := e.Limits.CheckFreeSpace && e.Sink == nil
+	if !checkSpace && e.Progress == nil {
+		return nil
+	}
+
+	ls := limitState{limits: e.Limits}
+	total := Progress{}
+	err := walker(func(path string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		total.TotalEntries++
+		if info.FMode.IsRegular() {
+			total.TotalBytes += info.FSize
+		}
+		if checkSpace {
+			return ls.check(path, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if checkSpace {
+		if err := e.checkFreeSpace(total.TotalBytes); err != nil {
+			return err
+		}
+	}
+	if e.Progress != nil {
+		e.progress = &progressState{p: total, report: e.Progress}
+	}
+	return nil
+}
+
+// checkFreeSpace - check the filesystem of e.Dir has room for size bytes of regular
+// files, plus e.Limits.Reserve.
+func (e *Extractor) checkFreeSpace(size int64) error {
+	need := size + e.Limits.Reserve
+
+	// a plan may be of a Dir that does not exist yet, its parent has the room.
+	dir := e.Dir
+	if _, planning := e.Ops.(*PlanOps); planning {
+		for dir != filepath.Dir(dir) {
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("cannot check free space in %s: %s", e.Dir, err)
+	}
+	if free := int64(st.Bavail) * int64(st.Bsize); need > free {
+		return &LimitError{"free space", e.Dir, need, free}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package squashfs
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/sys/unix"
+)
+
+// ManifestEntry - the record for one entry of a Manifest.
+type ManifestEntry struct {
+	// Path - relative to the manifest root, "." for the root itself.
+	Path string `json:"path"`
+	// Type - dir, file, symlink, char, block, fifo or socket.
+	Type    string    `json:"type"`
+	Mode    string    `json:"mode"`
+	Uid     uint32    `json:"uid"`
+	Gid     uint32    `json:"gid"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Nlink   uint64    `json:"nlink"`
+	// LinkTarget - for symlinks.
+	LinkTarget string `json:"link,omitempty"`
+	// DevMajor and DevMinor - for char and block devices.
+	DevMajor uint32            `json:"dev_major,omitempty"`
+	DevMinor uint32            `json:"dev_minor,omitempty"`
+	Xattrs   map[string]string `json:"xattrs,omitempty"`
+	// Digest - "algorithm:hex" of the content of regular files.
+	Digest string `json:"digest,omitempty"`
+}
+
+// ManifestOptions - options for Manifest.
+type ManifestOptions struct {
+	// Digest - sha256 (the default), sha512, blake2b (blake2b-256) or "none".
+	Digest string
+	// Workers - number of files hashed in parallel, runtime.NumCPU() if 0.
+	Workers int
+}
+
+// Manifest - return a record for every entry under root in sqfs, in walk order
+// (each directory before its content).
+func Manifest(sqfs *SquashFs, root string, opts ManifestOptions) ([]ManifestEntry, error) {
+	if opts.Digest == "" {
+		opts.Digest = "sha256"
+	}
+	if opts.Digest != "none" {
+		if _, err := newManifestHash(opts.Digest); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	root = path.Clean("/" + root)
+
+	entries := []ManifestEntry{}
+	files := []int{}
+	err := sqfs.Walk(root, func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat := info.Sys().(syscall.Stat_t)
+		xattrs, err := info.File.Xattrs()
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+		if rel == "" {
+			rel = "."
+		}
+		ent := ManifestEntry{
+			Path:       rel,
+			Type:       fileType(info.FMode),
+			Mode:       fmt.Sprintf("%#o", unixPerms(info.FMode)),
+			Uid:        stat.Uid,
+			Gid:        stat.Gid,
+			ModTime:    info.FModTime,
+			Nlink:      uint64(stat.Nlink),
+			LinkTarget: info.SymlinkTarget,
+			Xattrs:     xattrs,
+		}
+		switch ent.Type {
+		case "file":
+			ent.Size = info.FSize
+			files = append(files, len(entries))
+		case "char", "block":
+			ent.DevMajor = unix.Major(uint64(stat.Rdev))
+			ent.DevMinor = unix.Minor(uint64(stat.Rdev))
+		}
+		entries = append(entries, ent)
+		return nil
+	})
+	if err != nil || opts.Digest == "none" {
+		return entries, err
+	}
+
+	return entries, hashManifestFiles(sqfs, root, entries, files, opts)
+}
+
+// hashManifestFiles - set the Digest of entries[i] for i in files, using opts.Workers
+// goroutines that each Reopen the image, as readers cannot be shared.
+func hashManifestFiles(sqfs *SquashFs, root string, entries []ManifestEntry, files []int, opts ManifestOptions) error {
+	jobs := make(chan int)
+	errs := make(chan error, opts.Workers)
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			image, err := sqfs.Reopen()
+			if err != nil {
+				errs <- err
+				for range jobs {
+				}
+				return
+			}
+			defer image.Free()
+			for i := range jobs {
+				if err != nil {
+					continue
+				}
+				if entries[i].Digest, err = manifestDigest(&image, path.Join(root, entries[i].Path), opts.Digest); err != nil {
+					err = fmt.Errorf("failed hashing %s: %s", entries[i].Path, err)
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	for _, i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+func manifestDigest(sqfs *SquashFs, p, alg string) (string, error) {
+	h, err := newManifestHash(alg)
+	if err != nil {
+		return "", err
+	}
+	f, err := sqfs.OpenFile(p)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return alg + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func newManifestHash(alg string) (hash.Hash, error) {
+	switch alg {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake2b":
+		return blake2b.New256(nil)
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm '%s'. Needs one of: sha256, sha512, blake2b", alg)
+}
+
+// WriteManifestJSON - write entries to w as JSON lines, one object per entry.
+func WriteManifestJSON(w io.Writer, entries []ManifestEntry) error {
+	enc := json.NewEncoder(w)
+	for _, ent := range entries {
+		if err := enc.Encode(ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mtree keywords for the digests, mtree has none for blake2b.
+var mtreeDigestKeywords = map[string]string{
+	"sha256": "sha256digest",
+	"sha512": "sha512digest",
+}
+
+// mtree names for the entry types.
+var mtreeTypes = map[string]string{
+	"symlink": "link",
+}
+
+// WriteMtree - write entries, in Manifest order, to w as a hierarchical BSD mtree
+// spec as read by go-mtree.  Xattr values are base64 encoded as go-mtree does.
+func WriteMtree(w io.Writer, entries []ManifestEntry) error {
+	lines := []string{"#mtree v2.0"}
+	dirs := []string{}
+
+	indent := func() string {
+		return strings.Repeat("    ", len(dirs))
+	}
+	for _, ent := range entries {
+		parent := path.Dir(ent.Path)
+		for len(dirs) != 0 && ent.Path != "." && dirs[len(dirs)-1] != parent {
+			lines = append(lines, indent()+"..")
+			dirs = dirs[:len(dirs)-1]
+		}
+
+		name := mtreeVis(path.Base(ent.Path))
+		if ent.Path == "." {
+			name = "."
+		}
+		typ := ent.Type
+		if t, ok := mtreeTypes[typ]; ok {
+			typ = t
+		}
+		kws := []string{
+			name,
+			"type=" + typ,
+			"mode=" + ent.Mode,
+			fmt.Sprintf("uid=%d", ent.Uid),
+			fmt.Sprintf("gid=%d", ent.Gid),
+			fmt.Sprintf("nlink=%d", ent.Nlink),
+			fmt.Sprintf("time=%d.%09d", ent.ModTime.Unix(), ent.ModTime.Nanosecond()),
+		}
+		switch ent.Type {
+		case "file":
+			kws = append(kws, fmt.Sprintf("size=%d", ent.Size))
+			if ent.Digest != "" {
+				toks := strings.SplitN(ent.Digest, ":", 2)
+				kw, ok := mtreeDigestKeywords[toks[0]]
+				if !ok {
+					return fmt.Errorf("mtree has no keyword for %s digests", toks[0])
+				}
+				kws = append(kws, kw+"="+toks[1])
+			}
+		case "symlink":
+			kws = append(kws, "link="+mtreeVis(ent.LinkTarget))
+		case "char", "block":
+			kws = append(kws, fmt.Sprintf("device=native,%d,%d", ent.DevMajor, ent.DevMinor))
+		}
+		keys := []string{}
+		for k := range ent.Xattrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			kws = append(kws, "xattr."+mtreeVis(k)+"="+base64.StdEncoding.EncodeToString([]byte(ent.Xattrs[k])))
+		}
+
+		lines = append(lines, indent()+strings.Join(kws, " "))
+		if ent.Type == "dir" && ent.Path != "." {
+			dirs = append(dirs, ent.Path)
+		}
+	}
+	for len(dirs) != 0 {
+		lines = append(lines, indent()+"..")
+		dirs = dirs[:len(dirs)-1]
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// mtreeVis - encode s like vis(3) with VIS_OCTAL|VIS_WHITE|VIS_GLOB, as mtree names are.
+func mtreeVis(s string) string {
+	b := strings.Builder{}
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`\*?[#`, c) != -1 {
+			fmt.Fprintf(&b, "\\%03o", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,267 @@
+package squashfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MultiExtractor - extract a stack of layers into Dir, writing each path once.
+// The result is the same as running an Extractor with WhiteOuts set to
+// WhiteOutOverlay over each layer in order, bottom layer first.
+type MultiExtractor struct {
+	Dir     string
+	Layers  []SquashFs
+	Path    string
+	Owners  bool
+	Perms   bool
+	Devs    bool
+	Sockets bool
+	Logger  Logger
+	Ops     FsOps
+	// Workers - see Extractor.Workers.
+	Workers int
+	// Progress - see Extractor.Progress.
+	Progress func(Progress)
+	// Limits - see Extractor.Limits.
+	Limits Limits
+	// Atomic - see Extractor.Atomic.  What was in Dir is replaced, not merged into.
+	Atomic bool
+	// Conflicts, BackupSuffix - see Extractor.Conflicts.
+	Conflicts    ConflictPolicies
+	BackupSuffix string
+	// ContinueOnError - see Extractor.ContinueOnError.
+	ContinueOnError bool
+	// Sink - see Extractor.Sink.  Whiteouts and opaque dirs only hide entries
+	// of lower layers, there is nothing already in a sink.
+	Sink Sink
+	// Report - filled in by Extract.
+	Report   ExtractReport
+	removals []hiddenPath
+	opaques  []hiddenPath
+	limits   limitState
+}
+
+// hiddenPath - a path in Dir hidden by the whiteout or opaque directory info.
+type hiddenPath struct {
+	path string
+	info FileInfo
+}
+
+// mergeNode - an entry in the merged tree, info is from the layer that wins.
+type mergeNode struct {
+	info     FileInfo
+	children map[string]*mergeNode
+}
+
+func (n *mergeNode) isDir() bool {
+	return n.children != nil
+}
+
+// find - return the node at p below n, or nil if there is none.
+func (n *mergeNode) find(p string) *mergeNode {
+	cur := n
+	for _, part := range strings.Split(strings.Trim(p, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if cur == nil || !cur.isDir() {
+			return nil
+		}
+		cur = cur.children[part]
+	}
+	return cur
+}
+
+// remove - n and what is below it left the merged tree.  Placeholders (no
+// Filename) were never counted.
+func (ls *limitState) remove(n *mergeNode) {
+	if n.info.Filename != "" {
+		ls.entries--
+		if n.info.FMode.IsRegular() {
+			ls.bytes -= n.info.FSize
+		}
+	}
+	for _, child := range n.children {
+		ls.remove(child)
+	}
+}
+
+// walk - call walkFn on n and then on its children in name order.
+func (n *mergeNode) walk(p string, walkFn WalkFunc) error {
+	if err := walkFn(p, n.info, nil); err == SkipDir && n.isDir() {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !n.isDir() {
+		return nil
+	}
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := n.children[name].walk(path.Join(p, name), walkFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extract - merge the layers and write the result to Dir.
+func (m *MultiExtractor) Extract() error {
+	return m.ExtractContext(context.Background())
+}
+
+// ExtractContext - Extract, stopping with ctx.Err() when ctx is cancelled.
+func (m *MultiExtractor) ExtractContext(ctx context.Context) error {
+	if m.Path == "" {
+		m.Path = "/"
+	}
+	root := &mergeNode{children: map[string]*mergeNode{}}
+	m.removals = []hiddenPath{}
+	m.opaques = []hiddenPath{}
+	// the merged tree is checked as it grows, so a stack over the limits is not
+	// held in memory.  The Extractor checks again what it writes.
+	m.limits = limitState{limits: m.Limits}
+
+	// placeholders for the parents of Path, they are not extracted.
+	cur := root
+	for _, part := range strings.Split(strings.Trim(path.Dir(m.Path), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		cur.children[part] = &mergeNode{children: map[string]*mergeNode{}}
+		cur = cur.children[part]
+	}
+
+	for i := range m.Layers {
+		m.Logger.Debug("merging layer %d (%s)", i, m.Layers[i].Filename)
+		if err := m.Layers[i].Walk(m.Path, func(p string, info FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if err := ctx.Err(); err != nil {
+				return err
+			}
+			return m.merge(root, p, info)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// whiteouts and opaque dirs also hide what was in Dir before extraction.
+	// With Atomic, Dir is replaced as a whole, so there is nothing to hide.
+	if m.Atomic || m.Sink != nil {
+		m.removals, m.opaques = nil, nil
+	}
+	e := Extractor{
+		Dir:             m.Dir,
+		Path:            m.Path,
+		WhiteOuts:       WhiteOutSkip,
+		Owners:          m.Owners,
+		Perms:           m.Perms,
+		Devs:            m.Devs,
+		Sockets:         m.Sockets,
+		Logger:          m.Logger,
+		Ops:             m.Ops,
+		Workers:         m.Workers,
+		Progress:        m.Progress,
+		Limits:          m.Limits,
+		Atomic:          m.Atomic,
+		Conflicts:       m.Conflicts,
+		BackupSuffix:    m.BackupSuffix,
+		ContinueOnError: m.ContinueOnError,
+		Sink:            m.Sink,
+	}
+
+	start := root.find(m.Path)
+	if start == nil {
+		return os.ErrNotExist
+	}
+	// applied once run holds the lock of Dir.
+	e.prepare = func() error {
+		e.setOps()
+		for _, h := range m.removals {
+			if err := e.applyWhiteOut(h.path, h.info); err != nil && err != errKeepExisting {
+				return err
+			}
+		}
+
+		for _, h := range m.opaques {
+			if fi, err := e.view().Lstat(filepath.Join(m.Dir, h.path)); err == nil && fi.IsDir() {
+				if err := e.applyOpaque(h.path, h.info); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := e.run(ctx, func(walkFn WalkFunc) error {
+		return start.walk(m.Path, walkFn)
+	})
+	m.Report = e.Report
+	return err
+}
+
+// merge - apply the entry p of a layer to the merged tree below root.
+func (m *MultiExtractor) merge(root *mergeNode, p string, info FileInfo) error {
+	if whiteOut := getWhiteOut(info); whiteOut != "" {
+		m.Logger.Debug("white-out %s hides %s", p, whiteOut)
+		if parent := root.find(path.Dir(whiteOut)); parent != nil && parent.isDir() {
+			if old := parent.children[path.Base(whiteOut)]; old != nil {
+				m.limits.remove(old)
+				delete(parent.children, path.Base(whiteOut))
+			}
+		}
+		m.removals = append(m.removals, hiddenPath{whiteOut, info})
+		return nil
+	}
+
+	if info.Name() == OpaqueMarker {
+		return nil
+	}
+
+	mode := info.FMode
+	if mode&os.ModeSocket != 0 && !m.Sockets {
+		return nil
+	}
+	if mode&(os.ModeDevice|os.ModeCharDevice) != 0 && !m.Devs {
+		return nil
+	}
+
+	node := &mergeNode{info: info}
+	if info.IsDir() {
+		if IsOpaque(info) {
+			m.opaques = append(m.opaques, hiddenPath{p, info})
+			node.children = map[string]*mergeNode{}
+		} else if old := root.find(p); old != nil && old.isDir() {
+			// directories merge: children stay, metadata comes from this layer.
+			old.info = info
+			return nil
+		} else {
+			node.children = map[string]*mergeNode{}
+		}
+	}
+
+	if p == "/" {
+		m.limits.remove(root)
+		*root = *node
+		return m.limits.check(p, info)
+	}
+
+	parent := root.find(path.Dir(p))
+	if parent == nil || !parent.isDir() {
+		// a parent that is not a directory wins over anything below it.
+		return nil
+	}
+	if old := parent.children[path.Base(p)]; old != nil {
+		m.limits.remove(old)
+	}
+	parent.children[path.Base(p)] = node
+	return m.limits.check(p, info)
+}
@@ -0,0 +1,232 @@
+package squashfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var testModTime = time.Unix(1600000000, 0)
+
+// testEntry - an entry of a test image, content is the data of regular files.
+type testEntry struct {
+	TreeEntry
+	content string
+}
+
+func tdir(p string, xattrs ...string) testEntry {
+	ent := testEntry{TreeEntry: TreeEntry{Path: p, Mode: os.ModeDir | 0755, Xattrs: map[string]string{}}}
+	for i := 0; i+1 < len(xattrs); i += 2 {
+		ent.Xattrs[xattrs[i]] = xattrs[i+1]
+	}
+	return ent
+}
+
+func tfile(p, content string) testEntry {
+	return testEntry{TreeEntry: TreeEntry{Path: p, Mode: 0644, Size: int64(len(content))}, content: content}
+}
+
+func tsymlink(p, target string) testEntry {
+	return testEntry{TreeEntry: TreeEntry{Path: p, Mode: os.ModeSymlink | 0777, LinkTarget: target}}
+}
+
+func tchar(p string, major, minor uint32) testEntry {
+	return testEntry{TreeEntry: TreeEntry{Path: p, Mode: os.ModeCharDevice | 0644, Rdev: unix.Mkdev(major, minor)}}
+}
+
+func tsocket(p string) testEntry {
+	return testEntry{TreeEntry: TreeEntry{Path: p, Mode: os.ModeSocket | 0755}}
+}
+
+// writeTestImage - write ents, parents first, to the image fname and open it.
+func writeTestImage(t *testing.T, fname string, ents []testEntry) SquashFs {
+	t.Helper()
+	w, err := NewWriter(fname, WriterOptions{})
+	if err != nil {
+		t.Fatalf("NewWriter(%s): %s", fname, err)
+	}
+	for _, ent := range ents {
+		ent.ModTime = testModTime
+		if err := w.Add(ent.TreeEntry, strings.NewReader(ent.content)); err != nil {
+			w.Discard()
+			t.Fatalf("Add(%s): %s", ent.Path, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(%s): %s", fname, err)
+	}
+	sqfs, err := OpenSquashfs(fname)
+	if err != nil {
+		t.Fatalf("OpenSquashfs(%s): %s", fname, err)
+	}
+	return sqfs
+}
+
+// tempDir - return a new temporary directory, removed when the test is done.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	d, err := ioutil.TempDir("", "squashfs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { removeTree(d) })
+	return d
+}
+
+// testLayers - a stack of layers with whiteouts (0/0 char devices and .wh.
+// files), opaque directories (xattr and marker), entries that change type
+// between layers, devices and sockets.
+func testLayers(t *testing.T, d string) []SquashFs {
+	base := writeTestImage(t, filepath.Join(d, "base.squashfs"), []testEntry{
+		tdir("/"),
+		tdir("/data"),
+		tfile("/data/inner", "inner"),
+		tdir("/dev"),
+		tchar("/dev/null", 1, 3),
+		tdir("/etc"),
+		tfile("/etc/old", "old"),
+		tfile("/etc/passwd", "root"),
+		tfile("/file-to-dir", "file"),
+		tdir("/opt"),
+		tfile("/opt/a", "a"),
+		tdir("/opt/sub"),
+		tfile("/opt/sub/b", "b"),
+		tdir("/run"),
+		tsocket("/run/sock"),
+		tdir("/var"),
+		tfile("/var/x", "x"),
+	})
+	mid := writeTestImage(t, filepath.Join(d, "mid.squashfs"), []testEntry{
+		tdir("/"),
+		tsymlink("/data", "etc"),
+		tdir("/dev"),
+		tchar("/dev/zero", 1, 5),
+		tdir("/etc"),
+		tfile("/etc/new", "new"),
+		tchar("/etc/old", 0, 0),
+		tdir("/file-to-dir"),
+		tfile("/file-to-dir/inner", "inner"),
+		tdir("/opt", OpaqueXattr, "y"),
+		tfile("/opt/c", "c"),
+		tdir("/run"),
+		tfile("/run/.wh.sock", ""),
+		tdir("/var"),
+		tfile("/var/"+OpaqueMarker, ""),
+		tfile("/var/y", "y"),
+	})
+	top := writeTestImage(t, filepath.Join(d, "top.squashfs"), []testEntry{
+		tdir("/"),
+		tdir("/etc"),
+		tfile("/etc/"+WhiteOutPrefix+"new", ""),
+		tchar("/file-to-dir", 0, 0),
+		tdir("/opt"),
+		tdir("/opt/sub"),
+		tfile("/opt/sub/d", "d"),
+		tdir("/run"),
+		tsocket("/run/sock2"),
+	})
+	return []SquashFs{base, mid, top}
+}
+
+// treePaths - return the sorted paths of the directory tree dir.
+func treePaths(t *testing.T, dir string) []string {
+	t.Helper()
+	ents, err := DirTree(dir).Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sortedPaths(ents)
+}
+
+func TestMultiExtractorMatchesSequential(t *testing.T) {
+	d := tempDir(t)
+	layers := testLayers(t, d)
+
+	for _, tc := range []struct {
+		name    string
+		devs    bool
+		sockets bool
+		want    []string
+	}{
+		{"plain", false, false, []string{"/", "/data", "/dev", "/etc", "/etc/passwd",
+			"/opt", "/opt/c", "/opt/sub", "/opt/sub/d", "/run", "/var", "/var/y"}},
+		{"sockets", false, true, []string{"/", "/data", "/dev", "/etc", "/etc/passwd",
+			"/opt", "/opt/c", "/opt/sub", "/opt/sub/d", "/run", "/run/sock2", "/var", "/var/y"}},
+		{"devs", true, true, []string{"/", "/data", "/dev", "/dev/null", "/dev/zero", "/etc", "/etc/passwd",
+			"/opt", "/opt/c", "/opt/sub", "/opt/sub/d", "/run", "/run/sock2", "/var", "/var/y"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.devs && os.Getuid() != 0 {
+				t.Skip("creating devices needs root")
+			}
+			seqDir := filepath.Join(d, tc.name+"-seq")
+			multiDir := filepath.Join(d, tc.name+"-multi")
+			for _, dir := range []string{seqDir, multiDir} {
+				if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := range layers {
+				e := Extractor{Dir: seqDir, SquashFs: layers[i], Path: "/", WhiteOuts: WhiteOutOverlay,
+					Devs: tc.devs, Sockets: tc.sockets, Logger: PrintfLogger{}}
+				if err := e.Extract(); err != nil {
+					t.Fatalf("sequential extract of layer %d: %s", i, err)
+				}
+			}
+
+			m := MultiExtractor{Dir: multiDir, Layers: layers, Devs: tc.devs, Sockets: tc.sockets,
+				Logger: PrintfLogger{}}
+			if err := m.Extract(); err != nil {
+				t.Fatalf("multi extract: %s", err)
+			}
+
+			changes, err := Compare(DirTree(seqDir), DirTree(multiDir), CompareOptions{IgnoreMtime: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != 0 {
+				t.Errorf("multi extraction differs from sequential: %v", changes)
+			}
+
+			got := treePaths(t, multiDir)
+			sort.Strings(tc.want)
+			if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+				t.Errorf("extracted %v, want %v", got, tc.want)
+			}
+			if fi, err := os.Lstat(filepath.Join(multiDir, "data")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("/data should be the symlink of the middle layer: %v %v", fi, err)
+			}
+		})
+	}
+}
+
+func TestMultiExtractorLimitsWhileMerging(t *testing.T) {
+	d := tempDir(t)
+	layers := testLayers(t, d)
+
+	dir := filepath.Join(d, "out")
+	if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+		t.Fatal(err)
+	}
+	// the base layer alone has 15 entries that are extracted.
+	m := MultiExtractor{Dir: dir, Layers: layers, Limits: Limits{Entries: 14}, Logger: PrintfLogger{}}
+	err := m.Extract()
+	if le, ok := err.(*LimitError); !ok || le.Limit != "entries" {
+		t.Fatalf("expected an entries LimitError, got %v", err)
+	}
+	if got := treePaths(t, dir); len(got) != 1 {
+		t.Errorf("wrote %v before the limit was hit", got)
+	}
+
+	m.Limits.Entries = 15
+	if err := m.Extract(); err != nil {
+		t.Errorf("merged tree is within the limit: %s", err)
+	}
+}
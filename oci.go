@@ -0,0 +1,207 @@
+package squashfs
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MediaTypeLayerSquashfs - media type of squashfs layers, as written by stacker.
+// Variants such as "+zstd" or "+verity" are accepted as well.
+const MediaTypeLayerSquashfs = "application/vnd.stacker.image.layer.squashfs"
+
+const (
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// OCIOptions - how UnpackOCI extracts the layers, see Extractor.
+type OCIOptions struct {
+	Owners  bool
+	Perms   bool
+	Devs    bool
+	Sockets bool
+	Logger  Logger
+	Ops     FsOps
+	// Workers - see MultiExtractor.Workers.
+	Workers int
+	// Limits - see MultiExtractor.Limits.  Images pulled from elsewhere are not
+	// trusted, they should be set.
+	Limits Limits
+}
+
+// UnpackOCI - extract the image tagged tag in the OCI layout at layoutDir into destDir.
+// Every blob is checked against its digest, and the squashfs layers are applied
+// bottom first with their whiteouts.
+func UnpackOCI(layoutDir, tag, destDir string, opts OCIOptions) error {
+	if opts.Logger == nil {
+		opts.Logger = PrintfLogger{}
+	}
+
+	desc, err := ociFindManifest(layoutDir, tag)
+	if err != nil {
+		return err
+	}
+
+	manifest := ociManifest{}
+	if err := ociReadJSONBlob(layoutDir, desc, &manifest); err != nil {
+		return err
+	}
+
+	layers := []SquashFs{}
+	for _, layer := range manifest.Layers {
+		if !strings.HasPrefix(layer.MediaType, MediaTypeLayerSquashfs) {
+			return fmt.Errorf("layer %s has media type %s: only %s layers are supported",
+				layer.Digest, layer.MediaType, MediaTypeLayerSquashfs)
+		}
+		blob, _, err := ociBlobPath(layoutDir, layer.Digest)
+		if err != nil {
+			return err
+		}
+		// read through the descriptor that was hashed, the blob may be replaced.
+		s, err := OpenVerified(blob, layer.Digest, DigestFullFile)
+		if err != nil {
+			return fmt.Errorf("failed to open layer %s: %s", layer.Digest, err)
+		}
+		defer s.Free()
+		if fi, err := s.verified.Stat(); err != nil {
+			return err
+		} else if fi.Size() != layer.Size {
+			return fmt.Errorf("blob %s is %d bytes, expected %d", layer.Digest, fi.Size(), layer.Size)
+		}
+		layers = append(layers, s)
+	}
+
+	if err := os.Mkdir(destDir, DefaultDirPerm); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	opts.Logger.Info("Unpacking %s:%s (%d layers) to %s", layoutDir, tag, len(layers), destDir)
+	m := MultiExtractor{
+		Dir:     destDir,
+		Layers:  layers,
+		Owners:  opts.Owners,
+		Perms:   opts.Perms,
+		Devs:    opts.Devs,
+		Sockets: opts.Sockets,
+		Logger:  opts.Logger,
+		Ops:     opts.Ops,
+		Workers: opts.Workers,
+		Limits:  opts.Limits,
+	}
+	return m.Extract()
+}
+
+// ociFindManifest - return the descriptor in index.json for tag.
+// An empty tag is allowed when the index has a single manifest.
+func ociFindManifest(layoutDir, tag string) (ociDescriptor, error) {
+	if _, err := os.Stat(filepath.Join(layoutDir, "oci-layout")); err != nil {
+		return ociDescriptor{}, fmt.Errorf("%s is not an OCI layout: %s", layoutDir, err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	index := ociIndex{}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return ociDescriptor{}, fmt.Errorf("failed to parse %s/index.json: %s", layoutDir, err)
+	}
+
+	found := []ociDescriptor{}
+	for _, desc := range index.Manifests {
+		if tag == "" || desc.Annotations[ociRefNameAnnotation] == tag {
+			found = append(found, desc)
+		}
+	}
+
+	if len(found) == 0 {
+		return ociDescriptor{}, fmt.Errorf("no manifest for tag '%s' in %s", tag, layoutDir)
+	} else if len(found) > 1 {
+		return ociDescriptor{}, fmt.Errorf("%d manifests for tag '%s' in %s", len(found), tag, layoutDir)
+	}
+
+	if found[0].MediaType != ociMediaTypeManifest {
+		return ociDescriptor{}, fmt.Errorf("tag '%s' is a %s, expected %s",
+			tag, found[0].MediaType, ociMediaTypeManifest)
+	}
+
+	return found[0], nil
+}
+
+// ociBlobPath - return the path of the blob for digest ("algorithm:hex").
+func ociBlobPath(layoutDir, digest string) (string, hash.Hash, error) {
+	alg, value, h, err := parseDigest(digest)
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Join(layoutDir, "blobs", alg, value), h, nil
+}
+
+// ociVerifyBlob - check the blob for desc against its size and digest and return its path.
+func ociVerifyBlob(layoutDir string, desc ociDescriptor) (string, error) {
+	blob, h, err := ociBlobPath(layoutDir, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	fp, err := os.Open(blob)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	size, err := io.Copy(h, fp)
+	if err != nil {
+		return "", fmt.Errorf("failed reading %s: %s", blob, err)
+	}
+	if size != desc.Size {
+		return "", fmt.Errorf("blob %s is %d bytes, expected %d", desc.Digest, size, desc.Size)
+	}
+	if found := hex.EncodeToString(h.Sum(nil)); !strings.HasSuffix(desc.Digest, ":"+found) {
+		return "", fmt.Errorf("blob %s has digest %s", desc.Digest, found)
+	}
+
+	return blob, nil
+}
+
+// ociReadJSONBlob - verify the blob for desc and unmarshal it into v.
+func ociReadJSONBlob(layoutDir string, desc ociDescriptor, v interface{}) error {
+	blob, err := ociVerifyBlob(layoutDir, desc)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(blob)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %s", desc.Digest, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package squashfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestBlob - add content to the blobs of the layout, return its descriptor.
+func writeTestBlob(t *testing.T, layout, mediaType string, content []byte) ociDescriptor {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	desc := ociDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	blob, _, err := ociBlobPath(layout, desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), DefaultDirPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blob, content, DefaultFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// writeTestLayout - an OCI layout with the image tag made of layers.
+func writeTestLayout(t *testing.T, layout, tag string, layers []SquashFs) ociManifest {
+	t.Helper()
+	if err := os.MkdirAll(layout, DefaultDirPerm); err != nil {
+		t.Fatal(err)
+	}
+	manifest := ociManifest{SchemaVersion: 2, MediaType: ociMediaTypeManifest}
+	manifest.Config = writeTestBlob(t, layout, "application/vnd.oci.image.config.v1+json", []byte("{}"))
+	for _, layer := range layers {
+		content, err := ioutil.ReadFile(layer.Filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Layers = append(manifest.Layers, writeTestBlob(t, layout, MediaTypeLayerSquashfs, content))
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := writeTestBlob(t, layout, ociMediaTypeManifest, content)
+	desc.Annotations = map[string]string{ociRefNameAnnotation: tag}
+	index, err := json.Marshal(ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{desc}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(layout, "index.json"), index, DefaultFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		DefaultFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestUnpackOCI(t *testing.T) {
+	d := tempDir(t)
+	layers := testLayers(t, d)
+	for i := range layers {
+		defer layers[i].Free()
+	}
+	layout := filepath.Join(d, "layout")
+	manifest := writeTestLayout(t, layout, "latest", layers)
+
+	dir := filepath.Join(d, "out")
+	if err := UnpackOCI(layout, "latest", dir, OCIOptions{Workers: 4, Logger: PrintfLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/", "/data", "/dev", "/etc", "/etc/passwd",
+		"/opt", "/opt/c", "/opt/sub", "/opt/sub/d", "/run", "/var", "/var/y"}
+	if got := treePaths(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("unpacked %v, want %v", got, want)
+	}
+
+	limited := filepath.Join(d, "limited")
+	err := UnpackOCI(layout, "latest", limited, OCIOptions{Limits: Limits{Entries: 5}, Logger: PrintfLogger{}})
+	if le, ok := err.(*LimitError); !ok || le.Limit != "entries" {
+		t.Errorf("expected an entries LimitError, got %v", err)
+	}
+
+	// a layer that does not match its digest is not extracted.
+	blob, _, err := ociBlobPath(layout, manifest.Layers[2].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(layers[0].Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blob, content, DefaultFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	err = UnpackOCI(layout, "latest", filepath.Join(d, "tampered"), OCIOptions{Logger: PrintfLogger{}})
+	if err == nil || !strings.Contains(err.Error(), manifest.Layers[2].Digest) {
+		t.Errorf("expected the tampered layer to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package squashfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxSymlinks - how many symlinks Overlay.Stat follows before giving up.
+const maxSymlinks = 40
+
+// Overlay - read-only merged view of a stack of squashfs layers.
+// Layers are ordered bottom first, as they would be extracted. Whiteouts and
+// opaque directories in a layer hide the content of the layers below it.
+type Overlay struct {
+	Layers []SquashFs
+}
+
+// OverlayFile - a file in an Overlay.  Reads come from the layer that provides
+// the file, directory listings are merged across layers.
+type OverlayFile struct {
+	*File
+	Overlay *Overlay
+	names   []string
+	namePos int
+}
+
+// OpenFile - open name in the merged view.
+func (o *Overlay) OpenFile(name string) (*OverlayFile, error) {
+	info, err := o.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &OverlayFile{File: info.File, Overlay: o}, nil
+}
+
+// Lstat - os.Lstat - if name is a symlink, info is about the link not the target.
+func (o *Overlay) Lstat(name string) (FileInfo, error) {
+	name = overlayPath(name)
+	if strings.HasPrefix(path.Base(name), WhiteOutPrefix) {
+		// whiteouts and markers are never visible in the merged view.
+		return FileInfo{}, os.ErrNotExist
+	}
+
+	for i := len(o.Layers) - 1; i >= 0; i-- {
+		sqfs := &o.Layers[i]
+		info, err := sqfs.Lstat(name)
+		if err == nil {
+			if getWhiteOut(info) == name {
+				return FileInfo{}, os.ErrNotExist
+			}
+			info.Filename = name
+			info.File.Filename = name
+			return info, nil
+		}
+		if hidesLower(sqfs, name) {
+			break
+		}
+	}
+
+	return FileInfo{}, os.ErrNotExist
+}
+
+// Stat - os.Stat - if name is a symlink, tell about the target.
+func (o *Overlay) Stat(name string) (FileInfo, error) {
+	name = overlayPath(name)
+	for i := 0; i < maxSymlinks; i++ {
+		info, err := o.Lstat(name)
+		if err != nil || info.FMode&os.ModeSymlink == 0 {
+			return info, err
+		}
+		target := info.SymlinkTarget
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(name), target)
+		}
+		name = overlayPath(target)
+	}
+	return FileInfo{}, fmt.Errorf("too many levels of symbolic links in %s", name)
+}
+
+// Walk - mimics filepath.Walk over the merged view.
+func (o *Overlay) Walk(root string, walkFn WalkFunc) error {
+	info, err := o.Lstat(root)
+	if err != nil {
+		err = walkFn(root, FileInfo{Filename: root}, err)
+	} else {
+		err = walk(o, root, info, walkFn)
+	}
+	if err == SkipDir {
+		return nil
+	}
+	return err
+}
+
+// Readdirnames - return the sorted, merged names in directory name.
+func (o *Overlay) Readdirnames(name string) ([]string, error) {
+	name = overlayPath(name)
+	seen := map[string]bool{}
+	names := []string{}
+	found := false
+
+	for i := len(o.Layers) - 1; i >= 0; i-- {
+		sqfs := &o.Layers[i]
+		info, err := sqfs.Lstat(name)
+		if err != nil {
+			if hidesLower(sqfs, name) {
+				break
+			}
+			continue
+		}
+		if !info.IsDir() {
+			// a file or whiteout here hides any lower directory.
+			break
+		}
+		found = true
+
+		layerNames, err := info.File.Readdirnames(0)
+		if err != nil {
+			return names, err
+		}
+		for _, n := range layerNames {
+			if seen[n] || n == OpaqueMarker {
+				continue
+			}
+			seen[n] = true
+			if strings.HasPrefix(n, WhiteOutPrefix) {
+				seen[strings.TrimPrefix(n, WhiteOutPrefix)] = true
+				continue
+			}
+			entInfo, err := sqfs.Lstat(path.Join(name, n))
+			if err != nil {
+				return names, err
+			}
+			if getWhiteOut(entInfo) != "" {
+				continue
+			}
+			names = append(names, n)
+		}
+
+		if IsOpaque(info) {
+			break
+		}
+	}
+
+	if !found {
+		return names, os.ErrNotExist
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Readdir - return os.FileInfo (Lstat) for each merged entry in directory name.
+func (o *Overlay) Readdir(name string) ([]os.FileInfo, error) {
+	infos := []os.FileInfo{}
+	names, err := o.Readdirnames(name)
+	if err != nil {
+		return infos, err
+	}
+	for _, n := range names {
+		info, err := o.Lstat(path.Join(overlayPath(name), n))
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (o *Overlay) readDirNames(info FileInfo) ([]string, error) {
+	return o.Readdirnames(info.Filename)
+}
+
+// Readdirnames - os.File.Readdirnames over the merged directory.
+func (f *OverlayFile) Readdirnames(n int) ([]string, error) {
+	if f.names == nil {
+		names, err := f.Overlay.Readdirnames(f.Filename)
+		if err != nil {
+			return []string{}, err
+		}
+		f.names = names
+	}
+
+	rest := f.names[f.namePos:]
+	if n <= 0 {
+		f.namePos = len(f.names)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return rest, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	f.namePos += n
+	return rest[:n], nil
+}
+
+// Readdir - os.File.Readdir over the merged directory.
+func (f *OverlayFile) Readdir(n int) ([]os.FileInfo, error) {
+	infos := []os.FileInfo{}
+	names, rdErr := f.Readdirnames(n)
+	for _, name := range names {
+		info, err := f.Overlay.Lstat(path.Join(f.Filename, name))
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, rdErr
+}
+
+// Stat - os.File.Stat - if file is a symlink, tell about the target.
+func (f *OverlayFile) Stat() (FileInfo, error) {
+	return f.Overlay.Stat(f.Filename)
+}
+
+// hidesLower - return true if sqfs, which does not have name, hides name in the layers below it.
+// That is the case if name or one of its parents is whited-out, or a parent is
+// opaque or not a directory.
+func hidesLower(sqfs *SquashFs, name string) bool {
+	cur := "/"
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			break
+		}
+		if _, err := sqfs.Lstat(path.Join(cur, WhiteOutPrefix+part)); err == nil {
+			return true
+		}
+		info, err := sqfs.Lstat(cur)
+		if err != nil {
+			return false
+		}
+		if !info.IsDir() || IsOpaque(info) {
+			return true
+		}
+		cur = path.Join(cur, part)
+		if cur == name {
+			break
+		}
+	}
+	return false
+}
+
+// overlayPath - return name as a clean absolute path.
+func overlayPath(name string) string {
+	return filepath.ToSlash(path.Clean("/" + name))
+}
+
+// Open - fs.FS.Open, so an Overlay can be used with io/fs helpers.
+func (o *Overlay) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := o.OpenFile(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return overlayFsFile{f}, nil
+}
+
+// overlayFsFile - adapts OverlayFile to fs.File and fs.ReadDirFile.
+type overlayFsFile struct {
+	f *OverlayFile
+}
+
+func (f overlayFsFile) Stat() (fs.FileInfo, error) {
+	info, err := f.f.Lstat()
+	if err == nil && info.Filename == "/" {
+		return overlayRootInfo{info}, nil
+	}
+	return info, err
+}
+
+func (f overlayFsFile) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return f.f.Read(b)
+}
+
+func (f overlayFsFile) Close() error {
+	// File.Close frees the inode but always reports ErrNotImplemented.
+	f.f.Close()
+	return nil
+}
+
+func (f overlayFsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := f.f.Readdir(n)
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, err
+}
+
+// overlayRootInfo - the root directory is named "." in an fs.FS.
+type overlayRootInfo struct {
+	FileInfo
+}
+
+func (overlayRootInfo) Name() string { return "." }
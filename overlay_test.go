@@ -0,0 +1,80 @@
+package squashfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// testOverlayLayers - layers of directories and files only, with a whiteout
+// file, a whiteout char device and an opaque directory.
+func testOverlayLayers(t *testing.T, d string) []SquashFs {
+	base := writeTestImage(t, filepath.Join(d, "base.squashfs"), []testEntry{
+		tdir("/"),
+		tdir("/etc"),
+		tfile("/etc/gone", "gone"),
+		tfile("/etc/passwd", "root"),
+		tdir("/opt"),
+		tfile("/opt/hidden", "hidden"),
+		tfile("/removed", "removed"),
+	})
+	top := writeTestImage(t, filepath.Join(d, "top.squashfs"), []testEntry{
+		tdir("/"),
+		tdir("/etc"),
+		tfile("/etc/"+WhiteOutPrefix+"gone", ""),
+		tfile("/etc/passwd", "root:x:0:0"),
+		tdir("/opt", OpaqueXattr, "y"),
+		tfile("/opt/new", "new"),
+		tchar("/removed", 0, 0),
+	})
+	return []SquashFs{base, top}
+}
+
+func TestOverlayFS(t *testing.T) {
+	d := tempDir(t)
+	layers := testOverlayLayers(t, d)
+	for i := range layers {
+		defer layers[i].Free()
+	}
+	o := &Overlay{Layers: layers}
+
+	if err := fstest.TestFS(o, "etc/passwd", "opt/new"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fs.ReadFile(o, "etc/passwd")
+	if err != nil || string(data) != "root:x:0:0" {
+		t.Errorf("etc/passwd should come from the top layer: %q %v", data, err)
+	}
+	for _, name := range []string{"etc/gone", "opt/hidden", "removed", "etc/" + WhiteOutPrefix + "gone"} {
+		if _, err := o.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s should be hidden, got %v", name, err)
+		}
+	}
+}
+
+func TestOverlayOpenKeepsError(t *testing.T) {
+	d := tempDir(t)
+	layers := testOverlayLayers(t, d)
+	for i := range layers {
+		defer layers[i].Free()
+	}
+	o := &Overlay{Layers: layers}
+
+	_, err := o.Open("missing")
+	var pe *fs.PathError
+	if !errors.As(err, &pe) || pe.Err != os.ErrNotExist {
+		t.Errorf("expected a PathError with the Lstat error, got %#v", err)
+	}
+	if _, err := o.Open("/etc"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for an absolute name, got %v", err)
+	}
+
+	info, err := fs.Stat(o, ".")
+	if err != nil || info.Name() != "." || !info.IsDir() {
+		t.Errorf("root should be the directory \".\": %v %v", info, err)
+	}
+}
@@ -0,0 +1,142 @@
+package squashfs
+
+import (
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// extractPool - writes regular files for an Extractor with Workers goroutines.
+// Each worker reopens the images on its own, as libsquashfs readers cannot be shared.
+type extractPool struct {
+	jobs  chan fileJob
+	wg    sync.WaitGroup
+	mutex sync.Mutex
+	err   error
+}
+
+type fileJob struct {
+	path string
+	info FileInfo
+}
+
+func newExtractPool(e *Extractor) *extractPool {
+	p := &extractPool{jobs: make(chan fileJob, e.Workers)}
+	for i := 0; i < e.Workers; i++ {
+		p.wg.Add(1)
+		go p.work(e)
+	}
+	return p
+}
+
+// submit - queue path for extraction.  Returns the first error a worker hit, if any,
+// so the walk stops.
+func (p *extractPool) submit(path string, info FileInfo) error {
+	if err := p.failed(); err != nil {
+		return err
+	}
+	p.jobs <- fileJob{path, info}
+	return nil
+}
+
+// wait - wait for all queued files to be written, return the first error.
+func (p *extractPool) wait() error {
+	close(p.jobs)
+	p.wg.Wait()
+	return p.err
+}
+
+func (p *extractPool) failed() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.err
+}
+
+func (p *extractPool) fail(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *extractPool) work(e *Extractor) {
+	defer p.wg.Done()
+	images := map[*SquashFs]*SquashFs{}
+	defer func() {
+		for _, image := range images {
+			image.Free()
+		}
+	}()
+	for job := range p.jobs {
+		if p.failed() != nil {
+			continue
+		}
+		if err := e.ctx.Err(); err != nil {
+			p.fail(err)
+			continue
+		}
+		if err := p.extract(e, images, job); err != nil && !e.recordError(err) {
+			p.fail(err)
+			continue
+		}
+		e.progress.done(job.path)
+	}
+}
+
+func (p *extractPool) extract(e *Extractor, images map[*SquashFs]*SquashFs, job fileJob) error {
+	// the File may be from any layer (MultiExtractor), open it again in that image,
+	// through its verified descriptor if it has one.
+	src := job.info.File.SquashFs
+	image, ok := images[src]
+	if !ok {
+		sqfs, err := src.Reopen()
+		if err != nil {
+			return e.entryError(job.path, "read", err)
+		}
+		image = &sqfs
+		images[src] = image
+	}
+
+	f, err := image.OpenFile(job.info.File.Filename)
+	if err != nil {
+		return e.entryError(job.path, "read", err)
+	}
+	info := job.info
+	info.File = f
+
+	if err := e.extractRegular(job.path, info); err == errKeepExisting {
+		e.recordSkip(job.path, "kept existing entry")
+		return nil
+	} else if err != nil {
+		return e.entryError(job.path, "write", err)
+	}
+	if err := e.finish(job.path, info, false); err != nil {
+		return err
+	}
+	e.recordDone(info)
+	return nil
+}
+
+// keepWritable - make the existing directory path writable until the cleanups run,
+// so workers do not have to change its permissions while others write there too.
+func (e *Extractor) keepWritable(path string) error {
+	fpath := filepath.Join(e.Dir, path)
+	if e.view().Access(fpath, unix.W_OK|unix.X_OK) == nil {
+		return nil
+	}
+	finfo, err := e.view().Stat(fpath)
+	if err != nil {
+		return err
+	}
+	oldMode := finfo.Mode()
+	if err := e.Ops.Chmod(fpath, OpenDirPerm); err != nil {
+		return err
+	}
+	e.cleanups = append(e.cleanups, func() error {
+		e.Logger.Debug("fixing %s back to %04o", path, oldMode.Perm())
+		return e.Ops.Chmod(fpath, oldMode)
+	})
+	return nil
+}
@@ -0,0 +1,68 @@
+package squashfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParallelMatchesSerial(t *testing.T) {
+	d := tempDir(t)
+	fname := filepath.Join(d, "image.squashfs")
+	ents := []testEntry{tdir("/")}
+	for i := 0; i < 8; i++ {
+		dir := fmt.Sprintf("/d%d", i)
+		ents = append(ents, tdir(dir))
+		for j := 0; j < 16; j++ {
+			ents = append(ents, tfile(fmt.Sprintf("%s/f%02d", dir, j), strings.Repeat(dir, 1000*j)))
+		}
+		ents = append(ents, tsymlink(dir+"/link", "f00"))
+	}
+	sqfs := writeTestImage(t, fname, ents)
+	sqfs.Free()
+
+	// the workers reopen the image through the verified descriptor.
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	sqfs, err = OpenVerified(fname, "sha256:"+hex.EncodeToString(sum[:]), DigestFullFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqfs.Free()
+
+	dirs := map[int]string{}
+	for _, workers := range []int{0, 4} {
+		dirs[workers] = filepath.Join(d, fmt.Sprintf("workers-%d", workers))
+		if err := os.Mkdir(dirs[workers], DefaultDirPerm); err != nil {
+			t.Fatal(err)
+		}
+		e := Extractor{Dir: dirs[workers], SquashFs: sqfs, Path: "/", Workers: workers, Logger: PrintfLogger{}}
+		if err := e.Extract(); err != nil {
+			t.Fatalf("extract with %d workers: %s", workers, err)
+		}
+	}
+
+	changes, err := Compare(DirTree(dirs[0]), DirTree(dirs[4]), CompareOptions{IgnoreMtime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("parallel extraction differs from serial: %v", changes)
+	}
+	if changes, err = CompareDir(&sqfs, dirs[4], CheckOptions{}); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Errorf("parallel extraction differs from the image: %v", changes)
+	}
+	if got := len(treePaths(t, dirs[4])); got != len(ents) {
+		t.Errorf("extracted %d entries, want %d", got, len(ents))
+	}
+}
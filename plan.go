@@ -0,0 +1,423 @@
+package squashfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// FsView - the lookups an Extractor makes in Dir.  If its FsOps also implement
+// FsView, the Extractor looks through them, so FsOps that do not change the
+// filesystem can still show their changes.
+type FsView interface {
+	Stat(string) (os.FileInfo, error)
+	Lstat(string) (os.FileInfo, error)
+	Access(path string, mode uint32) error
+	ReadDirNames(string) ([]string, error)
+}
+
+// osView - FsView of the filesystem itself.
+type osView struct{}
+
+func (osView) Stat(path string) (os.FileInfo, error)  { return os.Stat(path) }
+func (osView) Lstat(path string) (os.FileInfo, error) { return os.Lstat(path) }
+func (osView) Access(path string, mode uint32) error  { return unix.Access(path, mode) }
+func (osView) ReadDirNames(path string) ([]string, error) {
+	return dirNames(path)
+}
+
+// view - the FsView e looks up Dir through.
+func (e *Extractor) view() FsView {
+	if v, ok := e.Ops.(FsView); ok {
+		return v
+	}
+	return osView{}
+}
+
+// PlanStep - one change to the filesystem in a plan.
+type PlanStep struct {
+	// Op - mkdir, create, symlink, link, rename, remove, remove-all, mkfifo,
+	// mknod, socket, chmod, chown, utimes or setxattr.
+	Op string `json:"op"`
+	// Path - the path changed.  Plan makes it relative to Dir, as "/a/b".
+	Path string `json:"path"`
+	// Target - the symlink target, the path linked to, or the new name of a rename.
+	Target string `json:"target,omitempty"`
+	// Mode - as "%#o", for mkdir, create, mkfifo, mknod and chmod.
+	Mode string `json:"mode,omitempty"`
+	// Owner - "uid:gid" for chown.
+	Owner string `json:"owner,omitempty"`
+	// Device - "major,minor" for mknod.
+	Device string `json:"device,omitempty"`
+	// Size - bytes written by create.
+	Size int64 `json:"size,omitempty"`
+	// Time - mtime set by utimes.
+	Time *time.Time `json:"time,omitempty"`
+	// Xattr - name of the xattr set by setxattr.
+	Xattr string `json:"xattr,omitempty"`
+}
+
+func (s PlanStep) String() string {
+	out := []string{s.Op, s.Path}
+	if s.Target != "" {
+		out = append(out, "-> "+s.Target)
+	}
+	for _, field := range []struct{ name, value string }{
+		{"mode", s.Mode}, {"owner", s.Owner}, {"device", s.Device}, {"xattr", s.Xattr}} {
+		if field.value != "" {
+			out = append(out, field.name+"="+field.value)
+		}
+	}
+	if s.Op == "create" {
+		out = append(out, fmt.Sprintf("size=%d", s.Size))
+	}
+	if s.Time != nil {
+		out = append(out, "time="+s.Time.UTC().Format(time.RFC3339))
+	}
+	return strings.Join(out, " ")
+}
+
+// PlanOps - FsOps that change nothing, but record the steps they were asked to
+// take.  As an FsView it shows the filesystem as if the steps were taken.
+type PlanOps struct {
+	Steps []PlanStep
+
+	mutex   sync.Mutex
+	planned map[string]os.FileMode // paths created, or chmod'ed, by a step.
+	removed map[string]bool        // paths removed, with what was below them.
+}
+
+func (p *PlanOps) add(step PlanStep) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.planned == nil {
+		p.planned, p.removed = map[string]os.FileMode{}, map[string]bool{}
+	}
+	p.Steps = append(p.Steps, step)
+	return len(p.Steps) - 1
+}
+
+func (p *PlanOps) setMode(path string, mode os.FileMode) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.planned[filepath.Clean(path)] = mode
+}
+
+// drop - path, and what is below it, is gone.
+func (p *PlanOps) drop(path string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	path = filepath.Clean(path)
+	for name := range p.planned {
+		if name == path || strings.HasPrefix(name, path+"/") {
+			delete(p.planned, name)
+		}
+	}
+	p.removed[path] = true
+}
+
+func planMode(mode os.FileMode) string {
+	return fmt.Sprintf("%#o", mode.Perm())
+}
+
+func (p *PlanOps) Chmod(name string, mode os.FileMode) error {
+	p.add(PlanStep{Op: "chmod", Path: name, Mode: planMode(mode)})
+	if fi, err := p.Lstat(name); err == nil {
+		p.setMode(name, fi.Mode()&^os.ModePerm|mode.Perm())
+	}
+	return nil
+}
+
+func (p *PlanOps) Chown(name string, uid, gid int) error {
+	p.add(PlanStep{Op: "chown", Path: name, Owner: fmt.Sprintf("%d:%d", uid, gid)})
+	return nil
+}
+
+func (p *PlanOps) Mknod(name string, info FileInfo) error {
+	stat := info.Sys().(syscall.Stat_t)
+	p.add(PlanStep{Op: "mknod", Path: name, Mode: planMode(info.FMode),
+		Device: fmt.Sprintf("%d,%d", unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev)))})
+	p.setMode(name, info.FMode&^os.ModePerm|DefaultFilePerm)
+	return nil
+}
+
+func (p *PlanOps) Mkdir(name string, mode os.FileMode) error {
+	if _, err := p.Lstat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	p.add(PlanStep{Op: "mkdir", Path: name, Mode: planMode(mode)})
+	p.setMode(name, os.ModeDir|mode.Perm())
+	return nil
+}
+
+func (p *PlanOps) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	i := p.add(PlanStep{Op: "create", Path: name, Mode: planMode(mode)})
+	p.setMode(name, mode.Perm())
+	return &planWriter{p, i}, nil
+}
+
+func (p *PlanOps) Symlink(target, name string) error {
+	p.add(PlanStep{Op: "symlink", Path: name, Target: target})
+	p.setMode(name, os.ModeSymlink|0777)
+	return nil
+}
+
+func (p *PlanOps) Link(oldpath, name string) error {
+	p.add(PlanStep{Op: "link", Path: name, Target: oldpath})
+	fi, err := p.Lstat(oldpath)
+	if err != nil {
+		return err
+	}
+	p.setMode(name, fi.Mode())
+	return nil
+}
+
+func (p *PlanOps) Rename(oldpath, newpath string) error {
+	fi, err := p.Lstat(oldpath)
+	if err != nil {
+		return err
+	}
+	p.add(PlanStep{Op: "rename", Path: oldpath, Target: newpath})
+	p.drop(newpath)
+	p.drop(oldpath)
+	p.setMode(newpath, fi.Mode())
+	return nil
+}
+
+func (p *PlanOps) Remove(name string) error {
+	p.add(PlanStep{Op: "remove", Path: name})
+	p.drop(name)
+	return nil
+}
+
+func (p *PlanOps) RemoveAll(name string) error {
+	p.add(PlanStep{Op: "remove-all", Path: name})
+	p.drop(name)
+	return nil
+}
+
+func (p *PlanOps) Mkfifo(name string, mode os.FileMode) error {
+	p.add(PlanStep{Op: "mkfifo", Path: name, Mode: planMode(mode)})
+	p.setMode(name, os.ModeNamedPipe|mode.Perm())
+	return nil
+}
+
+func (p *PlanOps) Socket(name string) error {
+	p.add(PlanStep{Op: "socket", Path: name})
+	p.setMode(name, os.ModeSocket|0755)
+	return nil
+}
+
+func (p *PlanOps) Utimes(name string, atime, mtime time.Time) error {
+	p.add(PlanStep{Op: "utimes", Path: name, Time: &mtime})
+	return nil
+}
+
+func (p *PlanOps) Setxattr(name, attr string, value []byte) error {
+	p.add(PlanStep{Op: "setxattr", Path: name, Xattr: attr})
+	return nil
+}
+
+// lookup - the planned mode of path, whether it was removed by a step.
+func (p *PlanOps) lookup(path string) (os.FileMode, bool, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	path = filepath.Clean(path)
+	if mode, ok := p.planned[path]; ok {
+		return mode, true, false
+	}
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if p.removed[dir] {
+			return 0, false, true
+		}
+		if dir == "/" || dir == "." {
+			return 0, false, false
+		}
+	}
+}
+
+func (p *PlanOps) Lstat(path string) (os.FileInfo, error) {
+	mode, planned, removed := p.lookup(path)
+	if planned {
+		return planFileInfo{filepath.Base(path), mode}, nil
+	} else if removed {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+	}
+	return os.Lstat(path)
+}
+
+func (p *PlanOps) Stat(path string) (os.FileInfo, error) {
+	fi, err := p.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return fi, err
+	}
+	if _, planned, _ := p.lookup(path); planned {
+		// where a planned symlink points is not followed.
+		return fi, nil
+	}
+	return os.Stat(path)
+}
+
+func (p *PlanOps) Access(path string, mode uint32) error {
+	fi, err := p.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := fi.(planFileInfo); !ok {
+		return unix.Access(path, mode)
+	}
+	// planned paths belong to whoever extracts them.
+	if uint32(fi.Mode().Perm()>>6)&mode != mode {
+		return unix.EACCES
+	}
+	return nil
+}
+
+func (p *PlanOps) ReadDirNames(dir string) ([]string, error) {
+	found := map[string]bool{}
+	if _, planned, removed := p.lookup(dir); !planned && !removed {
+		names, err := dirNames(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			found[name] = true
+		}
+	}
+	names := []string{}
+	for name := range found {
+		if _, err := p.Lstat(filepath.Join(dir, name)); err == nil {
+			names = append(names, name)
+		}
+	}
+	p.mutex.Lock()
+	for path := range p.planned {
+		if filepath.Dir(path) == filepath.Clean(dir) && !found[filepath.Base(path)] {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	p.mutex.Unlock()
+	sort.Strings(names)
+	return names, nil
+}
+
+// planWriter - counts what would be written to a created file.
+type planWriter struct {
+	p *PlanOps
+	i int
+}
+
+func (w *planWriter) Write(b []byte) (int, error) {
+	w.p.mutex.Lock()
+	defer w.p.mutex.Unlock()
+	w.p.Steps[w.i].Size += int64(len(b))
+	return len(b), nil
+}
+
+func (w *planWriter) Close() error {
+	return nil
+}
+
+// planFileInfo - os.FileInfo of a path a PlanOps step created.
+type planFileInfo struct {
+	name string
+	mode os.FileMode
+}
+
+func (fi planFileInfo) Name() string       { return fi.name }
+func (fi planFileInfo) Size() int64        { return 0 }
+func (fi planFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi planFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi planFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi planFileInfo) Sys() interface{}   { return nil }
+
+// relPlan - make the paths of steps relative to dir.
+func relPlan(dir string, steps []PlanStep) []PlanStep {
+	dir = filepath.Clean(dir)
+	rel := func(p string) string {
+		if p == dir {
+			return "/"
+		} else if strings.HasPrefix(p, dir+"/") {
+			return p[len(dir):]
+		}
+		return p
+	}
+	for i := range steps {
+		steps[i].Path = rel(steps[i].Path)
+		if steps[i].Op == "link" || steps[i].Op == "rename" {
+			steps[i].Target = rel(steps[i].Target)
+		}
+	}
+	return steps
+}
+
+// Plan - return the steps Extract would take, in order, without changing anything.
+// The plan is of the extraction straight into Dir, serially, and starts with
+// the mkdir of Dir if it does not exist.  Ops is not used, e is not changed.
+func (e *Extractor) Plan() ([]PlanStep, error) {
+	if e.Sink != nil {
+		return nil, fmt.Errorf("cannot plan an extraction to a sink")
+	}
+	ops, err := planDir(e.Dir)
+	if err != nil {
+		return nil, err
+	}
+	c := Extractor{
+		Dir:             e.Dir,
+		SquashFs:        e.SquashFs,
+		Path:            e.Path,
+		WhiteOuts:       e.WhiteOuts,
+		Owners:          e.Owners,
+		Perms:           e.Perms,
+		Devs:            e.Devs,
+		Sockets:         e.Sockets,
+		Logger:          e.Logger,
+		Ops:             ops,
+		Sync:            e.Sync,
+		SyncHash:        e.SyncHash,
+		Delete:          e.Delete,
+		Limits:          e.Limits,
+		Filter:          e.Filter,
+		Progress:        e.Progress,
+		Conflicts:       e.Conflicts,
+		BackupSuffix:    e.BackupSuffix,
+		ContinueOnError: e.ContinueOnError,
+	}
+	err = c.Extract()
+	return relPlan(e.Dir, ops.Steps), err
+}
+
+// Plan - return the steps Extract would take, see Extractor.Plan.
+func (m *MultiExtractor) Plan() ([]PlanStep, error) {
+	if m.Sink != nil {
+		return nil, fmt.Errorf("cannot plan an extraction to a sink")
+	}
+	ops, err := planDir(m.Dir)
+	if err != nil {
+		return nil, err
+	}
+	c := *m
+	c.Ops, c.Atomic, c.Workers = ops, false, 0
+	err = c.Extract()
+	return relPlan(m.Dir, ops.Steps), err
+}
+
+// planDir - return the PlanOps of a plan into dir, with the mkdir of dir
+// squashtool extract makes when it does not exist.
+func planDir(dir string) (*PlanOps, error) {
+	ops := &PlanOps{}
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return ops, ops.Mkdir(dir, DefaultDirPerm)
+	} else if err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
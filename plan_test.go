@@ -0,0 +1,33 @@
+package squashfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanMissingDir(t *testing.T) {
+	d := tempDir(t)
+	sqfs := writeTestImage(t, filepath.Join(d, "image.squashfs"), []testEntry{
+		tdir("/"),
+		tfile("/a", "a"),
+	})
+	defer sqfs.Free()
+
+	dir := filepath.Join(d, "out")
+	e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/", Atomic: true, Workers: 4,
+		Limits: Limits{CheckFreeSpace: true}, Logger: PrintfLogger{}}
+	steps, err := e.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) == 0 || steps[0].Op != "mkdir" || steps[0].Path != "/" {
+		t.Errorf("plan does not start with the mkdir of Dir: %v", steps)
+	}
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+		t.Errorf("Plan created Dir: %v", err)
+	}
+	if e.Ops != nil || !e.Atomic || e.Workers != 4 {
+		t.Errorf("Plan changed the Extractor: Ops %v, Atomic %v, Workers %d", e.Ops, e.Atomic, e.Workers)
+	}
+}
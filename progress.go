@@ -0,0 +1,68 @@
+package squashfs
+
+import (
+	"io"
+	"sync"
+)
+
+// Progress - the state of an extraction, passed to Extractor.Progress.
+type Progress struct {
+	// Entries - entries done, of TotalEntries below Path.
+	Entries      int64
+	TotalEntries int64
+	// Bytes - bytes of regular files written (or found unchanged with Sync),
+	// of TotalBytes of regular file content below Path.
+	Bytes      int64
+	TotalBytes int64
+	// Path - the entry last done.
+	Path string
+}
+
+// progressState - the Progress of a running extraction, shared with the workers.
+// The totals are counted by Extractor.preWalk.
+type progressState struct {
+	mutex  sync.Mutex
+	p      Progress
+	report func(Progress)
+}
+
+// done - path is extracted.  A nil progressState does nothing.
+func (ps *progressState) done(path string) {
+	if ps == nil {
+		return
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.p.Entries++
+	ps.p.Path = path
+	ps.report(ps.p)
+}
+
+// add - n more bytes of path are done.
+func (ps *progressState) add(path string, n int64) {
+	if ps == nil || n == 0 {
+		return
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.p.Bytes += n
+	ps.p.Path = path
+	ps.report(ps.p)
+}
+
+// progressWriter - io.Writer that reports what is written, and stops when the
+// extraction is cancelled.
+type progressWriter struct {
+	w    io.Writer
+	e    *Extractor
+	path string
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	if err := pw.e.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := pw.w.Write(b)
+	pw.e.progress.add(pw.path, int64(n))
+	return n, err
+}
@@ -0,0 +1,96 @@
+package squashfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testProgressImage - a read-only directory with n files of size bytes each.
+func testProgressImage(t *testing.T, fname string, n, size int) SquashFs {
+	ents := []testEntry{tdir("/"), {TreeEntry: TreeEntry{Path: "/ro", Mode: os.ModeDir | 0555}}}
+	for i := 0; i < n; i++ {
+		ents = append(ents, tfile(fmt.Sprintf("/ro/f%03d", i), strings.Repeat("x", size)))
+	}
+	return writeTestImage(t, fname, ents)
+}
+
+func TestProgressTotals(t *testing.T) {
+	d := tempDir(t)
+	sqfs := testProgressImage(t, filepath.Join(d, "image.squashfs"), 20, 1000)
+	defer sqfs.Free()
+
+	for _, workers := range []int{0, 4} {
+		t.Run(fmt.Sprintf("workers-%d", workers), func(t *testing.T) {
+			dir := filepath.Join(d, fmt.Sprintf("out-%d", workers))
+			if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+				t.Fatal(err)
+			}
+			var mutex sync.Mutex
+			var last Progress
+			calls := 0
+			e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/", Workers: workers, Logger: PrintfLogger{},
+				Progress: func(p Progress) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					last = p
+					calls++
+				}}
+			if err := e.Extract(); err != nil {
+				t.Fatal(err)
+			}
+			if calls == 0 {
+				t.Fatal("Progress was not called")
+			}
+			want := Progress{Entries: 22, TotalEntries: 22, Bytes: 20 * 1000, TotalBytes: 20 * 1000}
+			last.Path = ""
+			if last != want {
+				t.Errorf("last progress is %+v, want %+v", last, want)
+			}
+		})
+	}
+}
+
+func TestCancelRunsCleanups(t *testing.T) {
+	d := tempDir(t)
+	sqfs := testProgressImage(t, filepath.Join(d, "image.squashfs"), 50, 100000)
+	defer sqfs.Free()
+
+	for _, workers := range []int{0, 4} {
+		t.Run(fmt.Sprintf("workers-%d", workers), func(t *testing.T) {
+			dir := filepath.Join(d, fmt.Sprintf("out-%d", workers))
+			if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/", Perms: true, Workers: workers,
+				Logger: PrintfLogger{},
+				Progress: func(p Progress) {
+					if p.Entries >= 4 {
+						cancel()
+					}
+				}}
+			err := e.ExtractContext(ctx)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected context.Canceled, got %v", err)
+			}
+
+			fi, err := os.Lstat(filepath.Join(dir, "ro"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0555 {
+				t.Errorf("/ro is %o, the permission cleanup did not run", fi.Mode().Perm())
+			}
+			if got := treePaths(t, dir); len(got) >= 52 {
+				t.Errorf("the walk went on after cancel: %d entries", len(got))
+			}
+		})
+	}
+}
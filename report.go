@@ -0,0 +1,125 @@
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// EntryError - extracting Path failed at Op (mkdir, write, mknod, chown, chmod ...) with Err.
+type EntryError struct {
+	Path string
+	Op   string
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Path, e.Op, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// ExtractErrors - the entries that failed in an extraction with ContinueOnError.
+type ExtractErrors []*EntryError
+
+func (errs ExtractErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	return fmt.Sprintf("%d entries failed to extract, first: %s", len(errs), errs[0])
+}
+
+// SkippedEntry - an entry that was not extracted, and why.
+type SkippedEntry struct {
+	Path   string
+	Reason string
+}
+
+// ExtractReport - what an extraction did, filled in by Extract.
+type ExtractReport struct {
+	// Types - number of entries extracted, by type: dir, file, symlink, char,
+	// block, fifo or socket.
+	Types map[string]int64
+	// Bytes - bytes of regular files written.
+	Bytes   int64
+	Skipped []SkippedEntry
+	// Errors - the entries that failed, with ContinueOnError.
+	Errors ExtractErrors
+	// Created, Updated, Unchanged and Deleted - what a Sync or Delete
+	// extraction did to Dir, only counted when one of them is set.
+	Created   int
+	Updated   int
+	Unchanged int
+	Deleted   int
+}
+
+// entryError - err as an *EntryError for path, unless it already is one.
+// Cancellation and limits are not about the entry, so are left alone.
+func (e *Extractor) entryError(path, op string, err error) error {
+	var entryErr *EntryError
+	var limitErr *LimitError
+	if err == nil || err == SkipDir || err == errKeepExisting ||
+		errors.As(err, &entryErr) || errors.As(err, &limitErr) || e.ctx.Err() != nil {
+		return err
+	}
+	return &EntryError{Path: path, Op: op, Err: err}
+}
+
+// recordError - with ContinueOnError, add err to the report and return true if
+// the extraction can go on past it.
+func (e *Extractor) recordError(err error) bool {
+	var entryErr *EntryError
+	if !e.ContinueOnError || e.ctx.Err() != nil || !errors.As(err, &entryErr) {
+		return false
+	}
+	e.reportMutex.Lock()
+	defer e.reportMutex.Unlock()
+	e.Logger.Info("%s", entryErr)
+	e.Report.Errors = append(e.Report.Errors, entryErr)
+	return true
+}
+
+// recordDone - path was extracted, count it.
+func (e *Extractor) recordDone(info FileInfo) {
+	e.reportMutex.Lock()
+	defer e.reportMutex.Unlock()
+	e.Report.Types[fileType(info.FMode)]++
+	if info.FMode.IsRegular() {
+		e.Report.Bytes += info.FSize
+	}
+}
+
+// recordSync - count an entry in the Sync or Delete count n of the report.
+func (e *Extractor) recordSync(n *int) {
+	e.reportMutex.Lock()
+	defer e.reportMutex.Unlock()
+	*n++
+}
+
+// recordSkip - path was not extracted, for reason.
+func (e *Extractor) recordSkip(path, reason string) {
+	e.reportMutex.Lock()
+	defer e.reportMutex.Unlock()
+	e.Report.Skipped = append(e.Report.Skipped, SkippedEntry{Path: path, Reason: reason})
+}
+
+// extractOp - the operation that creates an entry of mode, for EntryError.
+func extractOp(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeDir != 0:
+		return "mkdir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "mkfifo"
+	case mode&(os.ModeDevice|os.ModeCharDevice) != 0:
+		return "mknod"
+	case mode.IsRegular():
+		return "write"
+	}
+	return "extract"
+}
@@ -0,0 +1,90 @@
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// failingOps - GoFsOps where chown of "bad" and sockets fail, and other chowns do nothing.
+type failingOps struct {
+	GoFsOps
+}
+
+func (f failingOps) Chown(name string, uid, gid int) error {
+	if filepath.Base(name) == "bad" {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+func (f failingOps) Socket(name string) error {
+	return syscall.EACCES
+}
+
+func TestContinueOnError(t *testing.T) {
+	d := tempDir(t)
+	sqfs := writeTestImage(t, filepath.Join(d, "image.squashfs"), []testEntry{
+		tdir("/"),
+		tfile("/a", "aaaa"),
+		tfile("/bad", "bad"),
+		tchar("/console", 5, 1),
+		tdir("/dir"),
+		tfile("/dir/c", "cc"),
+		tsocket("/sock"),
+		tfile("/z", "zzzzzz"),
+	})
+	defer sqfs.Free()
+
+	for _, workers := range []int{0, 4} {
+		t.Run(fmt.Sprintf("workers-%d", workers), func(t *testing.T) {
+			dir := filepath.Join(d, fmt.Sprintf("out-%d", workers))
+			if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+				t.Fatal(err)
+			}
+			e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/", Ops: failingOps{}, Owners: true, Sockets: true,
+				Workers: workers, ContinueOnError: true, Logger: PrintfLogger{}}
+			err := e.Extract()
+
+			var errs ExtractErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("expected ExtractErrors, got %v", err)
+			}
+			sort.Slice(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+			got := []string{}
+			for _, entryErr := range errs {
+				got = append(got, entryErr.Path+" "+entryErr.Op)
+			}
+			if want := []string{"/bad chown", "/sock socket"}; strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("errors are %v, want %v", got, want)
+			}
+			if len(e.Report.Errors) != len(errs) {
+				t.Errorf("Report.Errors has %d errors, Extract returned %d", len(e.Report.Errors), len(errs))
+			}
+			if !errors.Is(errs[0], syscall.EPERM) {
+				t.Errorf("the chown error lost its cause: %v", errs[0].Err)
+			}
+
+			// the walk went on past the failures.
+			for _, p := range []string{"a", "dir/c", "z"} {
+				if _, err := os.Lstat(filepath.Join(dir, p)); err != nil {
+					t.Errorf("%s was not extracted: %s", p, err)
+				}
+			}
+			if e.Report.Types["file"] != 3 || e.Report.Types["dir"] < 1 || e.Report.Types["socket"] != 0 {
+				t.Errorf("unexpected Report.Types %v", e.Report.Types)
+			}
+			if e.Report.Bytes != int64(len("aaaa")+len("cc")+len("zzzzzz")) {
+				t.Errorf("Report.Bytes is %d", e.Report.Bytes)
+			}
+			if len(e.Report.Skipped) != 1 || e.Report.Skipped[0] != (SkippedEntry{"/console", "devices not extracted"}) {
+				t.Errorf("unexpected Report.Skipped %v", e.Report.Skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package squashfs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// signature trailer: json signature, then its length (uint32 little endian) and the magic.
+var sigTrailerMagic = []byte("SQFSSIG1")
+
+const sigTrailerFooter = 12
+
+var (
+	// ErrNoSignature - the image has no signature trailer.
+	ErrNoSignature = errors.New("no signature found")
+	// ErrUntrustedKey - the signature was not made by a key in the KeySet.
+	ErrUntrustedKey = errors.New("signed by an untrusted key")
+	// ErrBadSignature - the signature does not verify.
+	ErrBadSignature = errors.New("bad signature")
+)
+
+// Signature - a detached ed25519 signature over the digest and superblock metadata of an image.
+type Signature struct {
+	// Digest - "sha256:hex" of the image up to bytes_used.
+	Digest      string `json:"digest"`
+	BytesUsed   uint64 `json:"bytes_used"`
+	BlockSize   uint32 `json:"block_size"`
+	Compression uint16 `json:"compression"`
+	Inodes      uint32 `json:"inodes"`
+	ModTime     uint32 `json:"mod_time"`
+	// KeyID - identifies the public key, see KeyID().
+	KeyID     string `json:"keyid"`
+	Signature []byte `json:"signature"`
+}
+
+// payload - the bytes that are signed.
+func (s Signature) payload() []byte {
+	return []byte(fmt.Sprintf("squashfs signature v1\ndigest %s\nbytes_used %d\nblock_size %d\ncompression %d\ninodes %d\nmod_time %d\n",
+		s.Digest, s.BytesUsed, s.BlockSize, s.Compression, s.Inodes, s.ModTime))
+}
+
+// KeyID - a short identifier for pub: the first 8 bytes of its sha256 as hex.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// KeySet - trusted public keys, by KeyID.
+type KeySet map[string]ed25519.PublicKey
+
+// Add - trust pub.
+func (ks KeySet) Add(pub ed25519.PublicKey) {
+	ks[KeyID(pub)] = pub
+}
+
+// LoadKeySet - a KeySet with the PEM public keys in the named files.
+func LoadKeySet(fnames ...string) (KeySet, error) {
+	ks := KeySet{}
+	for _, fname := range fnames {
+		pub, err := LoadPublicKey(fname)
+		if err != nil {
+			return ks, err
+		}
+		ks.Add(pub)
+	}
+	return ks, nil
+}
+
+// LoadPrivateKey - read a PEM PKCS#8 ed25519 private key ("openssl genpkey -algorithm ed25519").
+func LoadPrivateKey(fname string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(fname, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", fname, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", fname)
+	}
+	return priv, nil
+}
+
+// LoadPublicKey - read a PEM PKIX ed25519 public key ("openssl pkey -pubout").
+func LoadPublicKey(fname string) (ed25519.PublicKey, error) {
+	der, err := readPEM(fname, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", fname, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", fname)
+	}
+	return pub, nil
+}
+
+func readPEM(fname, blockType string) ([]byte, error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not contain a PEM %s", fname, blockType)
+	}
+	return block.Bytes, nil
+}
+
+// SignImage - sign the image fname with key.
+func SignImage(fname string, key ed25519.PrivateKey) (Signature, error) {
+	fp, err := os.Open(fname)
+	if err != nil {
+		return Signature{}, err
+	}
+	defer fp.Close()
+
+	sig, err := imageSignatureData(fp)
+	if err != nil {
+		return sig, fmt.Errorf("failed reading %s: %s", fname, err)
+	}
+	sig.KeyID = KeyID(key.Public().(ed25519.PublicKey))
+	sig.Signature = ed25519.Sign(key, sig.payload())
+	return sig, nil
+}
+
+// VerifyImage - check that sig is a valid signature of the image fname by a key in ks.
+// If sig is nil the signature trailer of the image is used.
+func (ks KeySet) VerifyImage(fname string, sig *Signature) error {
+	fp, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return ks.verify(fp, sig)
+}
+
+// OpenSigned - OpenSquashfs, after checking the image has a valid signature by a key in ks.
+// If sig is nil the signature trailer of the image is used.  As with OpenVerified the
+// image is read through the descriptor that was checked, kept open until Free.
+func OpenSigned(fname string, ks KeySet, sig *Signature) (SquashFs, error) {
+	fp, err := os.Open(fname)
+	if err != nil {
+		return SquashFs{}, err
+	}
+
+	if err := ks.verify(fp, sig); err != nil {
+		fp.Close()
+		return SquashFs{}, fmt.Errorf("%s: %w", fname, err)
+	}
+
+	return openVerified(fname, fp)
+}
+
+func (ks KeySet) verify(fp *os.File, sig *Signature) error {
+	if sig == nil {
+		trailer, err := readSignatureTrailer(fp)
+		if err != nil {
+			return err
+		}
+		sig = &trailer
+	}
+
+	pub, ok := ks[sig.KeyID]
+	if !ok {
+		return fmt.Errorf("%w: key %s", ErrUntrustedKey, sig.KeyID)
+	}
+
+	actual, err := imageSignatureData(fp)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(actual.payload(), sig.payload()) {
+		if actual.Digest != sig.Digest {
+			return &DigestMismatchError{fp.Name(), sig.Digest, actual.Digest}
+		}
+		return fmt.Errorf("%w: superblock does not match the signed metadata", ErrBadSignature)
+	}
+
+	if !ed25519.Verify(pub, sig.payload(), sig.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// imageSignatureData - a Signature with the digest and metadata of the image in fp, unsigned.
+func imageSignatureData(fp *os.File) (Signature, error) {
+	sig := Signature{}
+	bytesUsed, err := imageBytesUsed(fp)
+	if err != nil {
+		return sig, err
+	}
+
+	super := make([]byte, superSize)
+	if _, err := fp.ReadAt(super, 0); err != nil {
+		return sig, err
+	}
+	sig.BytesUsed = bytesUsed
+	sig.Inodes = binary.LittleEndian.Uint32(super[4:])
+	sig.ModTime = binary.LittleEndian.Uint32(super[8:])
+	sig.BlockSize = binary.LittleEndian.Uint32(super[12:])
+	sig.Compression = binary.LittleEndian.Uint16(super[20:])
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(fp, 0, int64(bytesUsed))); err != nil {
+		return sig, err
+	}
+	sig.Digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	return sig, nil
+}
+
+// ParseSignature - parse a detached signature, as written by Signature.Marshal.
+func ParseSignature(content []byte) (Signature, error) {
+	sig := Signature{}
+	if err := json.Unmarshal(content, &sig); err != nil {
+		return sig, fmt.Errorf("failed to parse signature: %s", err)
+	}
+	return sig, nil
+}
+
+// Marshal - the detached signature as json.
+func (s Signature) Marshal() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// WriteSignatureTrailer - embed sig at the end of the image fname, after bytes_used.
+// An existing signature trailer is replaced.  VerityFormat keeps the trailer
+// after the hash tree it appends.
+func WriteSignatureTrailer(fname string, sig Signature) error {
+	fp, err := os.OpenFile(fname, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	end, err := signatureTrailerStart(fp)
+	if err != nil && err != ErrNoSignature {
+		return err
+	}
+	if err := fp.Truncate(end); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(sig)
+	if err != nil {
+		return err
+	}
+	footer := make([]byte, 4, sigTrailerFooter)
+	binary.LittleEndian.PutUint32(footer, uint32(len(content)))
+	footer = append(footer, sigTrailerMagic...)
+	if _, err := fp.WriteAt(append(content, footer...), end); err != nil {
+		return err
+	}
+	return fp.Sync()
+}
+
+// ReadSignatureTrailer - return the signature embedded in the image fname.
+func ReadSignatureTrailer(fname string) (Signature, error) {
+	fp, err := os.Open(fname)
+	if err != nil {
+		return Signature{}, err
+	}
+	defer fp.Close()
+	return readSignatureTrailer(fp)
+}
+
+func readSignatureTrailer(fp *os.File) (Signature, error) {
+	start, err := signatureTrailerStart(fp)
+	if err != nil {
+		return Signature{}, err
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		return Signature{}, err
+	}
+	content := make([]byte, st.Size()-sigTrailerFooter-start)
+	if _, err := fp.ReadAt(content, start); err != nil {
+		return Signature{}, err
+	}
+	return ParseSignature(content)
+}
+
+// signatureTrailerStart - the offset of the signature trailer in fp, or the end of
+// the file and ErrNoSignature if there is none.
+func signatureTrailerStart(fp *os.File) (int64, error) {
+	st, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	bytesUsed, err := imageBytesUsed(fp)
+	if err != nil {
+		return 0, err
+	}
+
+	size := st.Size()
+	if uint64(size) < bytesUsed+sigTrailerFooter {
+		return size, ErrNoSignature
+	}
+	footer := make([]byte, sigTrailerFooter)
+	if _, err := fp.ReadAt(footer, size-sigTrailerFooter); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(footer[4:], sigTrailerMagic) {
+		return size, ErrNoSignature
+	}
+	start := size - sigTrailerFooter - int64(binary.LittleEndian.Uint32(footer))
+	if start < int64(bytesUsed) {
+		return 0, fmt.Errorf("signature trailer overlaps the filesystem")
+	}
+	return start, nil
+}
@@ -0,0 +1,403 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sink - where an Extractor with Sink set writes entries, instead of Dir.
+// Entries come in walk order, directories before what is in them.  The
+// Extractor does not Close the Sink, whoever made it does.
+type Sink interface {
+	// Add - add ent, r has the content of regular files and is nil otherwise.
+	Add(ent SinkEntry, r io.Reader) error
+	Close() error
+}
+
+// SinkEntry - an entry written to a Sink.  Mode, Uid and Gid are as the
+// Extractor's Perms and Owners say: without them, the defaults it would create
+// a directory with, owned by the current user.
+type SinkEntry struct {
+	TreeEntry
+	// Nlink - the link count in the image.
+	Nlink uint64
+	// HardLink - if set, the path of an earlier entry this is a hard link to.
+	// r is nil and Size 0, the content went with the first entry.
+	HardLink string
+}
+
+// linkKey - identifies an inode in an image, for finding hard links.
+type linkKey struct {
+	image string
+	ino   uint64
+}
+
+// sinkEntry - the SinkEntry for writing info as path.
+func (e *Extractor) sinkEntry(path string, info FileInfo) SinkEntry {
+	stat := info.Sys().(syscall.Stat_t)
+	ent := SinkEntry{
+		TreeEntry: TreeEntry{
+			Path:       path,
+			Mode:       info.FMode,
+			Uid:        uint32(os.Getuid()),
+			Gid:        uint32(os.Getgid()),
+			ModTime:    info.FModTime,
+			LinkTarget: info.SymlinkTarget,
+			Rdev:       stat.Rdev,
+			Xattrs:     map[string]string{},
+		},
+		Nlink: uint64(stat.Nlink),
+	}
+	if info.FMode.IsRegular() {
+		ent.Size = info.FSize
+	}
+	if e.Owners {
+		ent.Uid, ent.Gid = stat.Uid, stat.Gid
+	}
+	if !e.Perms {
+		switch {
+		case info.FMode.IsDir():
+			ent.Mode = os.ModeDir | DefaultDirPerm
+		case info.FMode&os.ModeSymlink != 0:
+			ent.Mode = os.ModeSymlink | 0777
+		default:
+			ent.Mode = info.FMode&os.ModeType | DefaultFilePerm
+		}
+	}
+	return ent
+}
+
+// addToSink - write the entry at path to e.Sink.
+func (e *Extractor) addToSink(path string, info FileInfo) error {
+	ent := e.sinkEntry(path, info)
+	var r io.Reader
+	var key *linkKey
+	if !info.IsDir() && ent.Nlink > 1 {
+		key = &linkKey{info.File.SquashFs.Filename, info.Sys().(syscall.Stat_t).Ino}
+		if first, ok := e.links[*key]; ok {
+			e.Logger.Debug("sink: %s is a hard link to %s", path, first)
+			ent.HardLink, ent.Size = first, 0
+			return e.Sink.Add(ent, nil)
+		}
+	}
+	if info.FMode.IsRegular() {
+		// the progressWriter stops the copy on cancel, and counts the bytes.
+		r = io.TeeReader(info.File, progressWriter{ioutil.Discard, e, path})
+	}
+
+	opaque := info.IsDir() && e.WhiteOuts != WhiteOutSkip && IsOpaque(info)
+	if opaque && e.WhiteOuts == WhiteOutLiteral {
+		ent.Xattrs[OpaqueXattr] = "y"
+	}
+	e.Logger.Debug("sink: %s %s", fileType(ent.Mode), path)
+	if err := e.Sink.Add(ent, r); err != nil {
+		return err
+	}
+	if key != nil {
+		// only once it is in the sink, later links to a failed entry are added
+		// as the entry instead.
+		e.links[*key] = path
+	}
+	if opaque && e.WhiteOuts == WhiteOutAUFS {
+		if hasOpaqueMarker(info) {
+			// the image has the marker, it is added as the walk gets to it.
+			return nil
+		}
+		marker := ent
+		marker.Path = filepath.Join(path, OpaqueMarker)
+		marker.Mode = info.FMode.Perm()
+		marker.Nlink, marker.Xattrs = 1, nil
+		return e.Sink.Add(marker, bytes.NewReader(nil))
+	}
+	return nil
+}
+
+// sinkWhiteOut - write the white-out at path, that hides whiteOut, to e.Sink.
+// Whiteouts applied (WhiteOutOverlay) would remove from Dir, there is nothing
+// to remove from a Sink.
+func (e *Extractor) sinkWhiteOut(path, whiteOut string, info FileInfo) error {
+	ent := e.sinkEntry(whiteOut, info)
+	ent.Nlink, ent.Size = 1, 0
+	switch e.WhiteOuts {
+	case WhiteOutLiteral:
+		if !e.Devs {
+			e.Logger.Debug("skipping white-out char device %s", path)
+			e.recordSkip(path, "devices not extracted")
+			return nil
+		}
+		e.Logger.Debug("sink: whiteout %s as char device %s", path, whiteOut)
+		ent.Mode = os.ModeCharDevice | ent.Mode.Perm()
+		ent.Rdev = 0
+		return e.Sink.Add(ent, nil)
+	case WhiteOutAUFS:
+		ent.Path = filepath.Join(filepath.Dir(whiteOut), WhiteOutPrefix+filepath.Base(whiteOut))
+		e.Logger.Debug("sink: whiteout %s as aufs %s", path, ent.Path)
+		ent.Mode = ent.Mode.Perm()
+		return e.Sink.Add(ent, bytes.NewReader(nil))
+	}
+	e.Logger.Debug("not writing white-out file %s", path)
+	e.recordSkip(path, "whiteout not extracted")
+	return nil
+}
+
+// DirSink - a Sink creating entries in the directory Dir, which should be empty.
+// Use an Extractor without a Sink to extract over what is there.
+type DirSink struct {
+	Dir  string
+	dirs []SinkEntry
+}
+
+// Add - Sink.Add for a directory.
+func (d *DirSink) Add(ent SinkEntry, r io.Reader) error {
+	fpath := filepath.Join(d.Dir, ent.Path)
+	var err error
+	switch typ := fileType(ent.Mode); {
+	case ent.HardLink != "":
+		err = os.Link(filepath.Join(d.Dir, ent.HardLink), fpath)
+	case typ == "dir":
+		// made writable for what goes in it, the mode is set by Close.
+		if err = os.Mkdir(fpath, OpenDirPerm); os.IsExist(err) && ent.Path == "/" {
+			err = os.Chmod(fpath, OpenDirPerm)
+		}
+		d.dirs = append(d.dirs, ent)
+	case typ == "file":
+		var fp *os.File
+		if fp, err = os.OpenFile(fpath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, DefaultFilePerm); err == nil {
+			_, err = io.Copy(fp, r)
+			if cerr := fp.Close(); err == nil {
+				err = cerr
+			}
+		}
+	case typ == "symlink":
+		err = os.Symlink(ent.LinkTarget, fpath)
+	case typ == "fifo":
+		err = GoFsOps{}.Mkfifo(fpath, DefaultFilePerm)
+	case typ == "socket":
+		err = GoFsOps{}.Socket(fpath)
+	case typ == "char":
+		err = unix.Mknod(fpath, syscall.S_IFCHR|DefaultFilePerm, int(ent.Rdev))
+	case typ == "block":
+		err = unix.Mknod(fpath, syscall.S_IFBLK|DefaultFilePerm, int(ent.Rdev))
+	default:
+		err = fmt.Errorf("cannot create %s of type %s", ent.Path, typ)
+	}
+	if err != nil || ent.HardLink != "" || ent.Mode.IsDir() {
+		return err
+	}
+	return d.setAttrs(fpath, ent)
+}
+
+func (d *DirSink) setAttrs(fpath string, ent SinkEntry) error {
+	if int(ent.Uid) != os.Getuid() || int(ent.Gid) != os.Getgid() {
+		if err := os.Lchown(fpath, int(ent.Uid), int(ent.Gid)); err != nil {
+			return err
+		}
+	}
+	for k, v := range ent.Xattrs {
+		if err := unix.Lsetxattr(fpath, k, []byte(v), 0); err != nil {
+			return err
+		}
+	}
+	if ent.Mode&os.ModeSymlink == 0 {
+		if err := os.Chmod(fpath, ent.Mode); err != nil {
+			return err
+		}
+	}
+	return GoFsOps{}.Utimes(fpath, ent.ModTime, ent.ModTime)
+}
+
+// Close - set the owners, modes and times of the directories, deepest first.
+func (d *DirSink) Close() error {
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		if err := d.setAttrs(filepath.Join(d.Dir, d.dirs[i].Path), d.dirs[i]); err != nil {
+			return err
+		}
+	}
+	d.dirs = nil
+	return nil
+}
+
+// MemSink - a Sink keeping entries in memory, keyed by path.  It is also a
+// Tree, so it can be compared with Compare.
+type MemSink struct {
+	Files map[string]*MemEntry
+}
+
+// MemEntry - an entry of a MemSink, Data is the content of regular files.
+// Hard links share Data.
+type MemEntry struct {
+	SinkEntry
+	Data []byte
+}
+
+// NewMemSink - return an empty MemSink.
+func NewMemSink() *MemSink {
+	return &MemSink{Files: map[string]*MemEntry{}}
+}
+
+// Add - Sink.Add in memory.
+func (m *MemSink) Add(ent SinkEntry, r io.Reader) error {
+	ment := &MemEntry{SinkEntry: ent}
+	if ent.HardLink != "" {
+		linked, ok := m.Files[ent.HardLink]
+		if !ok {
+			return fmt.Errorf("%s: hard link to %s, which is not in the sink", ent.Path, ent.HardLink)
+		}
+		ment.Data, ment.Size = linked.Data, linked.Size
+	} else if r != nil {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		ment.Data = data
+	}
+	m.Files[ent.Path] = ment
+	return nil
+}
+
+// Close - Sink.Close, nothing to do.
+func (m *MemSink) Close() error {
+	return nil
+}
+
+// Entries - Tree.Entries of the MemSink.
+func (m *MemSink) Entries() (map[string]TreeEntry, error) {
+	entries := map[string]TreeEntry{}
+	for p, ent := range m.Files {
+		entries[p] = ent.TreeEntry
+	}
+	return entries, nil
+}
+
+// Open - Tree.Open of the MemSink.
+func (m *MemSink) Open(path string) (io.ReadCloser, error) {
+	ent, ok := m.Files[path]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(ent.Data)), nil
+}
+
+// TarSink - a Sink writing a tar archive (PAX format, xattrs as SCHILY.xattr records).
+// Tar has no sockets, adding one is an error.
+type TarSink struct {
+	w *tar.Writer
+}
+
+// NewTarSink - return a TarSink writing to w.
+func NewTarSink(w io.Writer) *TarSink {
+	return &TarSink{w: tar.NewWriter(w)}
+}
+
+// Add - Sink.Add for tar.
+func (t *TarSink) Add(ent SinkEntry, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    strings.TrimPrefix(ent.Path, "/"),
+		Mode:    int64(unixPerms(ent.Mode)),
+		Uid:     int(ent.Uid),
+		Gid:     int(ent.Gid),
+		ModTime: ent.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	switch typ := fileType(ent.Mode); {
+	case ent.HardLink != "":
+		hdr.Typeflag, hdr.Linkname = tar.TypeLink, strings.TrimPrefix(ent.HardLink, "/")
+	case typ == "dir":
+		hdr.Typeflag, hdr.Name = tar.TypeDir, hdr.Name+"/"
+		if ent.Path == "/" {
+			hdr.Name = "./"
+		}
+	case typ == "file":
+		hdr.Typeflag, hdr.Size = tar.TypeReg, ent.Size
+	case typ == "symlink":
+		hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, ent.LinkTarget
+	case typ == "char" || typ == "block":
+		hdr.Typeflag = tar.TypeChar
+		if typ == "block" {
+			hdr.Typeflag = tar.TypeBlock
+		}
+		hdr.Devmajor, hdr.Devminor = int64(unix.Major(ent.Rdev)), int64(unix.Minor(ent.Rdev))
+	case typ == "fifo":
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return fmt.Errorf("%s: cannot store %s in tar", ent.Path, typ)
+	}
+	if len(ent.Xattrs) != 0 {
+		hdr.PAXRecords = map[string]string{}
+		for k, v := range ent.Xattrs {
+			hdr.PAXRecords["SCHILY.xattr."+k] = v
+		}
+	}
+
+	if err := t.w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		if _, err := io.Copy(t.w, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close - write the end of the archive.  The underlying writer is not closed.
+func (t *TarSink) Close() error {
+	return t.w.Close()
+}
+
+// CpioSink - a Sink writing a newc cpio archive, see CpioWriter.
+type CpioSink struct {
+	*CpioWriter
+}
+
+// NewCpioSink - return a CpioSink writing to w.
+func NewCpioSink(w io.Writer) *CpioSink {
+	return &CpioSink{NewCpioWriter(w)}
+}
+
+// Add - Sink.Add for cpio.
+func (c *CpioSink) Add(ent SinkEntry, r io.Reader) error {
+	return c.WriteEntry(ent, r)
+}
+
+// SquashfsSink - a Sink building a squashfs image with a Writer, so owners,
+// devices and xattrs go in without privileges.
+type SquashfsSink struct {
+	w *Writer
+}
+
+// NewSquashfsSink - return a SquashfsSink creating the image filename, see NewWriter.
+func NewSquashfsSink(filename string, opts WriterOptions) (*SquashfsSink, error) {
+	w, err := NewWriter(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &SquashfsSink{w: w}, nil
+}
+
+// Add - Sink.Add for squashfs.
+func (s *SquashfsSink) Add(ent SinkEntry, r io.Reader) error {
+	if ent.HardLink != "" {
+		return s.w.Link(ent.Path, ent.HardLink)
+	}
+	return s.w.Add(ent.TreeEntry, r)
+}
+
+// Discard - remove the image without finishing it.
+func (s *SquashfsSink) Discard() error {
+	return s.w.Discard()
+}
+
+// Close - finish the image.
+func (s *SquashfsSink) Close() error {
+	return s.w.Close()
+}
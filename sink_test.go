@@ -0,0 +1,93 @@
+package squashfs
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSquashfsSinkKeepsXattrs(t *testing.T) {
+	d := tempDir(t)
+	sqfs := writeTestImage(t, filepath.Join(d, "image.squashfs"), []testEntry{
+		tdir("/", "user.root", "r"),
+		tdir("/d", "user.test", "v"),
+		tfile("/d/a", "a"),
+	})
+	defer sqfs.Free()
+
+	out := filepath.Join(d, "out.squashfs")
+	sink, err := NewSquashfsSink(out, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Extractor{SquashFs: sqfs, Path: "/", Owners: true, Perms: true, Sink: sink, Logger: PrintfLogger{}}
+	if err := e.Extract(); err != nil {
+		sink.Discard()
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := OpenSquashfs(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer built.Free()
+	ents, err := ImageTree{&built}.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ents["/"].Xattrs["user.root"] != "r" || ents["/d"].Xattrs["user.test"] != "v" {
+		t.Errorf("xattrs lost: / %v, /d %v", ents["/"].Xattrs, ents["/d"].Xattrs)
+	}
+}
+
+// failingSink - a MemSink failing to add the path fail.
+type failingSink struct {
+	*MemSink
+	fail string
+}
+
+func (f failingSink) Add(ent SinkEntry, r io.Reader) error {
+	if ent.Path == f.fail {
+		return fmt.Errorf("cannot add %s", ent.Path)
+	}
+	return f.MemSink.Add(ent, r)
+}
+
+func TestSinkHardLinkToFailedEntry(t *testing.T) {
+	d := tempDir(t)
+	fname := filepath.Join(d, "image.squashfs")
+	w, err := NewWriter(fname, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent := tfile("/a", "content")
+	if err := w.Add(ent.TreeEntry, strings.NewReader(ent.content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Link("/b", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sqfs, err := OpenSquashfs(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqfs.Free()
+
+	sink := failingSink{NewMemSink(), "/a"}
+	e := Extractor{SquashFs: sqfs, Path: "/", Sink: sink, ContinueOnError: true, Logger: PrintfLogger{}}
+	if err := e.Extract(); err == nil {
+		t.Errorf("expected the error adding /a")
+	}
+	b, ok := sink.Files["/b"]
+	if !ok || b.HardLink != "" || string(b.Data) != "content" {
+		t.Errorf("/b should be added with the content, not as a link to /a: %+v", b)
+	}
+}
@@ -12,6 +12,7 @@ package squashfs
 // #include <sqfs/dir_reader.h>
 // #include <sqfs/id_table.h>
 // #include <sqfs/data_reader.h>
+// #include <sqfs/xattr_reader.h>
 import "C"
 
 import (
@@ -39,19 +40,87 @@ type WalkFunc func(string, FileInfo, error) error
 var ErrNotImplemented = errors.New("not implemented")
 
 type SquashFs struct {
-	Filename   string
-	file       *C.sqfs_file_t
-	super      *C.sqfs_super_t
-	config     *C.sqfs_compressor_config_t
-	compressor *C.sqfs_compressor_t
-	idTable    *C.sqfs_id_table_t
-	dirReader  *C.sqfs_dir_reader_t
-	dataReader *C.sqfs_data_reader_t
-	root       *C.sqfs_inode_generic_t
+	Filename string
+	// source - the path libsquashfs opens, the /proc/self/fd path of verified
+	// for images from OpenVerified and OpenSigned, else Filename.
+	source string
+	// verified - the descriptor that was checked, kept open until Free.
+	verified    *os.File
+	file        *C.sqfs_file_t
+	super       *C.sqfs_super_t
+	config      *C.sqfs_compressor_config_t
+	compressor  *C.sqfs_compressor_t
+	idTable     *C.sqfs_id_table_t
+	dirReader   *C.sqfs_dir_reader_t
+	dataReader  *C.sqfs_data_reader_t
+	xattrReader *C.sqfs_xattr_reader_t
+	// xattrErr - why the xattr table could not be loaded, Xattrs returns it.
+	xattrErr error
+	root     *C.sqfs_inode_generic_t
+}
+
+// Free - release the readers and tables of the image, and the verified descriptor.
+// Images from Reopen must be freed first.
+func (s *SquashFs) Free() {
+	if s.xattrReader != nil {
+		C.sqfs_destroy(unsafe.Pointer(s.xattrReader))
+		s.xattrReader = nil
+	}
+	if s.dataReader != nil {
+		C.sqfs_destroy(unsafe.Pointer(s.dataReader))
+		s.dataReader = nil
+	}
+	if s.dirReader != nil {
+		C.sqfs_destroy(unsafe.Pointer(s.dirReader))
+		s.dirReader = nil
+	}
+	if s.idTable != nil {
+		C.sqfs_destroy(unsafe.Pointer(s.idTable))
+		s.idTable = nil
+	}
+	if s.compressor != nil {
+		C.sqfs_destroy(unsafe.Pointer(s.compressor))
+		s.compressor = nil
+	}
+	if s.file != nil {
+		C.sqfs_destroy(unsafe.Pointer(s.file))
+		s.file = nil
+	}
+	if s.root != nil {
+		C.sqfs_free(unsafe.Pointer(s.root))
+		s.root = nil
+	}
+	if s.super != nil {
+		C.free(unsafe.Pointer(s.super))
+		s.super = nil
+	}
+	if s.config != nil {
+		C.free(unsafe.Pointer(s.config))
+		s.config = nil
+	}
+	if s.verified != nil {
+		s.verified.Close()
+		s.verified = nil
+	}
 }
 
-func (s *SquashFs) Free() {
-	// TODO: implement
+// Reopen - open the image again, with readers of its own (they can not be shared
+// between goroutines).  An image from OpenVerified or OpenSigned is reopened
+// through its verified descriptor, not by name, so s must not be freed first.
+func (s *SquashFs) Reopen() (SquashFs, error) {
+	return openSquashfs(s.Filename, s.sourceName())
+}
+
+// openImage - open the image file itself, through the verified descriptor if any.
+func (s *SquashFs) openImage(flag int) (*os.File, error) {
+	return os.OpenFile(s.sourceName(), flag, 0)
+}
+
+func (s *SquashFs) sourceName() string {
+	if s.source == "" {
+		return s.Filename
+	}
+	return s.source
 }
 
 func (s *SquashFs) Close() {
@@ -90,7 +159,7 @@ func (s *SquashFs) Walk(root string, walkFn WalkFunc) error {
 	if err != nil {
 		err = walkFn(root, FileInfo{Filename: root}, err)
 	} else {
-		err = walk(root, info, walkFn)
+		err = walk(s, root, info, walkFn)
 	}
 	if err == SkipDir {
 		return nil
@@ -102,13 +171,22 @@ func (s *SquashFs) BytesUsed() uint64 {
 	return uint64(s.super.bytes_used)
 }
 
-func walk(path string, info FileInfo, walkFn WalkFunc) error {
+func (s *SquashFs) readDirNames(info FileInfo) ([]string, error) {
+	return info.File.Readdirnames(0)
+}
+
+// dirLister - what walk needs to descend a tree, implemented by SquashFs and Overlay.
+type dirLister interface {
+	Lstat(string) (FileInfo, error)
+	readDirNames(FileInfo) ([]string, error)
+}
+
+func walk(fsys dirLister, path string, info FileInfo, walkFn WalkFunc) error {
 	if !info.IsDir() {
 		return walkFn(path, info, nil)
 	}
-	sqfs := info.File.SquashFs
 
-	names, err := info.File.Readdirnames(0)
+	names, err := fsys.readDirNames(info)
 	err1 := walkFn(path, info, err)
 	// If err != nil, walk can't walk into this directory.
 	// err1 != nil means walkFn want walk to skip this directory or stop walking.
@@ -123,13 +201,13 @@ func walk(path string, info FileInfo, walkFn WalkFunc) error {
 
 	for _, name := range names {
 		filename := filepath.Join(path, name)
-		fileInfo, err := sqfs.Lstat(filename)
+		fileInfo, err := fsys.Lstat(filename)
 		if err != nil {
 			if err := walkFn(filename, fileInfo, err); err != nil && err != SkipDir {
 				return err
 			}
 		} else {
-			err = walk(filename, fileInfo, walkFn)
+			err = walk(fsys, filename, fileInfo, walkFn)
 			if err != nil {
 				if !fileInfo.IsDir() || err != SkipDir {
 					return err
@@ -340,7 +418,7 @@ func (f *File) Read(b []byte) (int, error) {
 	rlen := C.sqfs_data_reader_read(f.SquashFs.dataReader,
 		f.inode, C.ulong(f.Pos), unsafe.Pointer(&b[0]), C.uint(len(b)))
 	if rlen < 0 {
-		return int(rlen), fmt.Errorf("Error reading from %s. got error code %d", f.Filename, rlen)
+		return int(rlen), fmt.Errorf("Error reading from %s at %d: %s", f.Filename, f.Pos, sqfsErrorString(int(rlen)))
 	}
 
 	f.Pos += int64(rlen)
@@ -579,12 +657,31 @@ func (f *File) Sync() error {
 
 // OpenSquashfs - return a SquashFs struct for fname.
 func OpenSquashfs(fname string) (SquashFs, error) {
+	return openSquashfs(fname, fname)
+}
+
+// openVerified - open the image fname through fp, which was checked and stays
+// open until Free.  fp is closed if the image can not be opened.
+func openVerified(fname string, fp *os.File) (SquashFs, error) {
+	sqfs, err := openSquashfs(fname, fmt.Sprintf("/proc/self/fd/%d", fp.Fd()))
+	if err != nil {
+		fp.Close()
+		return sqfs, err
+	}
+	sqfs.verified = fp
+	return sqfs, nil
+}
+
+// openSquashfs - open the image fname, reading it from source.
+func openSquashfs(fname, source string) (SquashFs, error) {
 	var err error
-	sqfs := SquashFs{Filename: fname}
+	sqfs := SquashFs{Filename: fname, source: source}
 	sqfs.super = (*C.sqfs_super_t)(C.malloc(C.sizeof_sqfs_super_t))
 	sqfs.config = (*C.sqfs_compressor_config_t)(C.malloc(C.sizeof_sqfs_compressor_config_t))
 
-	if sqfs.file, err = C.sqfs_open_file(C.CString(fname), C.SQFS_FILE_OPEN_READ_ONLY); err != nil {
+	csource := C.CString(source)
+	defer C.free(unsafe.Pointer(csource))
+	if sqfs.file, err = C.sqfs_open_file(csource, C.SQFS_FILE_OPEN_READ_ONLY); err != nil {
 		sqfs.Free()
 		return SquashFs{}, fmt.Errorf("failed to open %s: %s", fname, err)
 	}
@@ -643,5 +740,18 @@ func OpenSquashfs(fname string) (SquashFs, error) {
 		return sqfs, fmt.Errorf("error finding root node")
 	}
 
+	/* create a xattr reader, if the image has xattrs.  Without one the rest of
+	   the image can still be read, Xattrs reports why there is none. */
+	if sqfs.super.flags&C.SQFS_FLAG_NO_XATTRS == 0 {
+		sqfs.xattrReader = C.sqfs_xattr_reader_create(0)
+		if sqfs.xattrReader == nil {
+			sqfs.xattrErr = fmt.Errorf("error creating xattr reader")
+		} else if r := C.sqfs_xattr_reader_load(sqfs.xattrReader, sqfs.super, sqfs.file, sqfs.compressor); r != 0 {
+			C.sqfs_destroy(unsafe.Pointer(sqfs.xattrReader))
+			sqfs.xattrReader = nil
+			sqfs.xattrErr = fmt.Errorf("error loading xattr table: %s", sqfsErrorString(int(r)))
+		}
+	}
+
 	return sqfs, nil
 }
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/anuvu/squashfs"
 	"github.com/urfave/cli/v2"
@@ -17,6 +28,10 @@ func printWalker(path string, info squashfs.FileInfo, err error) error {
 	if err != nil {
 		return err
 	}
+	if squashfs.IsOpaque(info) {
+		fmt.Println(info.String() + " (opaque)")
+		return nil
+	}
 	fmt.Println(info.String())
 	return nil
 }
@@ -46,22 +61,443 @@ func listMain(c *cli.Context) error {
 	return err
 }
 
-func extractMain(c *cli.Context) error {
-	var err error
-
-	if c.Args().Len() != 2 {
-		return fmt.Errorf("Expected 2 args (squashfs and out-dir), got %d", c.Args().Len())
+func extractMain(c *cli.Context) (err error) {
+	if c.Args().Len() < 2 {
+		return fmt.Errorf("Expected 2 or more args (squashfs... and out-dir), got %d", c.Args().Len())
 	}
 	args := c.Args().Slice()
-	fname := args[0]
-	outDir := args[1]
+	fnames := args[:len(args)-1]
+	outDir := args[len(args)-1]
 	path := c.String("path")
 
-	s, err := squashfs.OpenSquashfs(fname)
+	digests := c.StringSlice("digest")
+	if len(digests) != 0 && len(digests) != len(fnames) {
+		return fmt.Errorf("Expected one --digest per image (%d), got %d", len(fnames), len(digests))
+	}
+	scope := squashfs.DigestBytesUsed
+	if c.Bool("digest-full") {
+		scope = squashfs.DigestFullFile
+	}
+
+	layers := []squashfs.SquashFs{}
+	for i, fname := range fnames {
+		var s squashfs.SquashFs
+		if len(digests) != 0 {
+			s, err = squashfs.OpenVerified(fname, digests[i], scope)
+		} else {
+			s, err = squashfs.OpenSquashfs(fname)
+		}
+		if err != nil {
+			return fmt.Errorf("error opening squashfs %s: %s", fname, err)
+		}
+		layers = append(layers, s)
+	}
+
+	logger, err := getLogger(c)
 	if err != nil {
-		return fmt.Errorf("error opening squashfs: %s", err)
+		return err
+	}
+
+	whiteOuts, err := squashfs.ParseWhiteOutMode(c.String("whiteouts"))
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Extracting squashfs file %s to %s.", strings.Join(fnames, ", "), outDir)
+
+	format := c.String("format")
+	if format != "dir" && (c.Bool("atomic") || c.Bool("sync") || c.Bool("checksum") ||
+		c.Bool("delete") || c.Bool("dry-run")) {
+		return fmt.Errorf("--format=%s writes a new archive, it cannot be used with "+
+			"--atomic, --sync, --checksum, --delete or --dry-run", format)
+	}
+
+	atomic := c.Bool("atomic")
+	if atomic && (c.Bool("sync") || c.Bool("checksum") || c.Bool("delete")) {
+		return fmt.Errorf("--atomic replaces out-dir, it cannot be used with --sync, --checksum or --delete")
+	}
+	dryRun := c.Bool("dry-run")
+	sync := c.Bool("sync") || c.Bool("checksum")
+	keepGoing := c.Bool("continue-on-error")
+
+	filter, err := getFilter(c)
+	if err != nil {
+		return err
+	}
+
+	limits, err := getLimits(c)
+	if err != nil {
+		return err
+	}
+
+	conflicts, err := squashfs.ParseConflictPolicies(c.StringSlice("conflict"))
+	if err != nil {
+		return err
+	}
+
+	if len(layers) > 1 {
+		if sync || c.Bool("delete") || filter != nil {
+			return fmt.Errorf("--sync, --checksum, --delete and filters work with a single image")
+		}
+		if c.IsSet("whiteouts") && whiteOuts != squashfs.WhiteOutOverlay {
+			return fmt.Errorf("--whiteouts=%s works with a single image, layers always apply their whiteouts", whiteOuts)
+		}
+	}
+
+	// the flags are all checked, create out-dir or the archive.
+	sink, err := newSink(format, outDir)
+	if err != nil {
+		return err
 	}
+	if sink != nil {
+		// closing writes the end of the archive, so only on success.
+		defer func() {
+			if err == nil {
+				err = sink.Close()
+			} else {
+				sink.discard()
+			}
+		}()
+	}
+
+	// with --atomic, out-dir is created by renaming the staging directory, a plan
+	// (--dry-run) starts with its mkdir.
+	if !atomic && !dryRun && format == "dir" {
+		if err = os.Mkdir(outDir, squashfs.DefaultDirPerm); err != nil {
+			if !os.IsExist(err) {
+				return err
+			}
+		}
+	}
+
+	// stop cleanly on interrupt, so permission cleanups still run.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		if _, ok := <-sigs; ok {
+			logger.Info("interrupted, stopping")
+			cancel()
+		}
+	}()
+
+	var progress func(squashfs.Progress)
+	if c.Bool("progress") {
+		bar := &progressBar{out: os.Stderr}
+		defer bar.finish()
+		progress = bar.update
+	}
+
+	if len(layers) > 1 {
+		// layers always apply their whiteouts to the layers below.
+		extractor := squashfs.MultiExtractor{
+			Path:            path,
+			Dir:             outDir,
+			Layers:          layers,
+			Logger:          logger,
+			Owners:          c.Bool("owners"),
+			Perms:           c.Bool("perms"),
+			Devs:            c.Bool("devs"),
+			Sockets:         c.Bool("sockets"),
+			Workers:         c.Int("jobs"),
+			Progress:        progress,
+			Limits:          limits,
+			Atomic:          atomic,
+			Conflicts:       conflicts,
+			BackupSuffix:    c.String("backup-suffix"),
+			ContinueOnError: keepGoing,
+		}
+		if sink != nil {
+			extractor.Sink = sink
+		}
+		if dryRun {
+			steps, err := extractor.Plan()
+			return printPlan(steps, c.Bool("json"), err)
+		}
+		err = extractor.ExtractContext(ctx)
+		if keepGoing {
+			err = extractReport(extractor.Report, err)
+		}
+		return err
+	}
+
+	extractor := squashfs.Extractor{
+		Path:            path,
+		Dir:             outDir,
+		SquashFs:        layers[0],
+		Logger:          logger,
+		Owners:          c.Bool("owners"),
+		Perms:           c.Bool("perms"),
+		Devs:            c.Bool("devs"),
+		Sockets:         c.Bool("sockets"),
+		WhiteOuts:       whiteOuts,
+		Sync:            sync,
+		SyncHash:        c.Bool("checksum"),
+		Delete:          c.Bool("delete"),
+		Workers:         c.Int("jobs"),
+		Progress:        progress,
+		Filter:          filter,
+		Limits:          limits,
+		Atomic:          atomic,
+		Conflicts:       conflicts,
+		BackupSuffix:    c.String("backup-suffix"),
+		ContinueOnError: keepGoing,
+	}
+	if sink != nil {
+		extractor.Sink = sink
+	}
+
+	if dryRun {
+		steps, err := extractor.Plan()
+		return printPlan(steps, c.Bool("json"), err)
+	}
+	err = extractor.ExtractContext(ctx)
+	if keepGoing {
+		err = extractReport(extractor.Report, err)
+	}
+	if err != nil {
+		return err
+	}
+	if sync || extractor.Delete {
+		sum := extractor.Report
+		logger.Info("%d created, %d updated, %d unchanged, %d deleted",
+			sum.Created, sum.Updated, sum.Unchanged, sum.Deleted)
+	}
+	return nil
+}
+
+// outputSink - a squashfs.Sink for extract --format, and what it writes to.
+type outputSink struct {
+	squashfs.Sink
+	out  *os.File
+	name string
+}
 
+// newSink - return the sink for --format, writing to name ("-" is stdout for tar
+// and cpio), or nil for dir.
+func newSink(format, name string) (*outputSink, error) {
+	switch format {
+	case "dir":
+		return nil, nil
+	case "squashfs":
+		sink, err := squashfs.NewSquashfsSink(name, squashfs.WriterOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &outputSink{Sink: sink, name: name}, nil
+	case "tar", "cpio":
+	default:
+		return nil, fmt.Errorf("unknown format '%s': expected dir, tar, cpio or squashfs", format)
+	}
+
+	out := os.Stdout
+	if name != "-" {
+		var err error
+		if out, err = os.Create(name); err != nil {
+			return nil, err
+		}
+	}
+	if format == "tar" {
+		return &outputSink{Sink: squashfs.NewTarSink(out), out: out, name: name}, nil
+	}
+	return &outputSink{Sink: squashfs.NewCpioSink(out), out: out, name: name}, nil
+}
+
+// Close - finish the archive and close the file it went to.
+func (o *outputSink) Close() error {
+	err := o.Sink.Close()
+	if o.out != nil && o.out != os.Stdout {
+		if cerr := o.out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// discard - drop what was written after a failure.
+func (o *outputSink) discard() {
+	if sqfs, ok := o.Sink.(*squashfs.SquashfsSink); ok {
+		sqfs.Discard()
+	} else if o.out != nil && o.out != os.Stdout {
+		o.out.Close()
+		os.Remove(o.name)
+	}
+}
+
+// printPlan - print the steps of a dry run to stdout, one per line, as JSON if asJSON.
+// The steps planned before an error are printed too.
+func printPlan(steps []squashfs.PlanStep, asJSON bool, err error) error {
+	enc := json.NewEncoder(os.Stdout)
+	for _, step := range steps {
+		if !asJSON {
+			fmt.Println(step)
+		} else if encErr := enc.Encode(step); encErr != nil {
+			return encErr
+		}
+	}
+	return err
+}
+
+// extractReport - print what an extraction with --continue-on-error did to stderr,
+// return the error to exit with.
+func extractReport(report squashfs.ExtractReport, err error) error {
+	types := []string{}
+	for typ := range report.Types {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	counts := []string{}
+	for _, typ := range types {
+		counts = append(counts, fmt.Sprintf("%d %s", report.Types[typ], typ))
+	}
+	if len(counts) == 0 {
+		counts = append(counts, "nothing")
+	}
+	fmt.Fprintf(os.Stderr, "extracted: %s, %d bytes\n", strings.Join(counts, ", "), report.Bytes)
+
+	if len(report.Skipped) != 0 {
+		reasons := map[string]int{}
+		names := []string{}
+		for _, skip := range report.Skipped {
+			if reasons[skip.Reason] == 0 {
+				names = append(names, skip.Reason)
+			}
+			reasons[skip.Reason]++
+		}
+		fmt.Fprintf(os.Stderr, "skipped: %d\n", len(report.Skipped))
+		for _, reason := range names {
+			fmt.Fprintf(os.Stderr, "  %d %s\n", reasons[reason], reason)
+		}
+	}
+
+	var failed squashfs.ExtractErrors
+	if !errors.As(err, &failed) {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "failed: %d\n", len(failed))
+	for _, entryErr := range failed {
+		fmt.Fprintf(os.Stderr, "  %s: %s: %s\n", entryErr.Path, entryErr.Op, entryErr.Err)
+	}
+	return cli.Exit(fmt.Sprintf("%d entries failed to extract", len(failed)), 1)
+}
+
+// getFilter - return the extraction filter for the filter flags, nil if there are none.
+func getFilter(c *cli.Context) (*squashfs.Filter, error) {
+	filter := &squashfs.Filter{
+		Include:         c.StringSlice("include"),
+		Exclude:         c.StringSlice("exclude"),
+		IncludeRegex:    c.StringSlice("include-regex"),
+		ExcludeRegex:    c.StringSlice("exclude-regex"),
+		Transforms:      c.StringSlice("transform"),
+		StripComponents: c.Int("strip-components"),
+	}
+	for _, rw := range c.StringSlice("prefix") {
+		toks := strings.SplitN(rw, "=", 2)
+		if len(toks) != 2 {
+			return nil, fmt.Errorf("bad --prefix '%s': expected OLD=NEW", rw)
+		}
+		filter.Prefixes = append(filter.Prefixes, squashfs.PrefixRewrite{From: toks[0], To: toks[1]})
+	}
+	if fname := c.String("files-from"); fname != "" {
+		fp, err := os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		if err := filter.IncludeFile(fp); err != nil {
+			return nil, fmt.Errorf("failed reading %s: %s", fname, err)
+		}
+	}
+
+	if len(filter.Include)+len(filter.Exclude)+len(filter.IncludeRegex)+len(filter.ExcludeRegex)+
+		len(filter.Transforms)+len(filter.Prefixes)+filter.StripComponents == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// getLimits - return the extraction limits for the --max-* and --check-free-space flags.
+func getLimits(c *cli.Context) (squashfs.Limits, error) {
+	limits := squashfs.Limits{
+		Entries:        c.Int64("max-entries"),
+		Depth:          c.Int("max-depth"),
+		PathLength:     c.Int("max-path-length"),
+		CheckFreeSpace: c.Bool("check-free-space"),
+	}
+	for flag, val := range map[string]*int64{
+		"max-bytes":     &limits.TotalBytes,
+		"max-file-size": &limits.FileSize,
+	} {
+		if c.String(flag) == "" {
+			continue
+		}
+		size, err := parseSize(c.String(flag))
+		if err != nil {
+			return limits, fmt.Errorf("bad --%s: %s", flag, err)
+		}
+		*val = size
+	}
+	return limits, nil
+}
+
+// parseSize - parse a size in bytes with an optional K, M, G or T (powers of 1024) suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i != -1 {
+			mult = int64(1) << (10 * uint(i+1))
+			s = s[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("expected a size like 512, 64K, 10M or 2G")
+	}
+	return size * mult, nil
+}
+
+// progressBar - renders squashfs.Progress on a terminal line.
+type progressBar struct {
+	out   io.Writer
+	last  time.Time
+	shown bool
+}
+
+func (b *progressBar) update(p squashfs.Progress) {
+	done := p.Entries == p.TotalEntries && p.Bytes == p.TotalBytes
+	if !done && time.Since(b.last) < 100*time.Millisecond {
+		return
+	}
+	b.last = time.Now()
+	b.shown = true
+
+	const width = 30
+	frac := 1.0
+	if p.TotalBytes > 0 {
+		frac = float64(p.Bytes) / float64(p.TotalBytes)
+	} else if p.TotalEntries > 0 {
+		frac = float64(p.Entries) / float64(p.TotalEntries)
+	}
+	filled := int(frac * width)
+	name := p.Path
+	if len(name) > 40 {
+		name = "..." + name[len(name)-37:]
+	}
+	fmt.Fprintf(b.out, "\r[%s%s] %3.0f%% %d/%d entries %.1f/%.1f MiB %-40s",
+		strings.Repeat("#", filled), strings.Repeat(".", width-filled), frac*100,
+		p.Entries, p.TotalEntries, float64(p.Bytes)/(1<<20), float64(p.TotalBytes)/(1<<20), name)
+}
+
+func (b *progressBar) finish() {
+	if b.shown {
+		fmt.Fprintln(b.out)
+	}
+}
+
+// getLogger - return a logger for the log-level flag.
+func getLogger(c *cli.Context) (squashfs.PrintfLogger, error) {
 	name2level := map[string]int{
 		"quiet":   0,
 		"info":    1,
@@ -69,37 +505,449 @@ func extractMain(c *cli.Context) error {
 		"debug":   3,
 	}
 
-	var level int
-	var ok bool
+	level, ok := name2level[c.String("log-level")]
+	if !ok {
+		return squashfs.PrintfLogger{}, fmt.Errorf("do not know log-level value '%s'. Needs one of: %v",
+			c.String("log-level"), name2level)
+	}
+
+	return squashfs.PrintfLogger{Verbosity: level}, nil
+}
+
+func ociUnpackMain(c *cli.Context) error {
+	if c.Args().Len() != 3 {
+		return fmt.Errorf("Expected 3 args (oci-layout, tag and out-dir), got %d", c.Args().Len())
+	}
+	args := c.Args().Slice()
+
+	logger, err := getLogger(c)
+	if err != nil {
+		return err
+	}
+
+	limits, err := getLimits(c)
+	if err != nil {
+		return err
+	}
+
+	return squashfs.UnpackOCI(args[0], args[1], args[2], squashfs.OCIOptions{
+		Logger:  logger,
+		Owners:  c.Bool("owners"),
+		Perms:   c.Bool("perms"),
+		Devs:    c.Bool("devs"),
+		Sockets: c.Bool("sockets"),
+		Workers: c.Int("jobs"),
+		Limits:  limits,
+	})
+}
+
+// openTree - return a Tree for name, which is either a directory or a squashfs image.
+func openTree(name string) (squashfs.Tree, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return squashfs.DirTree(name), nil
+	}
+	s, err := squashfs.OpenSquashfs(name)
+	if err != nil {
+		return nil, fmt.Errorf("error opening squashfs %s: %s", name, err)
+	}
+	return squashfs.ImageTree{SquashFs: &s}, nil
+}
+
+func diffLayerMain(c *cli.Context) error {
+	if c.Args().Len() != 3 {
+		return fmt.Errorf("Expected 3 args (lower, upper and output squashfs), got %d", c.Args().Len())
+	}
+	args := c.Args().Slice()
+
+	logger, err := getLogger(c)
+	if err != nil {
+		return err
+	}
+
+	lower, err := openTree(args[0])
+	if err != nil {
+		return err
+	}
+	upper, err := openTree(args[1])
+	if err != nil {
+		return err
+	}
+
+	return squashfs.Diff(lower, upper, args[2], squashfs.DiffOptions{
+		Compression: c.String("comp"),
+		Logger:      logger,
+	})
+}
+
+// diffMain - exit 0 if the trees are the same, 1 if they differ and 2 on error (like diff).
+func diffMain(c *cli.Context) error {
+	if c.Args().Len() != 2 {
+		return cli.Exit(fmt.Sprintf("Expected 2 args (two squashfs images), got %d", c.Args().Len()), 2)
+	}
+	args := c.Args().Slice()
+
+	a, err := openTree(args[0])
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+	b, err := openTree(args[1])
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+
+	changes, err := squashfs.Compare(a, b, squashfs.CompareOptions{IgnoreMtime: c.Bool("ignore-mtime")})
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+
+	switch c.String("format") {
+	case "text":
+		for _, change := range changes {
+			fmt.Println(change.String())
+		}
+	case "json":
+		out, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return cli.Exit(err.Error(), 2)
+		}
+		fmt.Println(string(out))
+	default:
+		return cli.Exit(fmt.Sprintf("do not know format '%s'. Needs one of: text, json", c.String("format")), 2)
+	}
+
+	if len(changes) != 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+func toCpioMain(c *cli.Context) (err error) {
+	if c.Args().Len() < 1 || c.Args().Len() > 2 {
+		return fmt.Errorf("Expected 1 or 2 args (squashfs and PATH), got %d", c.Args().Len())
+	}
+	path := c.Args().Get(1)
+	if path == "" {
+		path = "/"
+	}
+
+	logger, err := getLogger(c)
+	if err != nil {
+		return err
+	}
+	compression, err := squashfs.ParseCpioCompression(c.String("compress"))
+	if err != nil {
+		return err
+	}
+	whiteOuts, err := squashfs.ParseWhiteOutMode(c.String("whiteouts"))
+	if err != nil {
+		return err
+	}
+
+	s, err := squashfs.OpenSquashfs(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("error opening squashfs: %s", err)
+	}
+
+	out := os.Stdout
+	if name := c.String("output"); name != "-" {
+		if out, err = os.Create(name); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(name)
+			}
+		}()
+	}
+
+	return squashfs.WriteCpio(s, path, out, squashfs.CpioOptions{
+		Compression: compression,
+		WhiteOuts:   whiteOuts,
+		Logger:      logger,
+	})
+}
+
+func verifyMain(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("Expected 1 arg (squashfs), got %d", c.Args().Len())
+	}
+	fname := c.Args().First()
+
+	logger, err := getLogger(c)
+	if err != nil {
+		return err
+	}
+
+	problems, err := squashfs.VerifyFile(fname, squashfs.VerifyOptions{NoData: c.Bool("no-data"), Logger: logger})
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p.String())
+	}
+	if len(problems) != 0 {
+		return cli.Exit(fmt.Sprintf("%s: %d problems found", fname, len(problems)), 1)
+	}
+	logger.Info("%s: OK", fname)
+	return nil
+}
+
+// verityParams - VerityParams from the verity-format and verity-verify flags.
+func verityParams(c *cli.Context) (squashfs.VerityParams, error) {
+	params := squashfs.VerityParams{
+		DataBlockSize: uint32(c.Uint("data-block-size")),
+		HashBlockSize: uint32(c.Uint("hash-block-size")),
+		NoSuperblock:  c.Bool("no-superblock"),
+	}
+	switch salt := c.String("salt"); salt {
+	case "":
+	case "-":
+		params.Salt = []byte{}
+	default:
+		var err error
+		if params.Salt, err = hex.DecodeString(salt); err != nil {
+			return params, fmt.Errorf("bad salt '%s': %s", salt, err)
+		}
+	}
+	return params, nil
+}
+
+func printVerityInfo(info squashfs.VerityInfo) {
+	fmt.Printf("Root hash:       %x\n", info.RootHash)
+	fmt.Printf("Salt:            %x\n", info.Salt)
+	fmt.Printf("Data blocks:     %d\n", info.DataBlocks)
+	fmt.Printf("Data block size: %d\n", info.DataBlockSize)
+	fmt.Printf("Hash block size: %d\n", info.HashBlockSize)
+	fmt.Printf("Hash offset:     %d\n", info.HashOffset)
+	if !info.NoSuperblock {
+		fmt.Printf("UUID:            %x-%x-%x-%x-%x\n",
+			info.UUID[0:4], info.UUID[4:6], info.UUID[6:8], info.UUID[8:10], info.UUID[10:16])
+	}
+}
+
+func verityFormatMain(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("Expected 1 arg (squashfs), got %d", c.Args().Len())
+	}
+	fname := c.Args().First()
+
+	params, err := verityParams(c)
+	if err != nil {
+		return err
+	}
+
+	s, err := squashfs.OpenSquashfs(fname)
+	if err != nil {
+		return fmt.Errorf("error opening squashfs: %s", err)
+	}
+
+	info, err := squashfs.VerityFormat(&s, params)
+	if err != nil {
+		return err
+	}
+	printVerityInfo(info)
+	return nil
+}
+
+func verityVerifyMain(c *cli.Context) error {
+	if c.Args().Len() != 2 {
+		return fmt.Errorf("Expected 2 args (squashfs, root hash), got %d", c.Args().Len())
+	}
+	fname := c.Args().Get(0)
+
+	root, err := hex.DecodeString(c.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("bad root hash '%s': %s", c.Args().Get(1), err)
+	}
+
+	params, err := verityParams(c)
+	if err != nil {
+		return err
+	}
+
+	s, err := squashfs.OpenSquashfs(fname)
+	if err != nil {
+		return fmt.Errorf("error opening squashfs: %s", err)
+	}
+
+	info, err := squashfs.VerityVerify(&s, root, params)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("%s: %s", fname, err), 1)
+	}
+	if c.Bool("verbose") {
+		printVerityInfo(info)
+	}
+	fmt.Printf("%s: verity OK\n", fname)
+	return nil
+}
+
+func signMain(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("Expected 1 arg (squashfs), got %d", c.Args().Len())
+	}
+	fname := c.Args().First()
+
+	if c.String("key") == "" {
+		return fmt.Errorf("--key is required")
+	}
+	key, err := squashfs.LoadPrivateKey(c.String("key"))
+	if err != nil {
+		return err
+	}
+
+	sig, err := squashfs.SignImage(fname, key)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("embed") {
+		if err := squashfs.WriteSignatureTrailer(fname, sig); err != nil {
+			return err
+		}
+		fmt.Printf("%s: signed with key %s (embedded)\n", fname, sig.KeyID)
+		return nil
+	}
+
+	out := c.String("output")
+	if out == "" {
+		out = fname + ".sig"
+	}
+	content, err := sig.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(out, append(content, '\n'), squashfs.DefaultFilePerm); err != nil {
+		return err
+	}
+	fmt.Printf("%s: signed with key %s, signature in %s\n", fname, sig.KeyID, out)
+	return nil
+}
+
+func verifySigMain(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("Expected 1 arg (squashfs), got %d", c.Args().Len())
+	}
+	fname := c.Args().First()
+
+	if len(c.StringSlice("pub")) == 0 {
+		return fmt.Errorf("--pub is required")
+	}
+	keys, err := squashfs.LoadKeySet(c.StringSlice("pub")...)
+	if err != nil {
+		return err
+	}
+
+	// an explicit --sig, else the embedded signature, else IMAGE.sig.
+	var sig *squashfs.Signature
+	sigFile := c.String("sig")
+	if sigFile == "" {
+		if _, err := squashfs.ReadSignatureTrailer(fname); errors.Is(err, squashfs.ErrNoSignature) {
+			sigFile = fname + ".sig"
+		} else if err != nil {
+			return err
+		}
+	}
+	if sigFile != "" {
+		content, err := ioutil.ReadFile(sigFile)
+		if err != nil {
+			return err
+		}
+		detached, err := squashfs.ParseSignature(content)
+		if err != nil {
+			return fmt.Errorf("%s: %s", sigFile, err)
+		}
+		sig = &detached
+	}
+
+	if err := keys.VerifyImage(fname, sig); err != nil {
+		return cli.Exit(fmt.Sprintf("%s: %s", fname, err), 1)
+	}
+	fmt.Printf("%s: signature OK\n", fname)
+	return nil
+}
+
+func manifestMain(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("Expected 1 arg (squashfs), got %d", c.Args().Len())
+	}
+	fname := c.Args().First()
+
+	write := squashfs.WriteMtree
+	switch c.String("format") {
+	case "mtree":
+		if c.String("digest") == "blake2b" {
+			return fmt.Errorf("--digest blake2b needs --format json, mtree has no keyword for it")
+		}
+	case "json":
+		write = squashfs.WriteManifestJSON
+	default:
+		return fmt.Errorf("do not know format '%s'. Needs one of: mtree, json", c.String("format"))
+	}
+
+	s, err := squashfs.OpenSquashfs(fname)
+	if err != nil {
+		return fmt.Errorf("error opening squashfs: %s", err)
+	}
+
+	entries, err := squashfs.Manifest(&s, c.String("path"),
+		squashfs.ManifestOptions{Digest: c.String("digest"), Workers: c.Int("jobs")})
+	if err != nil {
+		return err
+	}
 
-	if level, ok = name2level[c.String("log-level")]; !ok {
-		return fmt.Errorf("do not know log-level value '%s'. Needs one of: %v",
-			c.String("log-level"), name2level)
+	out := os.Stdout
+	if c.String("output") != "" && c.String("output") != "-" {
+		if out, err = os.Create(c.String("output")); err != nil {
+			return err
+		}
+		defer out.Close()
 	}
+	return write(out, entries)
+}
 
-	logger := squashfs.PrintfLogger{Verbosity: level}
+func checkExtractMain(c *cli.Context) error {
+	if c.Args().Len() != 2 {
+		return cli.Exit(fmt.Sprintf("Expected 2 args (squashfs and dir), got %d", c.Args().Len()), 2)
+	}
+	fname, dir := c.Args().Get(0), c.Args().Get(1)
 
-	logger.Info("Extracting squashfs file %s to %s.", fname, outDir)
+	whiteOuts, err := squashfs.ParseWhiteOutMode(c.String("whiteouts"))
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
 
-	if err = os.Mkdir(outDir, squashfs.DefaultDirPerm); err != nil {
-		if !os.IsExist(err) {
-			return err
-		}
+	s, err := squashfs.OpenSquashfs(fname)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("error opening squashfs: %s", err), 2)
 	}
 
-	extractor := squashfs.Extractor{
-		Path:      path,
-		Dir:       outDir,
-		SquashFs:  s,
-		Logger:    logger,
+	changes, err := squashfs.CompareDir(&s, dir, squashfs.CheckOptions{
+		Path:      c.String("path"),
 		Owners:    c.Bool("owners"),
 		Perms:     c.Bool("perms"),
 		Devs:      c.Bool("devs"),
 		Sockets:   c.Bool("sockets"),
-		WhiteOuts: c.Bool("whiteouts"),
+		Mtimes:    c.Bool("mtimes"),
+		Xattrs:    c.Bool("xattrs"),
+		WhiteOuts: whiteOuts,
+	})
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
 	}
-
-	return extractor.Extract()
+	for _, ch := range changes {
+		fmt.Println(ch.String())
+	}
+	if len(changes) != 0 {
+		return cli.Exit(fmt.Sprintf("%s does not match %s: %d differences", dir, fname, len(changes)), 1)
+	}
+	return nil
 }
 
 func versionMain(c *cli.Context) error {
@@ -198,7 +1046,7 @@ func main() {
 			},
 			&cli.Command{
 				Name:   "extract",
-				Usage:  "extract contents of a squashfs to a directory",
+				Usage:  "extract contents of a squashfs (or a stack of layers, bottom first) to a directory",
 				Action: extractMain,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
@@ -226,10 +1074,287 @@ func main() {
 						Value: false,
 						Usage: "Extract file owners (chown)",
 					},
+					&cli.StringSliceFlag{
+						Name:  "digest",
+						Usage: "Refuse to extract unless the image matches this digest (sha256:hex), once per image",
+					},
+					&cli.BoolFlag{
+						Name:  "digest-full",
+						Value: false,
+						Usage: "The digest covers the whole file, not only the filesystem (bytes_used)",
+					},
+					&cli.IntFlag{
+						Name:    "jobs",
+						Aliases: []string{"j"},
+						Value:   1,
+						Usage:   "Number of files written in parallel",
+					},
+					&cli.StringSliceFlag{
+						Name:  "include",
+						Usage: "Only extract paths matching this glob, and what is below them",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude",
+						Usage: "Do not extract paths matching this glob, or what is below them",
+					},
+					&cli.StringSliceFlag{
+						Name:  "include-regex",
+						Usage: "Only extract paths matching this regular expression",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude-regex",
+						Usage: "Do not extract paths matching this regular expression",
+					},
+					&cli.StringFlag{
+						Name:  "files-from",
+						Usage: "Only extract the paths listed in this file, one per line",
+					},
+					&cli.StringSliceFlag{
+						Name:  "prefix",
+						Usage: "Extract OLD as NEW (OLD=NEW)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "transform",
+						Usage: "Rename paths with a sed s/regex/replacement/flags rule",
+					},
+					&cli.IntFlag{
+						Name:  "strip-components",
+						Value: 0,
+						Usage: "Drop this many leading path components",
+					},
+					&cli.StringFlag{
+						Name:  "max-bytes",
+						Usage: "Fail if the files extracted add up to more than this (K, M, G suffixes)",
+					},
+					&cli.StringFlag{
+						Name:  "max-file-size",
+						Usage: "Fail if a file is larger than this (K, M, G suffixes)",
+					},
+					&cli.Int64Flag{
+						Name:  "max-entries",
+						Usage: "Fail if there are more entries than this",
+					},
+					&cli.IntFlag{
+						Name:  "max-depth",
+						Usage: "Fail if a path has more components than this",
+					},
+					&cli.IntFlag{
+						Name:  "max-path-length",
+						Usage: "Fail if a path is longer than this",
+					},
+					&cli.BoolFlag{
+						Name:  "check-free-space",
+						Value: false,
+						Usage: "Fail before extracting if out-dir has not enough free space",
+					},
+					&cli.BoolFlag{
+						Name:  "progress",
+						Value: false,
+						Usage: "Show a progress bar on stderr",
+					},
+					&cli.StringSliceFlag{
+						Name: "conflict",
+						Usage: "What to do with existing entries in the way: overwrite, keep, error, newer or backup. " +
+							"TYPE=POLICY sets it for one type (dir, file, symlink, char, block, fifo, socket, " +
+							"or whiteout for what whiteouts and opaque directories remove)",
+					},
+					&cli.StringFlag{
+						Name:  "backup-suffix",
+						Value: squashfs.DefaultBackupSuffix,
+						Usage: "Suffix for entries moved out of the way by --conflict=backup",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Value: "dir",
+						Usage: "Write to out-dir as: dir, tar, cpio (newc) or squashfs. " +
+							"For tar and cpio, - is stdout",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Value: false,
+						Usage: "Print what would be done to out-dir, and do nothing",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Value: false,
+						Usage: "With --dry-run, print the steps as JSON, one per line",
+					},
+					&cli.BoolFlag{
+						Name:  "continue-on-error",
+						Value: false,
+						Usage: "Go on past entries that fail, report them at the end and exit 1",
+					},
+					&cli.BoolFlag{
+						Name:  "atomic",
+						Value: false,
+						Usage: "Extract to a staging directory and replace out-dir with it only on success",
+					},
+					&cli.BoolFlag{
+						Name:  "sync",
+						Value: false,
+						Usage: "Leave files that are already in out-dir with the same size and mtime",
+					},
+					&cli.BoolFlag{
+						Name:  "checksum",
+						Value: false,
+						Usage: "Like --sync, but also compare the content of files",
+					},
+					&cli.BoolFlag{
+						Name:  "delete",
+						Value: false,
+						Usage: "Remove what is in out-dir but not in the image",
+					},
+					&cli.StringFlag{
+						Name:  "whiteouts",
+						Value: "skip",
+						Usage: "Handle whiteouts: skip, overlay (apply them), literal (0/0 char devs), aufs (.wh. files)",
+					},
+					&cli.StringFlag{
+						Name:  "log-level",
+						Value: "info",
+						Usage: "Change level of verbosity: quiet, info, verbose, debug",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "oci-unpack",
+				Usage:     "unpack the squashfs layers of an image in an OCI layout to a directory",
+				ArgsUsage: "oci-layout tag out-dir",
+				Action:    ociUnpackMain,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "devs",
+						Value: false,
+						Usage: "Extract devices (mknod)",
+					},
+					&cli.BoolFlag{
+						Name:  "sockets",
+						Value: false,
+						Usage: "Extract sockets (unix domain sockets)",
+					},
+					&cli.BoolFlag{
+						Name:  "perms",
+						Value: false,
+						Usage: "Extract file permissions (chmod)",
+					},
+					&cli.BoolFlag{
+						Name:  "owners",
+						Value: false,
+						Usage: "Extract file owners (chown)",
+					},
+					&cli.IntFlag{
+						Name:    "jobs",
+						Aliases: []string{"j"},
+						Value:   1,
+						Usage:   "Number of files written in parallel",
+					},
+					&cli.StringFlag{
+						Name:  "max-bytes",
+						Usage: "Fail if the files extracted add up to more than this (K, M, G suffixes)",
+					},
+					&cli.StringFlag{
+						Name:  "max-file-size",
+						Usage: "Fail if a file is larger than this (K, M, G suffixes)",
+					},
+					&cli.Int64Flag{
+						Name:  "max-entries",
+						Usage: "Fail if there are more entries than this",
+					},
+					&cli.IntFlag{
+						Name:  "max-depth",
+						Usage: "Fail if a path has more components than this",
+					},
+					&cli.IntFlag{
+						Name:  "max-path-length",
+						Usage: "Fail if a path is longer than this",
+					},
+					&cli.BoolFlag{
+						Name:  "check-free-space",
+						Value: false,
+						Usage: "Fail before extracting if out-dir has not enough free space",
+					},
+					&cli.StringFlag{
+						Name:  "log-level",
+						Value: "info",
+						Usage: "Change level of verbosity: quiet, info, verbose, debug",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "diff-layer",
+				Usage:     "write a squashfs layer with the changes from lower to upper (directories or squashfs images)",
+				ArgsUsage: "lower upper out.squashfs",
+				Action:    diffLayerMain,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "comp",
+						Value: "",
+						Usage: "Compression: gzip (default), lzma, lzo, xz, lz4 or zstd",
+					},
+					&cli.StringFlag{
+						Name:  "log-level",
+						Value: "info",
+						Usage: "Change level of verbosity: quiet, info, verbose, debug",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "diff",
+				Usage:     "show what changed between two squashfs images, exit 1 if they differ",
+				ArgsUsage: "a.squashfs b.squashfs",
+				Action:    diffMain,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Value: "text",
+						Usage: "Output format: text, json",
+					},
 					&cli.BoolFlag{
+						Name:  "ignore-mtime",
+						Value: false,
+						Usage: "Do not report modification time changes",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "to-cpio",
+				Usage:     "write what is below PATH (default /) as a newc cpio archive, for an initramfs",
+				ArgsUsage: "image.squashfs [PATH]",
+				Action:    toCpioMain,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Value:   "-",
+						Usage:   "Write the archive to this file, - is stdout",
+					},
+					&cli.StringFlag{
+						Name:  "compress",
+						Value: "none",
+						Usage: "Compress the archive: none, gzip, zstd (runs zstd)",
+					},
+					&cli.StringFlag{
 						Name:  "whiteouts",
+						Value: "skip",
+						Usage: "Write whiteouts: skip, literal (0/0 char devs), aufs (.wh. files)",
+					},
+					&cli.StringFlag{
+						Name:  "log-level",
+						Value: "info",
+						Usage: "Change level of verbosity: quiet, info, verbose, debug",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "verify",
+				Usage:     "check the integrity of a squashfs image",
+				ArgsUsage: "image.squashfs",
+				Action:    verifyMain,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "no-data",
 						Value: false,
-						Usage: "Apply whiteout files during extraction",
+						Usage: "Check metadata only, do not decompress data blocks",
 					},
 					&cli.StringFlag{
 						Name:  "log-level",
@@ -238,6 +1363,186 @@ func main() {
 					},
 				},
 			},
+			&cli.Command{
+				Name:      "verity-format",
+				Usage:     "append a dm-verity hash tree to a squashfs image",
+				ArgsUsage: "image.squashfs",
+				Action:    verityFormatMain,
+				Flags: []cli.Flag{
+					&cli.UintFlag{
+						Name:  "data-block-size",
+						Value: squashfs.DefaultVerityBlockSize,
+						Usage: "Size of the data blocks the tree hashes",
+					},
+					&cli.UintFlag{
+						Name:  "hash-block-size",
+						Value: squashfs.DefaultVerityBlockSize,
+						Usage: "Size of the hash tree blocks",
+					},
+					&cli.StringFlag{
+						Name:  "salt",
+						Value: "",
+						Usage: "Salt as hex, '-' for none (default random)",
+					},
+					&cli.BoolFlag{
+						Name:  "no-superblock",
+						Value: false,
+						Usage: "The hash area has no veritysetup superblock",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "verity-verify",
+				Usage:     "check the dm-verity hash tree of a squashfs image",
+				ArgsUsage: "image.squashfs root-hash",
+				Action:    verityVerifyMain,
+				Flags: []cli.Flag{
+					&cli.UintFlag{
+						Name:  "data-block-size",
+						Value: squashfs.DefaultVerityBlockSize,
+						Usage: "Size of the data blocks the tree hashes (with --no-superblock)",
+					},
+					&cli.UintFlag{
+						Name:  "hash-block-size",
+						Value: squashfs.DefaultVerityBlockSize,
+						Usage: "Size of the hash tree blocks (with --no-superblock)",
+					},
+					&cli.StringFlag{
+						Name:  "salt",
+						Value: "",
+						Usage: "Salt as hex, '-' for none (needed with --no-superblock)",
+					},
+					&cli.BoolFlag{
+						Name:  "no-superblock",
+						Value: false,
+						Usage: "The hash area has no veritysetup superblock, --salt is needed",
+					},
+					&cli.BoolFlag{
+						Name:  "verbose",
+						Value: false,
+						Usage: "Print the verity parameters",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "sign",
+				Usage:     "sign a squashfs image with an ed25519 key",
+				ArgsUsage: "image.squashfs",
+				Action:    signMain,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "key",
+						Usage: "PEM ed25519 private key (openssl genpkey -algorithm ed25519)",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Write the detached signature here (default IMAGE.sig)",
+					},
+					&cli.BoolFlag{
+						Name:  "embed",
+						Value: false,
+						Usage: "Embed the signature as a trailer in the image instead",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "verify-sig",
+				Usage:     "check the signature of a squashfs image",
+				ArgsUsage: "image.squashfs",
+				Action:    verifySigMain,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "pub",
+						Usage: "PEM ed25519 public key to trust, may be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "sig",
+						Usage: "Detached signature (default the embedded one, then IMAGE.sig)",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "manifest",
+				Usage:     "print a record with metadata and digest for every entry in a squashfs image",
+				ArgsUsage: "image.squashfs",
+				Action:    manifestMain,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "path",
+						Value: "/",
+						Usage: "Only list this path and below",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Value: "mtree",
+						Usage: "Output format: mtree or json (one object per line)",
+					},
+					&cli.StringFlag{
+						Name:  "digest",
+						Value: "sha256",
+						Usage: "Content digest: sha256, sha512, blake2b (json only) or none",
+					},
+					&cli.IntFlag{
+						Name:    "jobs",
+						Aliases: []string{"j"},
+						Value:   0,
+						Usage:   "Number of files hashed in parallel (default number of CPUs)",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Value: "-",
+						Usage: "Write the manifest to this file",
+					},
+				},
+			},
+			&cli.Command{
+				Name:      "check-extract",
+				Usage:     "check that a directory matches what extract gives for a squashfs image",
+				ArgsUsage: "image.squashfs dir",
+				Action:    checkExtractMain,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "path",
+						Value: "/",
+						Usage: "The --path given to extract",
+					},
+					&cli.BoolFlag{
+						Name:  "devs",
+						Value: false,
+						Usage: "Devices were extracted",
+					},
+					&cli.BoolFlag{
+						Name:  "sockets",
+						Value: false,
+						Usage: "Sockets were extracted",
+					},
+					&cli.StringFlag{
+						Name:  "whiteouts",
+						Value: "skip",
+						Usage: "The --whiteouts given to extract: skip, overlay, literal or aufs",
+					},
+					&cli.BoolFlag{
+						Name:  "perms",
+						Value: false,
+						Usage: "Check file permissions",
+					},
+					&cli.BoolFlag{
+						Name:  "owners",
+						Value: false,
+						Usage: "Check file owners",
+					},
+					&cli.BoolFlag{
+						Name:  "mtimes",
+						Value: false,
+						Usage: "Check modification times",
+					},
+					&cli.BoolFlag{
+						Name:  "xattrs",
+						Value: false,
+						Usage: "Check extended attributes",
+					},
+				},
+			},
 		},
 	}
 
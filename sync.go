@@ -0,0 +1,113 @@
+package squashfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// unchanged - is what is at path in e.Dir the same as info, so it can be left alone.
+// Regular files must match in size and mtime, and in content if e.SyncHash.
+func (e *Extractor) unchanged(path string, info FileInfo) (bool, error) {
+	fpath := filepath.Join(e.Dir, path)
+	st, err := e.view().Lstat(fpath)
+	if err != nil {
+		return false, nil
+	}
+
+	if fileType(st.Mode()) != fileType(info.FMode) {
+		return false, nil
+	}
+
+	switch fileType(info.FMode) {
+	case "file":
+		if st.Size() != info.FSize || st.ModTime().Unix() != info.FModTime.Unix() {
+			return false, nil
+		}
+		if !e.SyncHash {
+			return true, nil
+		}
+		return e.sameHash(fpath, info)
+	case "symlink":
+		target, err := os.Readlink(fpath)
+		return err == nil && target == info.SymlinkTarget, nil
+	case "char", "block":
+		diskStat, ok := st.Sys().(*syscall.Stat_t)
+		return ok && uint64(diskStat.Rdev) == info.Sys().(syscall.Stat_t).Rdev, nil
+	}
+	return true, nil
+}
+
+// sameHash - compare the sha256 of the file at fpath with that of info.
+func (e *Extractor) sameHash(fpath string, info FileInfo) (bool, error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return false, nil
+	}
+	defer fp.Close()
+
+	diskSum := sha256.New()
+	if _, err := io.Copy(diskSum, fp); err != nil {
+		return false, err
+	}
+	imageSum := sha256.New()
+	if _, err := io.Copy(imageSum, info.File); err != nil {
+		return false, err
+	}
+	// rewind, the file is extracted from the same File if it differs.
+	info.File.Pos = 0
+
+	return bytes.Equal(diskSum.Sum(nil), imageSum.Sum(nil)), nil
+}
+
+// deleteExtras - remove everything below where e.Path was extracted in e.Dir that was
+// not extracted, except what e.Filter left out.
+func (e *Extractor) deleteExtras() error {
+	root := e.Path
+	if e.Filter != nil {
+		var ok bool
+		if root, ok = e.Filter.rename(e.Path); !ok {
+			// what is below e.Path lands directly in e.Dir.
+			root = "/"
+		}
+	}
+	return filepath.Walk(filepath.Join(e.Dir, root), func(fpath string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(e.Dir, fpath)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join("/", rel)
+		if e.seen[path] || path == root {
+			return nil
+		}
+		if below, ok := e.kept[path]; ok {
+			if below && finfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		e.Logger.Verbose("delete %s", path)
+		cleanup, err := e.prepParent(fpath)
+		if err == nil {
+			err = e.Ops.RemoveAll(fpath)
+		}
+		if cerr := cleanup(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		e.recordSync(&e.Report.Deleted)
+		if finfo.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package squashfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDeleteWithFilter(t *testing.T) {
+	d := tempDir(t)
+	sqfs := writeTestImage(t, filepath.Join(d, "image.squashfs"), []testEntry{
+		tdir("/"),
+		tdir("/usr"),
+		tdir("/usr/bin"),
+		tfile("/usr/bin/a", "a"),
+		tfile("/usr/bin/skip.log", "log"),
+		tchar("/usr/bin/null", 1, 3),
+	})
+	defer sqfs.Free()
+
+	dir := filepath.Join(d, "out")
+	for _, p := range []string{"bin/skip.log", "bin/stale", "bin/null", "other"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), DefaultDirPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, p), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/usr", Delete: true, Logger: PrintfLogger{},
+		Filter: &Filter{StripComponents: 1, Exclude: []string{"*.log"}}}
+	if err := e.Extract(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the excluded log stays, the device that was not extracted does not count as there.
+	want := []string{"/", "/bin", "/bin/a", "/bin/skip.log"}
+	got := treePaths(t, dir)
+	sort.Strings(want)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("tree is %v, want %v", got, want)
+	}
+	checkSyncCounts(t, e.Report, [4]int{1, 0, 1, 3})
+}
+
+// checkSyncCounts - check the created, updated, unchanged and deleted counts of report.
+func checkSyncCounts(t *testing.T, report ExtractReport, want [4]int) {
+	t.Helper()
+	if got := [4]int{report.Created, report.Updated, report.Unchanged, report.Deleted}; got != want {
+		t.Errorf("created, updated, unchanged, deleted are %v, want %v", got, want)
+	}
+}
+
+func TestSync(t *testing.T) {
+	d := tempDir(t)
+	sqfs := writeTestImage(t, filepath.Join(d, "image.squashfs"), []testEntry{
+		tdir("/"),
+		tfile("/a", "aaa"),
+		tfile("/b", "bbb"),
+	})
+	defer sqfs.Free()
+
+	dir := filepath.Join(d, "out")
+	if err := os.Mkdir(dir, DefaultDirPerm); err != nil {
+		t.Fatal(err)
+	}
+	sync := func(hash bool) ExtractReport {
+		t.Helper()
+		e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/", Sync: true, SyncHash: hash, Logger: PrintfLogger{}}
+		if err := e.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		return e.Report
+	}
+	write := func(name, content string) {
+		t.Helper()
+		fpath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fpath, testModTime, testModTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := func(name string) string {
+		t.Helper()
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	checkSyncCounts(t, sync(false), [4]int{2, 0, 1, 0})
+
+	// same size and mtime passes for unchanged, another size does not.
+	write("a", "xyz")
+	write("b", "bb")
+	checkSyncCounts(t, sync(false), [4]int{0, 1, 2, 0})
+	if got := content("a"); got != "xyz" {
+		t.Errorf("/a with the same size and mtime was written: %q", got)
+	}
+	if got := content("b"); got != "bbb" {
+		t.Errorf("/b with another size was not written: %q", got)
+	}
+
+	// the content is compared with SyncHash, and the file is extracted from the
+	// start after hashing it.
+	checkSyncCounts(t, sync(true), [4]int{0, 1, 2, 0})
+	if got := content("a"); got != "aaa" {
+		t.Errorf("/a changed in place was not written whole with SyncHash: %q", got)
+	}
+}
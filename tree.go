@@ -0,0 +1,306 @@
+package squashfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Tree - a directory tree to compare, either a DirTree or an ImageTree.
+type Tree interface {
+	// Entries - return every entry in the tree keyed by absolute path ("/", "/etc", ...)
+	Entries() (map[string]TreeEntry, error)
+	// Open - open the regular file at path for reading.
+	Open(path string) (io.ReadCloser, error)
+}
+
+// TreeEntry - the metadata of an entry in a Tree.
+type TreeEntry struct {
+	Path       string
+	Mode       os.FileMode
+	Uid        uint32
+	Gid        uint32
+	Size       int64
+	ModTime    time.Time
+	LinkTarget string
+	Rdev       uint64
+	Xattrs     map[string]string
+	// Ino - the inode number, entries of a Tree with the same non zero Ino are hard links.
+	Ino uint64
+}
+
+// Type - return the type of the entry: dir, file, symlink, char, block, fifo or socket.
+func (t TreeEntry) Type() string {
+	return fileType(t.Mode)
+}
+
+// DirTree - a Tree for a directory on disk.
+type DirTree string
+
+// ImageTree - a Tree for a squashfs image.
+type ImageTree struct {
+	SquashFs *SquashFs
+}
+
+// Entries - Tree.Entries for a directory.
+func (d DirTree) Entries() (map[string]TreeEntry, error) {
+	root := string(d)
+	entries := map[string]TreeEntry{}
+	err := filepath.Walk(root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return err
+		}
+		p := filepath.Join("/", rel)
+
+		mode := info.Mode()
+		if mode&os.ModeCharDevice != 0 {
+			// squashfs char devices do not carry ModeDevice, do the same here.
+			mode &^= os.ModeDevice
+		}
+		ent := TreeEntry{
+			Path:    p,
+			Mode:    mode,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			ent.Uid = stat.Uid
+			ent.Gid = stat.Gid
+			ent.Rdev = uint64(stat.Rdev)
+			ent.Ino = stat.Ino
+		}
+		if mode&os.ModeSymlink != 0 {
+			if ent.LinkTarget, err = os.Readlink(fpath); err != nil {
+				return err
+			}
+		}
+		if ent.Xattrs, err = diskXattrs(fpath); err != nil {
+			return err
+		}
+		entries[p] = ent
+		return nil
+	})
+	return entries, err
+}
+
+// Open - Tree.Open for a directory.
+func (d DirTree) Open(path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), path))
+}
+
+// Entries - Tree.Entries for a squashfs image.
+func (i ImageTree) Entries() (map[string]TreeEntry, error) {
+	entries := map[string]TreeEntry{}
+	err := i.SquashFs.Walk("/", func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat := info.Sys().(syscall.Stat_t)
+		xattrs, err := info.File.Xattrs()
+		if err != nil {
+			return err
+		}
+		entries[p] = TreeEntry{
+			Path:       p,
+			Mode:       info.FMode,
+			Uid:        stat.Uid,
+			Gid:        stat.Gid,
+			Size:       info.FSize,
+			ModTime:    info.FModTime,
+			LinkTarget: info.SymlinkTarget,
+			Rdev:       stat.Rdev,
+			Xattrs:     xattrs,
+			Ino:        stat.Ino,
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Open - Tree.Open for a squashfs image.
+func (i ImageTree) Open(path string) (io.ReadCloser, error) {
+	f, err := i.SquashFs.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return imageReader{f}, nil
+}
+
+// imageReader - io.ReadCloser for a File, whose Close always reports ErrNotImplemented.
+type imageReader struct {
+	*File
+}
+
+func (r imageReader) Close() error {
+	r.File.Close()
+	return nil
+}
+
+// diskXattrs - return the extended attributes of the file at path (not following symlinks).
+func diskXattrs(path string) (map[string]string, error) {
+	xattrs := map[string]string{}
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return xattrs, nil
+	} else if err != nil {
+		return xattrs, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return xattrs, err
+	}
+	for _, key := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		vsize, err := unix.Lgetxattr(path, key, nil)
+		if err != nil {
+			return xattrs, err
+		}
+		val := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(path, key, val); err != nil {
+			return xattrs, err
+		}
+		xattrs[key] = string(val[:vsize])
+	}
+	return xattrs, nil
+}
+
+// fileType - return the type of mode: dir, file, symlink, char, block, fifo or socket.
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeDir != 0:
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeCharDevice != 0:
+		return "char"
+	case mode&os.ModeDevice != 0:
+		return "block"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode.IsRegular():
+		return "file"
+	}
+	return "irregular"
+}
+
+// unixPerms - return the permission bits of mode including setuid, setgid and sticky.
+func unixPerms(mode os.FileMode) uint32 {
+	perms := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perms |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		perms |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		perms |= syscall.S_ISVTX
+	}
+	return perms
+}
+
+// compareEntries - return the names of the fields that differ between a and b:
+// type, mode, owner, mtime, xattr, target (symlinks), device and content.
+// Content of regular files is compared by size and then by sha256 of the data.
+func compareEntries(at Tree, a TreeEntry, bt Tree, b TreeEntry, ignoreMtime bool) ([]string, error) {
+	changes := []string{}
+	if a.Type() != b.Type() {
+		return []string{"type"}, nil
+	}
+	if a.Mode.Perm()|a.Mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) !=
+		b.Mode.Perm()|b.Mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) {
+		changes = append(changes, "mode")
+	}
+	if a.Uid != b.Uid || a.Gid != b.Gid {
+		changes = append(changes, "owner")
+	}
+	// squashfs keeps seconds only.
+	if !ignoreMtime && a.ModTime.Unix() != b.ModTime.Unix() {
+		changes = append(changes, "mtime")
+	}
+	if !sameXattrs(a.Xattrs, b.Xattrs) {
+		changes = append(changes, "xattr")
+	}
+	switch a.Type() {
+	case "symlink":
+		if a.LinkTarget != b.LinkTarget {
+			changes = append(changes, "target")
+		}
+	case "char", "block":
+		if unix.Major(a.Rdev) != unix.Major(b.Rdev) || unix.Minor(a.Rdev) != unix.Minor(b.Rdev) {
+			changes = append(changes, "device")
+		}
+	case "file":
+		same := a.Size == b.Size
+		if same {
+			var err error
+			if same, err = sameContent(at, a.Path, bt, b.Path); err != nil {
+				return changes, err
+			}
+		}
+		if !same {
+			changes = append(changes, "content")
+		}
+	}
+	return changes, nil
+}
+
+func sameXattrs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sameContent - compare the sha256 of the file apath in at and bpath in bt.
+func sameContent(at Tree, apath string, bt Tree, bpath string) (bool, error) {
+	asum, err := treeFileSum(at, apath)
+	if err != nil {
+		return false, err
+	}
+	bsum, err := treeFileSum(bt, bpath)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(asum, bsum), nil
+}
+
+func treeFileSum(t Tree, path string) ([]byte, error) {
+	r, err := t.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// sortedPaths - return the keys of entries in sorted order, so parents come before children.
+func sortedPaths(entries map[string]TreeEntry) []string {
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
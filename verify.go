@@ -0,0 +1,620 @@
+package squashfs
+
+// #cgo pkg-config: libsquashfs1
+// #include <stdlib.h>
+// #include <sqfs/predef.h>
+// #include <sqfs/error.h>
+// #include <sqfs/super.h>
+// #include <sqfs/inode.h>
+// #include <sqfs/dir.h>
+// #include <sqfs/dir_reader.h>
+// #include <sqfs/data_reader.h>
+// #include <sqfs/meta_reader.h>
+// #include <sqfs/id_table.h>
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"unsafe"
+)
+
+const (
+	// metaBlockSize - uncompressed size of a metadata block.
+	metaBlockSize = 8192
+	// noTable - table start of tables that are not in the image.
+	noTable = 0xFFFFFFFFFFFFFFFF
+	// noFragment - fragment index of files without a fragment.
+	noFragment = 0xFFFFFFFF
+	// blockSizeMask - the on-disk size bits of a data block size.
+	blockSizeMask = 0x00FFFFFF
+	// maxDirDepth - deeper directories are reported as a loop.
+	maxDirDepth = 1024
+)
+
+// Problem - something wrong found by Verify.  Offset is the byte offset in the
+// image where the problem is, or -1 if it is not known.
+type Problem struct {
+	Path    string
+	Offset  int64
+	Message string
+}
+
+func (p Problem) String() string {
+	where := p.Path
+	if where == "" {
+		where = "(image)"
+	}
+	if p.Offset >= 0 {
+		return fmt.Sprintf("%s @%d: %s", where, p.Offset, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", where, p.Message)
+}
+
+// VerifyOptions - options for Verify.
+type VerifyOptions struct {
+	// NoData - do not decompress data blocks and fragments, metadata only.
+	NoData bool
+	Logger Logger
+}
+
+// superBlock - the on-disk squashfs superblock, read from the file before the
+// image is opened so a damaged one is reported instead of failing the open.
+type superBlock struct {
+	Magic             uint32
+	InodeCount        uint32
+	ModTime           uint32
+	BlockSize         uint32
+	FragmentCount     uint32
+	Compression       uint16
+	BlockLog          uint16
+	Flags             uint16
+	IDCount           uint16
+	VersionMajor      uint16
+	VersionMinor      uint16
+	RootInodeRef      uint64
+	BytesUsed         uint64
+	IDTableStart      uint64
+	XattrIDTableStart uint64
+	InodeTableStart   uint64
+	DirTableStart     uint64
+	FragTableStart    uint64
+	ExportTableStart  uint64
+}
+
+// readSuperBlock - read the superblock at the start of r.
+func readSuperBlock(r io.ReaderAt) (superBlock, error) {
+	var super superBlock
+	err := binary.Read(io.NewSectionReader(r, 0, superSize), binary.LittleEndian, &super)
+	return super, err
+}
+
+// verifier - state of a Verify run.
+type verifier struct {
+	sqfs     *SquashFs
+	opts     VerifyOptions
+	image    *os.File
+	size     int64
+	super    superBlock
+	problems []Problem
+	inodes   map[uint32]bool
+}
+
+// Verify - check the whole image: the superblock against the file size, every
+// metadata block, every data block and fragment, and that directory entries,
+// inodes and the ID table agree.  The problems found are returned; the error
+// is only set when the image could not be checked at all.
+func Verify(sqfs *SquashFs, opts VerifyOptions) ([]Problem, error) {
+	v, err := newVerifier(sqfs.Filename, sqfs.sourceName(), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer v.image.Close()
+
+	if !v.verifySuper() {
+		// table positions can not be trusted, reading them would only add noise.
+		return v.problems, nil
+	}
+	v.sqfs = sqfs
+	v.verifyTables()
+	return v.problems, nil
+}
+
+// VerifyFile - Verify the image fname.  The superblock is checked against the
+// file before the image is opened, and an image that can not be opened is
+// reported as a Problem, so truncated and corrupted images are described
+// rather than failing with an error.
+func VerifyFile(fname string, opts VerifyOptions) ([]Problem, error) {
+	v, err := newVerifier(fname, fname, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer v.image.Close()
+
+	if !v.verifySuper() {
+		return v.problems, nil
+	}
+
+	// open through the descriptor that was checked, not the name.
+	sqfs, err := OpenSquashfs(fmt.Sprintf("/proc/self/fd/%d", v.image.Fd()))
+	if err != nil {
+		v.problem("", -1, "cannot open image: %s", err)
+		return v.problems, nil
+	}
+	defer sqfs.Free()
+	sqfs.Filename = fname
+
+	v.sqfs = &sqfs
+	v.verifyTables()
+	return v.problems, nil
+}
+
+// newVerifier - a verifier of the image fname, read from source.
+func newVerifier(fname, source string, opts VerifyOptions) (*verifier, error) {
+	if opts.Logger == nil {
+		opts.Logger = PrintfLogger{}
+	}
+	image, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := image.Stat()
+	if err != nil {
+		image.Close()
+		return nil, err
+	}
+
+	v := &verifier{opts: opts, image: image, size: fi.Size(), inodes: map[uint32]bool{}}
+	opts.Logger.Verbose("verifying superblock of %s", fname)
+	return v, nil
+}
+
+// verifyTables - check the metadata blocks and the directory tree of the opened image.
+func (v *verifier) verifyTables() {
+	v.opts.Logger.Verbose("verifying metadata blocks")
+	v.verifyMetaBlocks()
+
+	v.opts.Logger.Verbose("verifying directory tree")
+	v.verifyInode("/", v.sqfs.root, 0)
+
+	if n := uint32(len(v.inodes)); n != uint32(v.sqfs.super.inode_count) {
+		v.problem("", -1, "found %d inodes, superblock says %d", n, v.sqfs.super.inode_count)
+	}
+}
+
+func (v *verifier) problem(p string, offset int64, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	v.opts.Logger.Debug("problem: %s @%d: %s", p, offset, msg)
+	v.problems = append(v.problems, Problem{Path: p, Offset: offset, Message: msg})
+}
+
+// verifySuper - check the superblock, return false if the tables can not be read.
+func (v *verifier) verifySuper() bool {
+	if v.size < superSize {
+		v.problem("", 0, "truncated: the file has %d bytes, too short for a superblock", v.size)
+		return false
+	}
+	super, err := readSuperBlock(v.image)
+	if err != nil {
+		v.problem("", 0, "cannot read superblock: %s", err)
+		return false
+	}
+	v.super = super
+	if super.Magic != superMagic {
+		v.problem("", 0, "bad superblock magic %#x, not a squashfs image", super.Magic)
+		return false
+	}
+
+	used := super.BytesUsed
+	ok := true
+
+	if int64(used) > v.size {
+		v.problem("", superBytesUsedOffset, "truncated: bytes_used is %d but the file has %d bytes", used, v.size)
+		ok = false
+	}
+	if super.VersionMajor != 4 || super.VersionMinor != 0 {
+		v.problem("", 0, "unsupported version %d.%d", super.VersionMajor, super.VersionMinor)
+		ok = false
+	}
+	bs := super.BlockSize
+	if bs < C.SQFS_MIN_BLOCK_SIZE || bs > C.SQFS_MAX_BLOCK_SIZE || bs&(bs-1) != 0 {
+		v.problem("", 0, "invalid block size %d", bs)
+		ok = false
+	} else if 1<<uint(super.BlockLog) != bs {
+		v.problem("", 0, "block_log %d does not match block size %d", super.BlockLog, bs)
+	}
+
+	tables := []struct {
+		name  string
+		start uint64
+	}{
+		{"inode table", super.InodeTableStart},
+		{"directory table", super.DirTableStart},
+		{"fragment table", super.FragTableStart},
+		{"export table", super.ExportTableStart},
+		{"id table", super.IDTableStart},
+		{"xattr id table", super.XattrIDTableStart},
+	}
+	for _, t := range tables {
+		if t.start != noTable && t.start >= used {
+			v.problem("", 0, "%s starts at %d, past bytes_used %d", t.name, t.start, used)
+			ok = false
+		}
+	}
+	if super.InodeTableStart >= super.DirTableStart {
+		v.problem("", 0, "inode table (%d) does not come before directory table (%d)",
+			super.InodeTableStart, super.DirTableStart)
+		ok = false
+	}
+
+	rootBlock := super.RootInodeRef >> 16
+	rootOffset := super.RootInodeRef & 0xFFFF
+	if rootOffset >= metaBlockSize || super.InodeTableStart+rootBlock >= super.DirTableStart {
+		v.problem("/", 0, "root inode reference %#x is outside the inode table", super.RootInodeRef)
+		ok = false
+	}
+
+	return ok
+}
+
+// readU64 - read a little endian uint64 at offset of the image.
+func (v *verifier) readU64(offset uint64) (uint64, error) {
+	b := make([]byte, 8)
+	if _, err := v.image.ReadAt(b, int64(offset)); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// verifyMetaBlocks - decompress every metadata block of every table.
+func (v *verifier) verifyMetaBlocks() {
+	super := v.sqfs.super
+	used := uint64(super.bytes_used)
+
+	m := C.sqfs_meta_reader_create(v.sqfs.file, v.sqfs.compressor, 0, C.sqfs_u64(used))
+	if m == nil {
+		v.problem("", -1, "failed to create a metadata reader")
+		return
+	}
+	defer C.sqfs_destroy(unsafe.Pointer(m))
+
+	// the directory table ends where the metadata of the next table starts.
+	dirEnd := used
+	lookups := []struct {
+		name    string
+		start   uint64
+		entries uint64
+		size    uint64
+	}{
+		{"fragment table", uint64(super.fragment_table_start), uint64(super.fragment_entry_count), 16},
+		{"export table", uint64(super.export_table_start), uint64(super.inode_count), 8},
+		{"id table", uint64(super.id_table_start), uint64(super.id_count), 4},
+	}
+	for _, t := range lookups {
+		if t.start == noTable || t.entries == 0 {
+			continue
+		}
+		nblocks := (t.entries*t.size + metaBlockSize - 1) / metaBlockSize
+		for i := uint64(0); i < nblocks; i++ {
+			loc, err := v.readU64(t.start + i*8)
+			if err != nil {
+				v.problem("", int64(t.start+i*8), "%s: cannot read block location: %s", t.name, err)
+				continue
+			}
+			if i == 0 && loc > uint64(super.directory_table_start) && loc < dirEnd {
+				dirEnd = loc
+			}
+			v.verifyMetaBlock(m, t.name, loc)
+		}
+	}
+
+	if xstart := uint64(super.xattr_id_table_start); xstart != noTable && super.flags&C.SQFS_FLAG_NO_XATTRS == 0 {
+		kvStart, err := v.readU64(xstart)
+		if err != nil {
+			v.problem("", int64(xstart), "xattr id table: cannot read header: %s", err)
+		} else {
+			if kvStart > uint64(super.directory_table_start) && kvStart < dirEnd {
+				dirEnd = kvStart
+			}
+			v.verifyMetaRegion(m, "xattr table", kvStart, xstart)
+		}
+	}
+
+	v.verifyMetaRegion(m, "inode table", uint64(super.inode_table_start), uint64(super.directory_table_start))
+	v.verifyMetaRegion(m, "directory table", uint64(super.directory_table_start), dirEnd)
+}
+
+// verifyMetaRegion - decompress the consecutive metadata blocks in [start, end).
+func (v *verifier) verifyMetaRegion(m *C.sqfs_meta_reader_t, name string, start, end uint64) {
+	hdr := make([]byte, 2)
+	for off := start; off < end; {
+		if _, err := v.image.ReadAt(hdr, int64(off)); err != nil {
+			v.problem("", int64(off), "%s: cannot read metadata block header: %s", name, err)
+			return
+		}
+		size := uint64(binary.LittleEndian.Uint16(hdr) & 0x7FFF)
+		if size == 0 || size > metaBlockSize {
+			v.problem("", int64(off), "%s: invalid metadata block size %d", name, size)
+			return
+		}
+		if !v.verifyMetaBlock(m, name, off) {
+			return
+		}
+		off += 2 + size
+	}
+}
+
+// verifyMetaBlock - decompress the metadata block at offset.
+func (v *verifier) verifyMetaBlock(m *C.sqfs_meta_reader_t, name string, offset uint64) bool {
+	if offset >= uint64(v.sqfs.super.bytes_used) {
+		v.problem("", int64(offset), "%s: metadata block past bytes_used", name)
+		return false
+	}
+	if r := C.sqfs_meta_reader_seek(m, C.sqfs_u64(offset), 0); r != 0 {
+		v.problem("", int64(offset), "%s: cannot decompress metadata block: %s", name, sqfsErrorString(int(r)))
+		return false
+	}
+	return true
+}
+
+// inodeBasicType - the basic inode type of t (extended types map to the basic one).
+func inodeBasicType(t C.sqfs_u16) C.sqfs_u16 {
+	if t > C.SQFS_INODE_SOCKET {
+		return t - C.SQFS_INODE_SOCKET
+	}
+	return t
+}
+
+// dirBlockOffset - image offset of the listing of the directory inode.
+func (v *verifier) dirBlockOffset(inode *C.sqfs_inode_generic_t) int64 {
+	dataPtr := unsafe.Pointer(&inode.data)
+	start := uint64(v.sqfs.super.directory_table_start)
+	switch inode.base._type {
+	case C.SQFS_INODE_DIR:
+		return int64(start + uint64((*C.sqfs_inode_dir_t)(dataPtr).start_block))
+	case C.SQFS_INODE_EXT_DIR:
+		return int64(start + uint64((*C.sqfs_inode_dir_ext_t)(dataPtr).start_block))
+	}
+	return -1
+}
+
+// verifyInode - check inode at p, and what it refers to.
+func (v *verifier) verifyInode(p string, inode *C.sqfs_inode_generic_t, depth int) {
+	num := uint32(inode.base.inode_number)
+	if num == 0 || num > uint32(v.sqfs.super.inode_count) {
+		v.problem(p, -1, "inode number %d out of range 1-%d", num, v.sqfs.super.inode_count)
+	}
+	seen := v.inodes[num]
+	v.inodes[num] = true
+
+	var id C.sqfs_u32
+	if r := C.sqfs_id_table_index_to_id(v.sqfs.idTable, inode.base.uid_idx, &id); r != 0 {
+		v.problem(p, -1, "uid index %d not in id table (%d ids)", inode.base.uid_idx, v.sqfs.super.id_count)
+	}
+	if r := C.sqfs_id_table_index_to_id(v.sqfs.idTable, inode.base.gid_idx, &id); r != 0 {
+		v.problem(p, -1, "gid index %d not in id table (%d ids)", inode.base.gid_idx, v.sqfs.super.id_count)
+	}
+
+	switch inode.base._type {
+	case C.SQFS_INODE_DIR, C.SQFS_INODE_EXT_DIR:
+		if seen {
+			v.problem(p, v.dirBlockOffset(inode), "directory inode %d is linked more than once", num)
+			return
+		}
+		if depth >= maxDirDepth {
+			v.problem(p, v.dirBlockOffset(inode), "directories nested more than %d deep", maxDirDepth)
+			return
+		}
+		v.verifyDir(p, inode, depth)
+	case C.SQFS_INODE_FILE, C.SQFS_INODE_EXT_FILE:
+		if !seen && !v.opts.NoData {
+			v.verifyFileData(p, inode)
+		}
+	}
+}
+
+// verifyDir - check the entries of the directory inode at p.
+func (v *verifier) verifyDir(p string, inode *C.sqfs_inode_generic_t, depth int) {
+	offset := v.dirBlockOffset(inode)
+	rd := sqfsDirReaderTCopy(v.sqfs.dirReader)
+	if rd == nil {
+		v.problem(p, offset, "failed to create a directory reader")
+		return
+	}
+	defer C.sqfs_destroy(unsafe.Pointer(rd))
+
+	if r := C.sqfs_dir_reader_open_dir(rd, inode, 0); r != 0 {
+		v.problem(p, offset, "cannot read directory: %s", sqfsErrorString(int(r)))
+		return
+	}
+
+	nums, err := v.dirEntryInodes(inode)
+	if err != nil {
+		v.problem(p, offset, "cannot read directory listing: %s", err)
+		return
+	}
+
+	prev := ""
+	for i := 0; ; i++ {
+		var ent *C.sqfs_dir_entry_t
+		r := C.sqfs_dir_reader_read(rd, &ent)
+		if r > 0 {
+			return
+		} else if r < 0 {
+			v.problem(p, offset, "cannot read directory entry: %s", sqfsErrorString(int(r)))
+			return
+		}
+		name := sqfsDirEntryTName(ent)
+		entType := ent._type
+		C.sqfs_free(unsafe.Pointer(ent))
+
+		child := path.Join(p, name)
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			v.problem(child, offset, "invalid entry name %q", name)
+			continue
+		}
+		if prev != "" && name <= prev {
+			v.problem(child, offset, "entry not sorted after %q (duplicate or out of order)", prev)
+		}
+		prev = name
+
+		var childInode *C.sqfs_inode_generic_t
+		if r := C.sqfs_dir_reader_get_inode(rd, &childInode); r != 0 {
+			v.problem(child, offset, "cannot read inode: %s", sqfsErrorString(int(r)))
+			continue
+		}
+		if num := uint32(childInode.base.inode_number); i >= len(nums) || nums[i] != num {
+			v.problem(child, offset, "entry inode number does not match inode number %d", num)
+		} else if t := inodeBasicType(childInode.base._type); t != C.sqfs_u16(entType) {
+			v.problem(child, offset, "entry type %d does not match inode type %d", entType, childInode.base._type)
+		} else {
+			v.verifyInode(child, childInode, depth+1)
+		}
+		C.sqfs_free(unsafe.Pointer(childInode))
+	}
+}
+
+// dirEntryInodes - return the inode numbers the entries of the directory inode
+// refer to, in order.  The directory reader does not give them: the entries only
+// have a difference to the number in the header of their run.
+func (v *verifier) dirEntryInodes(inode *C.sqfs_inode_generic_t) ([]uint32, error) {
+	dataPtr := unsafe.Pointer(&inode.data)
+	var start, size uint64
+	var offset C.size_t
+	switch inode.base._type {
+	case C.SQFS_INODE_DIR:
+		dir := (*C.sqfs_inode_dir_t)(dataPtr)
+		start, size, offset = uint64(dir.start_block), uint64(dir.size), C.size_t(dir.offset)
+	case C.SQFS_INODE_EXT_DIR:
+		dir := (*C.sqfs_inode_dir_ext_t)(dataPtr)
+		start, size, offset = uint64(dir.start_block), uint64(dir.size), C.size_t(dir.offset)
+	}
+
+	dirStart := uint64(v.sqfs.super.directory_table_start)
+	m := C.sqfs_meta_reader_create(v.sqfs.file, v.sqfs.compressor, C.sqfs_u64(dirStart),
+		C.sqfs_u64(v.sqfs.super.bytes_used))
+	if m == nil {
+		return nil, fmt.Errorf("failed to create a metadata reader")
+	}
+	defer C.sqfs_destroy(unsafe.Pointer(m))
+	if r := C.sqfs_meta_reader_seek(m, C.sqfs_u64(dirStart+start), offset); r != 0 {
+		return nil, fmt.Errorf("%s", sqfsErrorString(int(r)))
+	}
+
+	// the size counts 3 bytes for the "." and ".." entries that are not stored.
+	nums := []uint32{}
+	for read := uint64(3); read < size; {
+		var hdr C.sqfs_dir_header_t
+		if r := C.sqfs_meta_reader_read_dir_header(m, &hdr); r != 0 {
+			return nums, fmt.Errorf("header: %s", sqfsErrorString(int(r)))
+		}
+		read += uint64(unsafe.Sizeof(hdr))
+		for i := uint32(0); i <= uint32(hdr.count) && read < size; i++ {
+			var ent *C.sqfs_dir_entry_t
+			if r := C.sqfs_meta_reader_read_dir_ent(m, &ent); r != 0 {
+				return nums, fmt.Errorf("entry: %s", sqfsErrorString(int(r)))
+			}
+			nums = append(nums, uint32(int64(hdr.inode_number)+int64(ent.inode_diff)))
+			read += 8 + uint64(ent.size) + 1
+			C.sqfs_free(unsafe.Pointer(ent))
+		}
+	}
+	return nums, nil
+}
+
+// inodeBlockSizes - return the data block sizes of a file inode.
+func inodeBlockSizes(inode *C.sqfs_inode_generic_t) []uint32 {
+	count := int(inode.payload_bytes_used) / 4
+	structSize := int(C.sizeof_sqfs_inode_generic_t)
+	b := C.GoBytes(unsafe.Pointer(inode), C.int(structSize+count*4))[structSize:]
+	sizes := make([]uint32, count)
+	for i := range sizes {
+		sizes[i] = *(*uint32)(unsafe.Pointer(&b[i*4]))
+	}
+	return sizes
+}
+
+// verifyFileData - decompress every data block and the fragment of the file inode at p.
+func (v *verifier) verifyFileData(p string, inode *C.sqfs_inode_generic_t) {
+	var size, start C.sqfs_u64
+	var fragIdx, fragOffset C.sqfs_u32
+	C.sqfs_inode_get_file_size(inode, &size)
+	C.sqfs_inode_get_file_block_start(inode, &start)
+	C.sqfs_inode_get_frag_location(inode, &fragIdx, &fragOffset)
+
+	blockSize := uint64(v.sqfs.super.block_size)
+	hasFrag := fragIdx != noFragment
+	nblocks := uint64(size) / blockSize
+	if !hasFrag && uint64(size)%blockSize != 0 {
+		nblocks++
+	}
+
+	sizes := inodeBlockSizes(inode)
+	if uint64(len(sizes)) < nblocks {
+		v.problem(p, int64(start), "inode lists %d blocks, file size %d needs %d", len(sizes), size, nblocks)
+		nblocks = uint64(len(sizes))
+	}
+
+	used := uint64(v.sqfs.super.bytes_used)
+	off := uint64(start)
+	for i := uint64(0); i < nblocks; i++ {
+		onDisk := uint64(sizes[i] & blockSizeMask)
+		if off+onDisk > used {
+			v.problem(p, int64(off), "data block %d (%d bytes) past bytes_used", i, onDisk)
+			return
+		}
+		var out *C.sqfs_u8
+		var outSize C.size_t
+		if r := C.sqfs_data_reader_get_block(v.sqfs.dataReader, inode, C.size_t(i), &outSize, &out); r != 0 {
+			v.problem(p, int64(off), "cannot decompress data block %d: %s", i, sqfsErrorString(int(r)))
+		} else {
+			C.free(unsafe.Pointer(out))
+		}
+		off += onDisk
+	}
+
+	if hasFrag {
+		if uint32(fragIdx) >= uint32(v.sqfs.super.fragment_entry_count) {
+			v.problem(p, -1, "fragment index %d out of range (%d fragments)", fragIdx, v.sqfs.super.fragment_entry_count)
+			return
+		}
+		var out *C.sqfs_u8
+		var outSize C.size_t
+		if r := C.sqfs_data_reader_get_fragment(v.sqfs.dataReader, inode, &outSize, &out); r != 0 {
+			v.problem(p, -1, "cannot decompress fragment %d: %s", fragIdx, sqfsErrorString(int(r)))
+		} else {
+			C.free(unsafe.Pointer(out))
+		}
+	}
+}
+
+// sqfsErrorString - describe a SQFS_ERROR code returned by libsquashfs.
+func sqfsErrorString(code int) string {
+	names := map[int]string{
+		C.SQFS_ERROR_ALLOC:            "out of memory",
+		C.SQFS_ERROR_IO:               "I/O error",
+		C.SQFS_ERROR_COMPRESSOR:       "decompression failed",
+		C.SQFS_ERROR_INTERNAL:         "internal error",
+		C.SQFS_ERROR_CORRUPTED:        "corrupted data",
+		C.SQFS_ERROR_UNSUPPORTED:      "unsupported feature",
+		C.SQFS_ERROR_OVERFLOW:         "numeric overflow",
+		C.SQFS_ERROR_OUT_OF_BOUNDS:    "location out of bounds",
+		C.SFQS_ERROR_SUPER_MAGIC:      "bad superblock magic",
+		C.SFQS_ERROR_SUPER_VERSION:    "unsupported squashfs version",
+		C.SQFS_ERROR_SUPER_BLOCK_SIZE: "invalid block size",
+		C.SQFS_ERROR_NOT_DIR:          "not a directory",
+		C.SQFS_ERROR_NO_ENTRY:         "no such entry",
+		C.SQFS_ERROR_LINK_LOOP:        "hard link loop",
+		C.SQFS_ERROR_NOT_FILE:         "not a file",
+		C.SQFS_ERROR_ARG_INVALID:      "invalid argument",
+		C.SQFS_ERROR_SEQUENCE:         "wrong call sequence",
+	}
+	if name, ok := names[code]; ok {
+		return fmt.Sprintf("%s (%d)", name, code)
+	}
+	return fmt.Sprintf("error %d", code)
+}
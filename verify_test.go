@@ -0,0 +1,87 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyFileTruncated(t *testing.T) {
+	d := tempDir(t)
+	fname := filepath.Join(d, "image.squashfs")
+	sqfs := writeTestImage(t, fname, []testEntry{
+		tdir("/"),
+		tfile("/a", strings.Repeat("a", 1000)),
+	})
+	sqfs.Free()
+
+	problems, err := VerifyFile(fname, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("problems in a good image: %v", problems)
+	}
+
+	if err := os.Truncate(fname, superSize+10); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = VerifyFile(fname, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) == 0 || !strings.Contains(problems[0].Message, "truncated") {
+		t.Errorf("expected a truncation problem, got %v", problems)
+	}
+}
+
+func TestVerifyDirEntryInode(t *testing.T) {
+	d := tempDir(t)
+	fname := filepath.Join(d, "image.squashfs")
+	sqfs := writeTestImage(t, fname, []testEntry{
+		tdir("/"),
+		tfile("/a", "a"),
+		tfile("/b", "b"),
+	})
+	sqfs.Free()
+
+	fp, err := os.OpenFile(fname, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	super, err := readSuperBlock(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the root listing is the only one: a metadata block header, the run
+	// header (count, start block, inode number), then the entry of /a.
+	block := make([]byte, 2+12+8)
+	if _, err := fp.ReadAt(block, int64(super.DirTableStart)); err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint16(block)&0x8000 == 0 {
+		t.Skip("the directory table is compressed, it cannot be patched")
+	}
+	diff := int16(binary.LittleEndian.Uint16(block[2+12+2:]))
+	binary.LittleEndian.PutUint16(block[2+12+2:], uint16(diff+1))
+	if _, err := fp.WriteAt(block, int64(super.DirTableStart)); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := VerifyFile(fname, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, p := range problems {
+		if p.Path == "/a" && strings.Contains(p.Message, "inode number") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected an inode number problem for /a, got %v", problems)
+	}
+}
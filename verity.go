@@ -0,0 +1,344 @@
+package squashfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultVerityBlockSize - data and hash block size veritysetup uses by default.
+const DefaultVerityBlockSize = 4096
+
+// veritySuperSize - size of the veritysetup superblock (struct verity_sb).
+const veritySuperSize = 512
+
+var veritySignature = []byte("verity\x00\x00")
+
+// ErrVerityMismatch - the hash tree or root hash does not match the image data.
+var ErrVerityMismatch = errors.New("verity hash mismatch")
+
+// VerityParams - parameters of a dm-verity hash tree (sha256, format version 1).
+// Zero values get the veritysetup defaults: 4096 byte blocks, a random 32
+// byte salt and a random UUID.
+type VerityParams struct {
+	DataBlockSize uint32
+	HashBlockSize uint32
+	Salt          []byte
+	UUID          [16]byte
+	// NoSuperblock - do not write a superblock in front of the tree (veritysetup --no-superblock).
+	NoSuperblock bool
+}
+
+// VerityInfo - what veritysetup needs to open or verify an image with an appended tree.
+type VerityInfo struct {
+	VerityParams
+	RootHash   []byte
+	DataBlocks uint64
+	// HashOffset - byte offset of the hash area (superblock or tree) in the image file.
+	HashOffset uint64
+}
+
+func (p *VerityParams) setDefaults() error {
+	if p.DataBlockSize == 0 {
+		p.DataBlockSize = DefaultVerityBlockSize
+	}
+	if p.HashBlockSize == 0 {
+		p.HashBlockSize = DefaultVerityBlockSize
+	}
+	for _, bs := range []uint32{p.DataBlockSize, p.HashBlockSize} {
+		if bs < 512 || bs > 1<<20 || bs&(bs-1) != 0 {
+			return fmt.Errorf("invalid verity block size %d", bs)
+		}
+	}
+	if p.HashBlockSize < sha256.Size {
+		return fmt.Errorf("hash block size %d is smaller than a digest", p.HashBlockSize)
+	}
+	if p.Salt == nil {
+		p.Salt = make([]byte, sha256.Size)
+		if _, err := rand.Read(p.Salt); err != nil {
+			return err
+		}
+	}
+	if len(p.Salt) > 256 {
+		return fmt.Errorf("verity salt is %d bytes, the maximum is 256", len(p.Salt))
+	}
+	if p.UUID == [16]byte{} && !p.NoSuperblock {
+		if _, err := rand.Read(p.UUID[:]); err != nil {
+			return err
+		}
+		// RFC 4122 version 4.
+		p.UUID[6] = (p.UUID[6] & 0x0f) | 0x40
+		p.UUID[8] = (p.UUID[8] & 0x3f) | 0x80
+	}
+	return nil
+}
+
+// treeOffset - offset of the hash tree relative to the hash area.
+func (p VerityParams) treeOffset() uint64 {
+	if p.NoSuperblock {
+		return 0
+	}
+	hbs := uint64(p.HashBlockSize)
+	return (veritySuperSize + hbs - 1) / hbs * hbs
+}
+
+// VerityFormat - compute the dm-verity hash tree of the image data (BytesUsed() bytes,
+// padded to a data block) and append it to the image file.  Anything after the data
+// is replaced, except a signature trailer (see WriteSignatureTrailer) which is kept
+// after the tree.  The tree can be used with veritysetup using --hash-offset=HashOffset.
+func VerityFormat(sqfs *SquashFs, params VerityParams) (VerityInfo, error) {
+	if err := params.setDefaults(); err != nil {
+		return VerityInfo{}, err
+	}
+
+	dbs := uint64(params.DataBlockSize)
+	info := VerityInfo{VerityParams: params}
+	info.DataBlocks = (sqfs.BytesUsed() + dbs - 1) / dbs
+	info.HashOffset = info.DataBlocks * dbs
+
+	fp, err := sqfs.openImage(os.O_RDWR)
+	if err != nil {
+		return info, err
+	}
+	defer fp.Close()
+
+	levels, root, err := verityTree(io.NewSectionReader(fp, 0, int64(sqfs.BytesUsed())), info.DataBlocks, params)
+	if err != nil {
+		return info, err
+	}
+	info.RootHash = root
+
+	trailer, err := readTrailerBytes(fp)
+	if err != nil {
+		return info, err
+	}
+
+	// zero pad the last data block and drop anything that followed the data.
+	if err := fp.Truncate(int64(info.HashOffset)); err != nil {
+		return info, err
+	}
+
+	area := []byte{}
+	if !params.NoSuperblock {
+		area = append(area, verityEncodeSuper(info)...)
+		area = append(area, make([]byte, params.treeOffset()-veritySuperSize)...)
+	}
+	// the level closest to the root comes first.
+	for i := len(levels) - 1; i >= 0; i-- {
+		area = append(area, levels[i]...)
+	}
+	area = append(area, trailer...)
+	if _, err := fp.WriteAt(area, int64(info.HashOffset)); err != nil {
+		return info, err
+	}
+
+	return info, fp.Sync()
+}
+
+// readTrailerBytes - the raw signature trailer of the image in fp, nil if it has none.
+func readTrailerBytes(fp *os.File) ([]byte, error) {
+	start, err := signatureTrailerStart(fp)
+	if err == ErrNoSignature {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, st.Size()-start)
+	if _, err := fp.ReadAt(trailer, start); err != nil {
+		return nil, err
+	}
+	return trailer, nil
+}
+
+// VerityVerify - check the hash tree appended to the image against the data and rootHash.
+// If the tree has a superblock it is found after the data and its parameters are
+// used, otherwise params must be those the tree was made with.  ErrVerityMismatch
+// is returned if anything does not match.
+func VerityVerify(sqfs *SquashFs, rootHash []byte, params VerityParams) (VerityInfo, error) {
+	info := VerityInfo{}
+	fp, err := sqfs.openImage(os.O_RDONLY)
+	if err != nil {
+		return info, err
+	}
+	defer fp.Close()
+
+	if !params.NoSuperblock {
+		if info, err = findVeritySuper(fp, sqfs.BytesUsed()); err != nil {
+			return info, err
+		}
+	} else {
+		if params.Salt == nil {
+			return info, fmt.Errorf("the salt is needed to verify a tree without superblock")
+		}
+		if err := params.setDefaults(); err != nil {
+			return info, err
+		}
+		dbs := uint64(params.DataBlockSize)
+		info.VerityParams = params
+		info.DataBlocks = (sqfs.BytesUsed() + dbs - 1) / dbs
+		info.HashOffset = info.DataBlocks * dbs
+	}
+
+	levels, root, err := verityTree(io.NewSectionReader(fp, 0, int64(info.HashOffset)), info.DataBlocks, info.VerityParams)
+	if err != nil {
+		return info, err
+	}
+	info.RootHash = root
+
+	pos := int64(info.HashOffset + info.treeOffset())
+	for i := len(levels) - 1; i >= 0; i-- {
+		onDisk := make([]byte, len(levels[i]))
+		if _, err := fp.ReadAt(onDisk, pos); err != nil {
+			return info, fmt.Errorf("cannot read verity hash level %d at %d: %s", i, pos, err)
+		}
+		if !bytes.Equal(onDisk, levels[i]) {
+			return info, fmt.Errorf("%w: hash level %d at %d", ErrVerityMismatch, i, pos)
+		}
+		pos += int64(len(levels[i]))
+	}
+
+	if !bytes.Equal(root, rootHash) {
+		return info, fmt.Errorf("%w: root hash is %x, expected %x", ErrVerityMismatch, root, rootHash)
+	}
+
+	return info, nil
+}
+
+// findVeritySuper - read the verity superblock following the image data.  The data
+// is padded to the data block size recorded in the superblock, so every valid
+// block size is tried.
+func findVeritySuper(fp *os.File, bytesUsed uint64) (VerityInfo, error) {
+	super := make([]byte, veritySuperSize)
+	last := uint64(0)
+	for dbs := uint64(512); dbs <= 1<<20; dbs *= 2 {
+		offset := (bytesUsed + dbs - 1) / dbs * dbs
+		if offset == last {
+			continue
+		}
+		last = offset
+		if _, err := fp.ReadAt(super, int64(offset)); err != nil || !bytes.Equal(super[0:8], veritySignature) {
+			continue
+		}
+		info, err := verityDecodeSuper(super)
+		if err != nil {
+			return info, fmt.Errorf("verity superblock at %d: %s", offset, err)
+		}
+		if uint64(info.DataBlockSize)*info.DataBlocks != offset {
+			return info, fmt.Errorf("verity superblock at %d covers %d blocks of %d bytes",
+				offset, info.DataBlocks, info.DataBlockSize)
+		}
+		info.HashOffset = offset
+		return info, nil
+	}
+	return VerityInfo{}, fmt.Errorf("no verity superblock found after the image data")
+}
+
+// verityTree - return the hash levels (leaves first) and the root hash for the
+// dataBlocks blocks in r.  A short last block is zero padded.  A single data block
+// has no hash levels, its digest is the root hash, as with veritysetup and the
+// kernel (levels is the smallest n with dataBlocks <= hashes per block ^ n).
+func verityTree(r io.ReaderAt, dataBlocks uint64, params VerityParams) ([][]byte, []byte, error) {
+	dbs := int64(params.DataBlockSize)
+	hbs := int64(params.HashBlockSize)
+	perBlock := hbs / sha256.Size
+
+	hashBlock := func(block []byte) []byte {
+		h := sha256.New()
+		h.Write(params.Salt)
+		h.Write(block)
+		return h.Sum(nil)
+	}
+
+	// pack - store digests perBlock to a hash block, zero padded.
+	pack := func(digests [][]byte) []byte {
+		nblocks := (int64(len(digests)) + perBlock - 1) / perBlock
+		level := make([]byte, nblocks*hbs)
+		for i, d := range digests {
+			copy(level[int64(i)/perBlock*hbs+int64(i)%perBlock*sha256.Size:], d)
+		}
+		return level
+	}
+
+	digests := make([][]byte, 0, dataBlocks)
+	buf := make([]byte, dbs)
+	for i := uint64(0); i < dataBlocks; i++ {
+		n, err := r.ReadAt(buf, int64(i)*dbs)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		for j := n; j < len(buf); j++ {
+			buf[j] = 0
+		}
+		digests = append(digests, hashBlock(buf))
+	}
+
+	if len(digests) == 0 {
+		return nil, nil, fmt.Errorf("no data to hash")
+	} else if len(digests) == 1 {
+		return [][]byte{}, digests[0], nil
+	}
+
+	levels := [][]byte{}
+	for len(digests) > 1 {
+		level := pack(digests)
+		levels = append(levels, level)
+		digests = digests[:0]
+		for off := int64(0); off < int64(len(level)); off += hbs {
+			digests = append(digests, hashBlock(level[off:off+hbs]))
+		}
+	}
+
+	return levels, digests[0], nil
+}
+
+// verityEncodeSuper - the veritysetup superblock (struct verity_sb) for info.
+func verityEncodeSuper(info VerityInfo) []byte {
+	sb := make([]byte, veritySuperSize)
+	copy(sb[0:8], veritySignature)
+	binary.LittleEndian.PutUint32(sb[8:], 1)  // version
+	binary.LittleEndian.PutUint32(sb[12:], 1) // hash_type: normal
+	copy(sb[16:32], info.UUID[:])
+	copy(sb[32:64], "sha256")
+	binary.LittleEndian.PutUint32(sb[64:], info.DataBlockSize)
+	binary.LittleEndian.PutUint32(sb[68:], info.HashBlockSize)
+	binary.LittleEndian.PutUint64(sb[72:], info.DataBlocks)
+	binary.LittleEndian.PutUint16(sb[80:], uint16(len(info.Salt)))
+	copy(sb[88:344], info.Salt)
+	return sb
+}
+
+// verityDecodeSuper - parse a veritysetup superblock.
+func verityDecodeSuper(sb []byte) (VerityInfo, error) {
+	info := VerityInfo{}
+	if !bytes.Equal(sb[0:8], veritySignature) {
+		return info, fmt.Errorf("no verity superblock found")
+	}
+	if v := binary.LittleEndian.Uint32(sb[8:]); v != 1 {
+		return info, fmt.Errorf("unsupported verity superblock version %d", v)
+	}
+	if t := binary.LittleEndian.Uint32(sb[12:]); t != 1 {
+		return info, fmt.Errorf("unsupported verity hash type %d", t)
+	}
+	if alg := string(bytes.TrimRight(sb[32:64], "\x00")); alg != "sha256" {
+		return info, fmt.Errorf("unsupported verity hash algorithm %s", alg)
+	}
+	copy(info.UUID[:], sb[16:32])
+	info.DataBlockSize = binary.LittleEndian.Uint32(sb[64:])
+	info.HashBlockSize = binary.LittleEndian.Uint32(sb[68:])
+	info.DataBlocks = binary.LittleEndian.Uint64(sb[72:])
+	saltSize := binary.LittleEndian.Uint16(sb[80:])
+	if saltSize > 256 {
+		return info, fmt.Errorf("invalid verity salt size %d", saltSize)
+	}
+	info.Salt = append([]byte{}, sb[88:88+int(saltSize)]...)
+	return info, info.VerityParams.setDefaults()
+}
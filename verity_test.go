@@ -0,0 +1,78 @@
+package squashfs
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerity(t *testing.T) {
+	d := tempDir(t)
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := KeySet{}
+	ks.Add(pub)
+
+	for _, tc := range []struct {
+		name   string
+		size   int
+		params VerityParams
+	}{
+		// bytes_used fits a single data block: no hash levels.
+		{"single-block", 100, VerityParams{}},
+		{"multi-block", 1 << 20, VerityParams{}},
+		{"small-blocks", 1 << 20, VerityParams{DataBlockSize: 1024, HashBlockSize: 512}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fname := filepath.Join(d, tc.name+".squashfs")
+			sqfs := writeTestImage(t, fname, []testEntry{
+				tdir("/"),
+				tfile("/a", strings.Repeat(tc.name, tc.size/len(tc.name))),
+			})
+			defer sqfs.Free()
+
+			sig, err := SignImage(fname, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteSignatureTrailer(fname, sig); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := VerityFormat(&sqfs, tc.params)
+			if err != nil {
+				t.Fatalf("VerityFormat: %s", err)
+			}
+
+			if err := ks.VerifyImage(fname, nil); err != nil {
+				t.Errorf("signature trailer lost by VerityFormat: %s", err)
+			}
+
+			// the parameters come from the verity superblock, not from params.
+			got, err := VerityVerify(&sqfs, info.RootHash, VerityParams{DataBlockSize: 65536})
+			if err != nil {
+				t.Fatalf("VerityVerify: %s", err)
+			}
+			if got.HashOffset != info.HashOffset || got.DataBlockSize != info.DataBlockSize {
+				t.Errorf("VerityVerify found %+v, VerityFormat wrote %+v", got, info)
+			}
+
+			veritysetup, err := exec.LookPath("veritysetup")
+			if err != nil {
+				t.Log("veritysetup not found, not checked against it")
+				return
+			}
+			out, err := exec.Command(veritysetup, "verify", fname, fname, hex.EncodeToString(info.RootHash),
+				fmt.Sprintf("--hash-offset=%d", info.HashOffset)).CombinedOutput()
+			if err != nil {
+				t.Errorf("veritysetup verify: %s: %s", err, out)
+			}
+		})
+	}
+}
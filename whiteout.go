@@ -0,0 +1,217 @@
+package squashfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// OpaqueXattr - overlayfs xattr that marks a directory opaque when set to "y"
+const OpaqueXattr = "trusted.overlay.opaque"
+
+// OpaqueMarker - file name that marks its directory opaque
+const OpaqueMarker = ".wh..wh..opq"
+
+// WhiteOutPrefix - AUFS whiteout files are named WhiteOutPrefix + name of the hidden file
+const WhiteOutPrefix = ".wh."
+
+// aufsMetaPrefix - AUFS internal files (.wh..wh.plnk, .wh..wh.aufs, ...) are not whiteouts.
+const aufsMetaPrefix = WhiteOutPrefix + WhiteOutPrefix
+
+// WhiteOutMode - how the Extractor handles whiteouts and opaque directories.
+type WhiteOutMode int
+
+const (
+	// WhiteOutSkip - do not extract 0/0 char device whiteouts.  .wh. files, opaque
+	//   markers included, are extracted as the regular files they are.
+	WhiteOutSkip WhiteOutMode = iota
+	// WhiteOutOverlay - apply whiteouts by removing what they hide, empty opaque directories.
+	WhiteOutOverlay
+	// WhiteOutLiteral - write whiteouts as 0/0 char devices and opaque dirs with the
+	//   trusted.overlay.opaque xattr, as an overlayfs lowerdir expects.  Whiteouts
+	//   are devices, so they are only written with Devs.
+	WhiteOutLiteral
+	// WhiteOutAUFS - write whiteouts as .wh.<name> files and opaque dirs with a .wh..wh..opq file.
+	WhiteOutAUFS
+)
+
+var whiteOutModeNames = map[WhiteOutMode]string{
+	WhiteOutSkip:    "skip",
+	WhiteOutOverlay: "overlay",
+	WhiteOutLiteral: "literal",
+	WhiteOutAUFS:    "aufs",
+}
+
+func (m WhiteOutMode) String() string {
+	if name, ok := whiteOutModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("WhiteOutMode(%d)", int(m))
+}
+
+// ParseWhiteOutMode - return the WhiteOutMode for name (skip, overlay, literal or aufs).
+func ParseWhiteOutMode(name string) (WhiteOutMode, error) {
+	for m, n := range whiteOutModeNames {
+		if n == name {
+			return m, nil
+		}
+	}
+	return WhiteOutSkip, fmt.Errorf("unknown whiteout mode '%s'. Needs one of: skip, overlay, literal, aufs", name)
+}
+
+// getWhiteOut - return the path hidden by the white-out info, or "" if info is not a white-out.
+func getWhiteOut(info FileInfo) string {
+	// squashfs / overlayfs is a character device major/minor 0/0 with same name.
+	if info.FMode&os.ModeCharDevice != 0 {
+		stat := info.Sys().(syscall.Stat_t)
+		if stat.Rdev == 0 {
+			return info.Filename
+		}
+	}
+	// aufs is a file named .wh.<name> next to the hidden name.
+	name := info.Name()
+	if info.FMode.IsRegular() && strings.HasPrefix(name, WhiteOutPrefix) && !strings.HasPrefix(name, aufsMetaPrefix) {
+		return filepath.Join(filepath.Dir(info.Filename), strings.TrimPrefix(name, WhiteOutPrefix))
+	}
+	return ""
+}
+
+// IsOpaque - return true if the directory info is an overlay opaque directory.
+//   A directory is opaque if it has the trusted.overlay.opaque=y xattr or
+//   contains a .wh..wh..opq marker file.
+func IsOpaque(info FileInfo) bool {
+	if !info.IsDir() || info.File == nil {
+		return false
+	}
+	if xattrs, err := info.File.Xattrs(); err == nil && xattrs[OpaqueXattr] == "y" {
+		return true
+	}
+	return hasOpaqueMarker(info)
+}
+
+// hasOpaqueMarker - return true if the directory info contains a .wh..wh..opq marker file.
+func hasOpaqueMarker(info FileInfo) bool {
+	_, err := info.File.SquashFs.Lstat(filepath.Join(info.Filename, OpaqueMarker))
+	return err == nil
+}
+
+// extractWhiteOut - handle the white-out at path that hides whiteOut according to e.WhiteOuts.
+func (e *Extractor) extractWhiteOut(path string, whiteOut string, info FileInfo) error {
+	if e.Sink != nil {
+		return e.sinkWhiteOut(path, whiteOut, info)
+	}
+	switch e.WhiteOuts {
+	case WhiteOutOverlay:
+		return e.applyWhiteOut(whiteOut, info)
+	case WhiteOutLiteral:
+		if !e.Devs {
+			e.Logger.Debug("skipping white-out char device %s", path)
+			e.recordSkip(path, "devices not extracted")
+			return nil
+		}
+		e.Logger.Debug("whiteout: %s as char device %s", path, whiteOut)
+		targetPath := filepath.Join(e.Dir, whiteOut)
+		// aufs whiteouts are regular files, so claim a 0/0 char device for Mknod.
+		devInfo := info
+		devInfo.FMode = os.ModeCharDevice | info.FMode.Perm()
+		return e.doCreate(targetPath, devInfo,
+			func() error { return e.Ops.Mknod(targetPath, devInfo) })
+	case WhiteOutAUFS:
+		aufsPath := filepath.Join(filepath.Dir(whiteOut), WhiteOutPrefix+filepath.Base(whiteOut))
+		e.Logger.Debug("whiteout: %s as aufs %s", path, aufsPath)
+		return e.createEmpty(filepath.Join(e.Dir, aufsPath), info)
+	}
+	e.Logger.Debug("not extracting white-out file %s", path)
+	e.recordSkip(path, "whiteout not extracted")
+	return nil
+}
+
+// extractOpaque - handle the opaque directory at path according to e.WhiteOuts.
+func (e *Extractor) extractOpaque(path string, info FileInfo) error {
+	fp := filepath.Join(e.Dir, path)
+	switch e.WhiteOuts {
+	case WhiteOutOverlay:
+		return e.applyOpaque(path, info)
+	case WhiteOutLiteral:
+		e.Logger.Debug("opaque: setting %s=y on %s", OpaqueXattr, path)
+		return e.Ops.Setxattr(fp, OpaqueXattr, []byte("y"))
+	case WhiteOutAUFS:
+		if hasOpaqueMarker(info) {
+			// the image has the marker, it is extracted as the walk gets to it.
+			return nil
+		}
+		e.Logger.Debug("opaque: creating %s in %s", OpaqueMarker, path)
+		if err := e.createEmpty(filepath.Join(fp, OpaqueMarker), info); err != errKeepExisting {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOpaque - remove everything already in path so lower layers do not show
+// through, as the conflict policy for whiteouts allows.
+func (e *Extractor) applyOpaque(path string, info FileInfo) error {
+	fp := filepath.Join(e.Dir, path)
+	names, err := e.view().ReadDirNames(fp)
+	if err != nil {
+		return err
+	}
+	e.Logger.Debug("applying opaque dir '%s' by emptying it", path)
+	backups := map[string]bool{}
+	for _, name := range names {
+		if backups[name] {
+			continue
+		}
+		moved, err := e.removeHidden(filepath.Join(fp, name), info)
+		if err == errKeepExisting {
+			continue
+		} else if err != nil {
+			return err
+		} else if moved {
+			// the backup is not to be removed in turn.
+			backups[name+e.backupSuffix()] = true
+		}
+	}
+	return nil
+}
+
+// applyWhiteOut - remove whiteOut, hidden by the whiteout info, as the conflict
+// policy for whiteouts allows.
+func (e *Extractor) applyWhiteOut(whiteOut string, info FileInfo) error {
+	fp := filepath.Join(e.Dir, whiteOut)
+	if _, err := e.view().Lstat(fp); err != nil {
+		return nil
+	}
+	e.Logger.Debug("applying white-out '%s' by removing '%s'", info.Filename, whiteOut)
+	_, err := e.removeHidden(fp, info)
+	return err
+}
+
+// removeHidden - remove fp, hidden by the whiteout or opaque directory info, unless
+// the conflict policy says otherwise.  Returns true if fp was moved to a backup.
+func (e *Extractor) removeHidden(fp string, info FileInfo) (bool, error) {
+	existing, err := e.view().Lstat(fp)
+	if err != nil {
+		return false, err
+	}
+	if moved, err := e.resolveRemoval(fp, existing, info); err != nil || moved {
+		return moved, err
+	}
+	return false, e.Ops.RemoveAll(fp)
+}
+
+// createEmpty - create an empty regular file at targetPath.
+func (e *Extractor) createEmpty(targetPath string, info FileInfo) error {
+	fileInfo := info
+	fileInfo.FMode = info.FMode.Perm()
+	return e.doCreate(targetPath, fileInfo,
+		func() error {
+			fp, err := e.Ops.Create(targetPath, DefaultFilePerm)
+			if err != nil {
+				return err
+			}
+			return fp.Close()
+		})
+}
@@ -0,0 +1,53 @@
+package squashfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWhiteOutRenamedByFilter(t *testing.T) {
+	d := tempDir(t)
+	base := writeTestImage(t, filepath.Join(d, "base.squashfs"), []testEntry{
+		tdir("/"),
+		tdir("/usr"),
+		tfile("/usr/a", "a"),
+		tfile("/usr/b", "b"),
+		tfile("/usr/c", "c"),
+	})
+	defer base.Free()
+	top := writeTestImage(t, filepath.Join(d, "top.squashfs"), []testEntry{
+		tdir("/"),
+		tdir("/usr"),
+		tfile("/usr/"+WhiteOutPrefix+"a", ""),
+		tchar("/usr/b", 0, 0),
+		tfile("/usr/"+WhiteOutPrefix+"c", ""),
+	})
+	defer top.Free()
+
+	dir := filepath.Join(d, "out")
+	// not part of the extraction or excluded, the whiteouts must not touch them.
+	for _, p := range []string{"usr/a", "opt/c"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), DefaultDirPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, p), []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, sqfs := range []SquashFs{base, top} {
+		e := Extractor{Dir: dir, SquashFs: sqfs, Path: "/", WhiteOuts: WhiteOutOverlay, Logger: PrintfLogger{},
+			Filter: &Filter{Prefixes: []PrefixRewrite{{From: "/usr", To: "/opt"}}, Exclude: []string{"/usr/c"}}}
+		if err := e.Extract(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := "/ /opt /opt/c /usr /usr/a"
+	if got := strings.Join(treePaths(t, dir), " "); got != want {
+		t.Errorf("tree is %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,610 @@
+package squashfs
+
+// #cgo pkg-config: libsquashfs1
+// #include <stdlib.h>
+// #include <string.h>
+// #include <sqfs/predef.h>
+// #include <sqfs/io.h>
+// #include <sqfs/super.h>
+// #include <sqfs/compressor.h>
+// #include <sqfs/inode.h>
+// #include <sqfs/id_table.h>
+// #include <sqfs/meta_writer.h>
+// #include <sqfs/dir_writer.h>
+// #include <sqfs/block_writer.h>
+// #include <sqfs/block_processor.h>
+// #include <sqfs/frag_table.h>
+// #include <sqfs/xattr_writer.h>
+//
+// static int write_compressor_options(sqfs_compressor_t *cmp, sqfs_file_t *file) {
+// 	return cmp->write_options(cmp, file);
+// }
+//
+// static sqfs_u64 file_size(sqfs_file_t *file) {
+// 	return file->get_size(file);
+// }
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// DefaultBlockSize - data block size of images written by a Writer.
+const DefaultBlockSize = 128 * 1024
+
+// devBlockSize - images are padded to a multiple of this, so they can be loop mounted.
+const devBlockSize = 4096
+
+// WriterOptions - options for NewWriter.
+type WriterOptions struct {
+	// Compression - gzip, lzma, lzo, xz, lz4 or zstd, gzip if empty.
+	Compression string
+	// BlockSize - data block size, DefaultBlockSize if 0.
+	BlockSize int
+}
+
+// Writer - builds a squashfs image with libsquashfs, without privileges and
+// without staging anything on disk.  The content of regular files goes to the
+// image as they are added, the inode and directory tables are written by Close.
+// Entries are added parents first, a root directory with default permissions
+// is there if "/" is not added.
+type Writer struct {
+	Filename   string
+	file       *C.sqfs_file_t
+	super      *C.sqfs_super_t
+	compressor *C.sqfs_compressor_t
+	blkWriter  *C.sqfs_block_writer_t
+	fragTable  *C.sqfs_frag_table_t
+	dataProc   *C.sqfs_block_processor_t
+	idTable    *C.sqfs_id_table_t
+	xattrs     *C.sqfs_xattr_writer_t
+	root       *writerNode
+	files      []*writerNode
+	hasXattrs  bool
+}
+
+// writerNode - an entry added to a Writer.
+type writerNode struct {
+	ent      TreeEntry
+	children map[string]*writerNode
+	// link - for hard links, the node that has the inode.
+	link *writerNode
+	// nlink - number of names of a non-directory inode.
+	nlink int
+	// fileInode - where the block processor keeps the inode of a regular file.
+	fileInode **C.sqfs_inode_generic_t
+	ino       uint32
+	ref       uint64
+}
+
+// NewWriter - return a Writer creating the image filename, replacing what is there.
+func NewWriter(filename string, opts WriterOptions) (*Writer, error) {
+	if opts.Compression == "" {
+		opts.Compression = "gzip"
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+	cname := C.CString(opts.Compression)
+	compID := C.sqfs_compressor_id_from_name(cname)
+	C.free(unsafe.Pointer(cname))
+	if compID < 0 {
+		return nil, fmt.Errorf("unknown compression '%s'", opts.Compression)
+	}
+
+	w := &Writer{
+		Filename: filename,
+		root: &writerNode{
+			ent:      TreeEntry{Path: "/", Mode: os.ModeDir | DefaultDirPerm, ModTime: time.Now()},
+			children: map[string]*writerNode{},
+		},
+	}
+
+	cfname := C.CString(filename)
+	defer C.free(unsafe.Pointer(cfname))
+	if w.file = C.sqfs_open_file(cfname, C.SQFS_FILE_OPEN_OVERWRITE); w.file == nil {
+		return nil, fmt.Errorf("failed to create %s", filename)
+	}
+
+	w.super = (*C.sqfs_super_t)(C.calloc(1, C.sizeof_sqfs_super_t))
+	if r := C.sqfs_super_init(w.super, C.size_t(opts.BlockSize), 0, C.SQFS_COMPRESSOR(compID)); r != 0 {
+		w.free()
+		return nil, fmt.Errorf("bad block size %d: %s", opts.BlockSize, sqfsErrorString(int(r)))
+	}
+
+	var config C.sqfs_compressor_config_t
+	C.sqfs_compressor_config_init(&config, C.SQFS_COMPRESSOR(compID), C.size_t(opts.BlockSize), 0)
+	if r := C.sqfs_compressor_create(&config, &w.compressor); r != 0 {
+		w.free()
+		return nil, fmt.Errorf("error creating %s compressor: %s", opts.Compression, sqfsErrorString(int(r)))
+	}
+
+	// the super block is written again by Close, this reserves its place.
+	if r := C.sqfs_super_write(w.super, w.file); r != 0 {
+		w.free()
+		return nil, fmt.Errorf("error writing super block: %s", sqfsErrorString(int(r)))
+	}
+	r := C.write_compressor_options(w.compressor, w.file)
+	if r < 0 {
+		w.free()
+		return nil, fmt.Errorf("error writing compressor options: %s", sqfsErrorString(int(r)))
+	} else if r > 0 {
+		w.super.flags |= C.SQFS_FLAG_COMPRESSOR_OPTIONS
+	}
+
+	w.blkWriter = C.sqfs_block_writer_create(w.file, devBlockSize, 0)
+	w.fragTable = C.sqfs_frag_table_create(0)
+	w.idTable = C.sqfs_id_table_create(0)
+	w.xattrs = C.sqfs_xattr_writer_create(0)
+	if w.blkWriter == nil || w.fragTable == nil || w.idTable == nil || w.xattrs == nil {
+		w.free()
+		return nil, fmt.Errorf("error creating the tables of %s", filename)
+	}
+	w.dataProc = C.sqfs_block_processor_create(C.size_t(opts.BlockSize), w.compressor, 1, 10,
+		w.blkWriter, w.fragTable)
+	if w.dataProc == nil {
+		w.free()
+		return nil, fmt.Errorf("error creating data block processor")
+	}
+	return w, nil
+}
+
+// Add - add ent, with the content of regular files read from r.  Size, Rdev
+// and LinkTarget are used as the type of ent says, Ino is not used.
+func (w *Writer) Add(ent TreeEntry, r io.Reader) error {
+	if w.file == nil {
+		return fmt.Errorf("%s: writer is closed", ent.Path)
+	}
+	ent.Path = path.Clean("/" + ent.Path)
+	node := &writerNode{ent: ent, nlink: 1}
+	if ent.Path == "/" {
+		if !ent.Mode.IsDir() {
+			return fmt.Errorf("/: the root must be a directory")
+		}
+		w.root.ent = ent
+		return nil
+	}
+	parent, err := w.parent(ent.Path)
+	if err != nil {
+		return err
+	}
+
+	switch ent.Type() {
+	case "dir":
+		node.children = map[string]*writerNode{}
+	case "file":
+		if err := w.writeData(node, r); err != nil {
+			return fmt.Errorf("%s: %s", ent.Path, err)
+		}
+	case "symlink", "char", "block", "fifo", "socket":
+	default:
+		return fmt.Errorf("%s: cannot write %s to squashfs", ent.Path, ent.Type())
+	}
+
+	parent.children[path.Base(ent.Path)] = node
+	return nil
+}
+
+// Link - add a hard link at p to target, which was added before and is not a directory.
+func (w *Writer) Link(p, target string) error {
+	if w.file == nil {
+		return fmt.Errorf("%s: writer is closed", p)
+	}
+	tnode := w.find(path.Clean("/" + target))
+	if tnode == nil {
+		return fmt.Errorf("%s: hard link to %s, which is not in the image", p, target)
+	}
+	if tnode.link != nil {
+		tnode = tnode.link
+	}
+	if tnode.children != nil {
+		return fmt.Errorf("%s: cannot hard link to directory %s", p, target)
+	}
+	p = path.Clean("/" + p)
+	parent, err := w.parent(p)
+	if err != nil {
+		return err
+	}
+	node := &writerNode{ent: tnode.ent, link: tnode}
+	node.ent.Path = p
+	parent.children[path.Base(p)] = node
+	tnode.nlink++
+	return nil
+}
+
+// parent - return the directory the new entry at the clean absolute path p goes in.
+func (w *Writer) parent(p string) (*writerNode, error) {
+	if p == "/" {
+		return nil, fmt.Errorf("/: the root must be a directory")
+	}
+	parent := w.find(path.Dir(p))
+	if parent == nil || parent.children == nil {
+		return nil, fmt.Errorf("%s: %s is not a directory in the image", p, path.Dir(p))
+	}
+	if _, ok := parent.children[path.Base(p)]; ok {
+		return nil, fmt.Errorf("%s: already in the image", p)
+	}
+	return parent, nil
+}
+
+// find - return the node at the clean absolute path p, or nil.
+func (w *Writer) find(p string) *writerNode {
+	cur := w.root
+	for _, part := range strings.Split(strings.Trim(p, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if cur.children == nil {
+			return nil
+		}
+		if cur = cur.children[part]; cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+// writeData - feed the content of a regular file to the block processor.
+func (w *Writer) writeData(node *writerNode, r io.Reader) error {
+	// the processor updates the inode until it is finished, so the pointer to
+	// it has to live in C memory.
+	node.fileInode = (**C.sqfs_inode_generic_t)(C.calloc(1, C.size_t(unsafe.Sizeof(uintptr(0)))))
+	w.files = append(w.files, node)
+	if r := C.sqfs_block_processor_begin_file(w.dataProc, node.fileInode, nil, 0); r != 0 {
+		return fmt.Errorf("error starting file data: %s", sqfsErrorString(int(r)))
+	}
+
+	var written int64
+	if r != nil {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if r := C.sqfs_block_processor_append(w.dataProc, unsafe.Pointer(&buf[0]), C.size_t(n)); r != 0 {
+					return fmt.Errorf("error writing file data: %s", sqfsErrorString(int(r)))
+				}
+				written += int64(n)
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				C.sqfs_block_processor_end_file(w.dataProc)
+				return err
+			}
+		}
+	}
+
+	if r := C.sqfs_block_processor_end_file(w.dataProc); r != 0 {
+		return fmt.Errorf("error ending file data: %s", sqfsErrorString(int(r)))
+	}
+	if written != node.ent.Size {
+		return fmt.Errorf("wrote %d bytes, expected %d", written, node.ent.Size)
+	}
+	return nil
+}
+
+// Close - write the inode, directory, fragment, id and xattr tables and the
+// super block, and close the image.
+func (w *Writer) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	defer w.free()
+
+	if r := C.sqfs_block_processor_finish(w.dataProc); r != 0 {
+		return fmt.Errorf("error writing data blocks: %s", sqfsErrorString(int(r)))
+	}
+
+	// number the inodes: hard links share the inode of the node they link to.
+	count := uint32(0)
+	w.number(w.root, &count)
+	w.super.inode_count = C.sqfs_u32(count)
+	w.super.modification_time = C.sqfs_u32(w.root.ent.ModTime.Unix())
+
+	inodes := C.sqfs_meta_writer_create(w.file, w.compressor, 0)
+	dirs := C.sqfs_meta_writer_create(w.file, w.compressor, C.SQFS_META_WRITER_KEEP_IN_MEMORY)
+	if inodes != nil {
+		defer C.sqfs_destroy(unsafe.Pointer(inodes))
+	}
+	if dirs != nil {
+		defer C.sqfs_destroy(unsafe.Pointer(dirs))
+	}
+	if inodes == nil || dirs == nil {
+		return fmt.Errorf("error creating meta data writers")
+	}
+	dirWriter := C.sqfs_dir_writer_create(dirs, 0)
+	if dirWriter == nil {
+		return fmt.Errorf("error creating directory writer")
+	}
+	defer C.sqfs_destroy(unsafe.Pointer(dirWriter))
+
+	w.super.inode_table_start = C.sqfs_u64(C.file_size(w.file))
+	if err := w.writeInodes(w.root, count+1, inodes, dirWriter); err != nil {
+		return err
+	}
+	if r := C.sqfs_meta_writer_flush(inodes); r != 0 {
+		return fmt.Errorf("error writing inode table: %s", sqfsErrorString(int(r)))
+	}
+	if r := C.sqfs_meta_writer_flush(dirs); r != 0 {
+		return fmt.Errorf("error writing directory table: %s", sqfsErrorString(int(r)))
+	}
+	w.super.root_inode_ref = C.sqfs_u64(w.root.ref)
+	w.super.directory_table_start = C.sqfs_u64(C.file_size(w.file))
+	if r := C.sqfs_meta_write_write_to_file(dirs); r != 0 {
+		return fmt.Errorf("error writing directory table: %s", sqfsErrorString(int(r)))
+	}
+
+	if r := C.sqfs_frag_table_write(w.fragTable, w.file, w.super, w.compressor); r != 0 {
+		return fmt.Errorf("error writing fragment table: %s", sqfsErrorString(int(r)))
+	}
+	if r := C.sqfs_id_table_write(w.idTable, w.file, w.super, w.compressor); r != 0 {
+		return fmt.Errorf("error writing id table: %s", sqfsErrorString(int(r)))
+	}
+	if r := C.sqfs_xattr_writer_flush(w.xattrs, w.file, w.super, w.compressor); r != 0 {
+		return fmt.Errorf("error writing xattr table: %s", sqfsErrorString(int(r)))
+	}
+	if w.hasXattrs {
+		w.super.flags &^= C.SQFS_FLAG_NO_XATTRS
+	} else {
+		w.super.flags |= C.SQFS_FLAG_NO_XATTRS
+	}
+
+	w.super.bytes_used = C.sqfs_u64(C.file_size(w.file))
+	if r := C.sqfs_super_write(w.super, w.file); r != 0 {
+		return fmt.Errorf("error writing super block: %s", sqfsErrorString(int(r)))
+	}
+	bytesUsed := int64(w.super.bytes_used)
+	w.free()
+
+	if pad := bytesUsed % devBlockSize; pad != 0 {
+		return os.Truncate(w.Filename, bytesUsed+devBlockSize-pad)
+	}
+	return nil
+}
+
+// Discard - close the image without finishing it, and remove it.
+func (w *Writer) Discard() error {
+	if w.file == nil {
+		return nil
+	}
+	w.free()
+	return os.Remove(w.Filename)
+}
+
+// number - give node and what is below it inode numbers, in walk order.
+func (w *Writer) number(node *writerNode, count *uint32) {
+	if node.link == nil {
+		*count++
+		node.ino = *count
+	}
+	for _, name := range sortedNames(node.children) {
+		w.number(node.children[name], count)
+	}
+}
+
+// writeInodes - write the inodes below node and then node's, directories get
+// their entries written to dirWriter first.
+func (w *Writer) writeInodes(node *writerNode, parentIno uint32, inodes *C.sqfs_meta_writer_t,
+	dirWriter *C.sqfs_dir_writer_t) error {
+	if node.link != nil {
+		return nil
+	}
+	ent := node.ent
+
+	xattrIdx, err := w.writeXattrs(ent)
+	if err != nil {
+		return err
+	}
+
+	var inode *C.sqfs_inode_generic_t
+	if node.children != nil {
+		names := sortedNames(node.children)
+		subdirs := 0
+		for _, name := range names {
+			child := node.children[name]
+			if err := w.writeInodes(child, node.ino, inodes, dirWriter); err != nil {
+				return err
+			}
+			if child.children != nil {
+				subdirs++
+			}
+		}
+		if r := C.sqfs_dir_writer_begin(dirWriter, 0); r != 0 {
+			return fmt.Errorf("%s: error writing directory: %s", ent.Path, sqfsErrorString(int(r)))
+		}
+		for _, name := range names {
+			child := node.children[name]
+			if child.link != nil {
+				child = child.link
+			}
+			cname := C.CString(name)
+			r := C.sqfs_dir_writer_add_entry(dirWriter, cname, C.sqfs_u32(child.ino), C.sqfs_u64(child.ref),
+				C.sqfs_u16(unixMode(child.ent.Mode)))
+			C.free(unsafe.Pointer(cname))
+			if r != 0 {
+				return fmt.Errorf("%s: error adding %s: %s", ent.Path, name, sqfsErrorString(int(r)))
+			}
+		}
+		if r := C.sqfs_dir_writer_end(dirWriter); r != 0 {
+			return fmt.Errorf("%s: error writing directory: %s", ent.Path, sqfsErrorString(int(r)))
+		}
+		if inode = C.sqfs_dir_writer_create_inode(dirWriter, C.size_t(subdirs+2), C.sqfs_u32(xattrIdx),
+			C.sqfs_u32(parentIno)); inode == nil {
+			return fmt.Errorf("%s: error creating directory inode", ent.Path)
+		}
+		defer C.sqfs_free(unsafe.Pointer(inode))
+	} else if node.fileInode != nil {
+		inode = *node.fileInode
+		defer func() {
+			C.sqfs_free(unsafe.Pointer(inode))
+			C.free(unsafe.Pointer(node.fileInode))
+			node.fileInode = nil
+		}()
+		if node.nlink > 1 {
+			if r := C.sqfs_inode_make_extended(inode); r != 0 {
+				return fmt.Errorf("%s: %s", ent.Path, sqfsErrorString(int(r)))
+			}
+			(*C.sqfs_inode_file_ext_t)(unsafe.Pointer(&inode.data)).nlink = C.sqfs_u32(node.nlink)
+		}
+	} else {
+		inode = newInode(ent, node.nlink)
+		defer C.free(unsafe.Pointer(inode))
+	}
+
+	if node.children == nil && xattrIdx != noXattrIdx {
+		if r := C.sqfs_inode_set_xattr_index(inode, C.sqfs_u32(xattrIdx)); r != 0 {
+			return fmt.Errorf("%s: error setting xattrs: %s", ent.Path, sqfsErrorString(int(r)))
+		}
+	}
+
+	inode.base.mode = C.sqfs_u16(unixMode(ent.Mode))
+	inode.base.mod_time = C.sqfs_u32(ent.ModTime.Unix())
+	inode.base.inode_number = C.sqfs_u32(node.ino)
+	if r := C.sqfs_id_table_id_to_index(w.idTable, C.sqfs_u32(ent.Uid), &inode.base.uid_idx); r != 0 {
+		return fmt.Errorf("%s: error adding uid %d: %s", ent.Path, ent.Uid, sqfsErrorString(int(r)))
+	}
+	if r := C.sqfs_id_table_id_to_index(w.idTable, C.sqfs_u32(ent.Gid), &inode.base.gid_idx); r != 0 {
+		return fmt.Errorf("%s: error adding gid %d: %s", ent.Path, ent.Gid, sqfsErrorString(int(r)))
+	}
+
+	var block C.sqfs_u64
+	var offset C.sqfs_u32
+	C.sqfs_meta_writer_get_position(inodes, &block, &offset)
+	node.ref = uint64(block)<<16 | uint64(offset)
+	if r := C.sqfs_meta_writer_write_inode(inodes, inode); r != 0 {
+		return fmt.Errorf("%s: error writing inode: %s", ent.Path, sqfsErrorString(int(r)))
+	}
+	return nil
+}
+
+// writeXattrs - add the xattrs of ent to the xattr table, return their index.
+func (w *Writer) writeXattrs(ent TreeEntry) (uint32, error) {
+	if len(ent.Xattrs) == 0 {
+		return noXattrIdx, nil
+	}
+	if r := C.sqfs_xattr_writer_begin(w.xattrs, 0); r != 0 {
+		return noXattrIdx, fmt.Errorf("%s: error writing xattrs: %s", ent.Path, sqfsErrorString(int(r)))
+	}
+	keys := make([]string, 0, len(ent.Xattrs))
+	for k := range ent.Xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ckey := C.CString(k)
+		cval := C.CString(ent.Xattrs[k])
+		r := C.sqfs_xattr_writer_add(w.xattrs, ckey, unsafe.Pointer(cval), C.size_t(len(ent.Xattrs[k])))
+		C.free(unsafe.Pointer(ckey))
+		C.free(unsafe.Pointer(cval))
+		if r != 0 {
+			return noXattrIdx, fmt.Errorf("%s: error adding xattr %s: %s", ent.Path, k, sqfsErrorString(int(r)))
+		}
+	}
+	var idx C.sqfs_u32
+	if r := C.sqfs_xattr_writer_end(w.xattrs, &idx); r != 0 {
+		return noXattrIdx, fmt.Errorf("%s: error writing xattrs: %s", ent.Path, sqfsErrorString(int(r)))
+	}
+	w.hasXattrs = true
+	return uint32(idx), nil
+}
+
+// newInode - return a basic inode for the symlink, device, fifo or socket ent,
+// allocated with C.calloc.  Mode, times, ids and number are left to the caller.
+func newInode(ent TreeEntry, nlink int) *C.sqfs_inode_generic_t {
+	payload := 0
+	if ent.Type() == "symlink" {
+		payload = len(ent.LinkTarget)
+	}
+	inode := (*C.sqfs_inode_generic_t)(C.calloc(1, C.size_t(C.sizeof_sqfs_inode_generic_t+payload)))
+	inode.payload_bytes_available = C.sqfs_u32(payload)
+	inode.payload_bytes_used = C.sqfs_u32(payload)
+
+	dataPtr := unsafe.Pointer(&inode.data)
+	switch ent.Type() {
+	case "symlink":
+		inode.base._type = C.SQFS_INODE_SLINK
+		data := (*C.sqfs_inode_slink_t)(dataPtr)
+		data.nlink, data.target_size = C.sqfs_u32(nlink), C.sqfs_u32(payload)
+		if payload != 0 {
+			target := unsafe.Pointer(uintptr(unsafe.Pointer(inode)) + C.sizeof_sqfs_inode_generic_t)
+			C.memcpy(target, unsafe.Pointer(&[]byte(ent.LinkTarget)[0]), C.size_t(payload))
+		}
+	case "char", "block":
+		inode.base._type = C.SQFS_INODE_CDEV
+		if ent.Type() == "block" {
+			inode.base._type = C.SQFS_INODE_BDEV
+		}
+		data := (*C.sqfs_inode_dev_t)(dataPtr)
+		data.nlink, data.devno = C.sqfs_u32(nlink), C.sqfs_u32(ent.Rdev)
+	case "fifo", "socket":
+		inode.base._type = C.SQFS_INODE_FIFO
+		if ent.Type() == "socket" {
+			inode.base._type = C.SQFS_INODE_SOCKET
+		}
+		(*C.sqfs_inode_ipc_t)(dataPtr).nlink = C.sqfs_u32(nlink)
+	}
+	return inode
+}
+
+// free - release what libsquashfs allocated for w and close the image file.
+func (w *Writer) free() {
+	for _, node := range w.files {
+		if node.fileInode != nil {
+			C.sqfs_free(unsafe.Pointer(*node.fileInode))
+			C.free(unsafe.Pointer(node.fileInode))
+			node.fileInode = nil
+		}
+	}
+	// the block processor uses the block writer and fragment table, it goes first.
+	for _, obj := range []unsafe.Pointer{unsafe.Pointer(w.dataProc), unsafe.Pointer(w.blkWriter),
+		unsafe.Pointer(w.fragTable), unsafe.Pointer(w.idTable), unsafe.Pointer(w.xattrs),
+		unsafe.Pointer(w.compressor), unsafe.Pointer(w.file)} {
+		if obj != nil {
+			C.sqfs_destroy(obj)
+		}
+	}
+	w.dataProc, w.blkWriter, w.fragTable, w.idTable, w.xattrs = nil, nil, nil, nil, nil
+	w.compressor, w.file = nil, nil
+	if w.super != nil {
+		C.free(unsafe.Pointer(w.super))
+		w.super = nil
+	}
+}
+
+// sortedNames - return the names of children in the order squashfs directories need.
+func sortedNames(children map[string]*writerNode) []string {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unixMode - return mode as a unix mode, file type bits included.
+func unixMode(mode os.FileMode) uint32 {
+	perms := unixPerms(mode)
+	switch fileType(mode) {
+	case "dir":
+		return perms | syscall.S_IFDIR
+	case "symlink":
+		return perms | syscall.S_IFLNK
+	case "char":
+		return perms | syscall.S_IFCHR
+	case "block":
+		return perms | syscall.S_IFBLK
+	case "fifo":
+		return perms | syscall.S_IFIFO
+	case "socket":
+		return perms | syscall.S_IFSOCK
+	}
+	return perms | syscall.S_IFREG
+}
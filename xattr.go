@@ -0,0 +1,88 @@
+package squashfs
+
+// #cgo pkg-config: libsquashfs1
+// #include <stdlib.h>
+// #include <sqfs/predef.h>
+// #include <sqfs/inode.h>
+// #include <sqfs/xattr.h>
+// #include <sqfs/xattr_reader.h>
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// noXattrIdx - xattr index of an inode that carries no extended attributes.
+const noXattrIdx = 0xFFFFFFFF
+
+func sqfsXattrReaderTCopy(xr *C.sqfs_xattr_reader_t) *C.sqfs_xattr_reader_t {
+	return (*C.sqfs_xattr_reader_t)(unsafe.Pointer(C.sqfs_copy(unsafe.Pointer(xr))))
+}
+
+// sqfsXattrEntryTKey - return the full key (prefix included) of a sqfs_xattr_entry_t.
+func sqfsXattrEntryTKey(ent *C.sqfs_xattr_entry_t) string {
+	// sqfs_xattr_reader_read_key puts the prefix in front of the key and NUL
+	// terminates it, size does not count the prefix.  key is a flexible array
+	// member cgo can not reach, so it is found right after the struct.
+	key := unsafe.Pointer(uintptr(unsafe.Pointer(ent)) + C.sizeof_sqfs_xattr_entry_t)
+	return C.GoString((*C.char)(key))
+}
+
+// sqfsXattrValueTValue - return the value of a sqfs_xattr_value_t.
+func sqfsXattrValueTValue(val *C.sqfs_xattr_value_t) string {
+	structSize := C.int(C.sizeof_sqfs_xattr_value_t)
+	b := C.GoBytes(unsafe.Pointer(val), structSize+C.int(val.size))
+	return string(b[structSize:])
+}
+
+// Xattrs - return the extended attributes of the file, keyed by full name (e.g. "user.foo").
+func (f *File) Xattrs() (map[string]string, error) {
+	var idx C.sqfs_u32
+	var desc C.sqfs_xattr_id_t
+	xattrs := map[string]string{}
+
+	if f.SquashFs.xattrErr != nil {
+		return xattrs, f.SquashFs.xattrErr
+	}
+	if f.SquashFs.xattrReader == nil {
+		return xattrs, nil
+	}
+
+	if r := C.sqfs_inode_get_xattr_index(f.inode, &idx); r != 0 {
+		return xattrs, fmt.Errorf("error getting xattr index for %s (%d)", f.Filename, r)
+	}
+	if idx == noXattrIdx {
+		return xattrs, nil
+	}
+
+	xr := sqfsXattrReaderTCopy(f.SquashFs.xattrReader)
+	if xr == nil {
+		return xattrs, fmt.Errorf("failed to create a xattr reader for %s", f.Filename)
+	}
+	defer C.sqfs_destroy(unsafe.Pointer(xr))
+
+	if r := C.sqfs_xattr_reader_get_desc(xr, idx, &desc); r != 0 {
+		return xattrs, fmt.Errorf("error reading xattr descriptor %d for %s (%d)", idx, f.Filename, r)
+	}
+	if r := C.sqfs_xattr_reader_seek_kv(xr, &desc); r != 0 {
+		return xattrs, fmt.Errorf("error seeking to xattrs of %s (%d)", f.Filename, r)
+	}
+
+	for i := C.sqfs_u32(0); i < desc.count; i++ {
+		var key *C.sqfs_xattr_entry_t
+		var val *C.sqfs_xattr_value_t
+		if r := C.sqfs_xattr_reader_read_key(xr, &key); r != 0 {
+			return xattrs, fmt.Errorf("error reading xattr key of %s (%d)", f.Filename, r)
+		}
+		if r := C.sqfs_xattr_reader_read_value(xr, key, &val); r != 0 {
+			C.sqfs_free(unsafe.Pointer(key))
+			return xattrs, fmt.Errorf("error reading xattr value of %s (%d)", f.Filename, r)
+		}
+		xattrs[sqfsXattrEntryTKey(key)] = sqfsXattrValueTValue(val)
+		C.sqfs_free(unsafe.Pointer(key))
+		C.sqfs_free(unsafe.Pointer(val))
+	}
+
+	return xattrs, nil
+}